@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+)
+
+// batchJob is a single input file and the path its output is written to
+type batchJob struct {
+	inPath  string
+	outPath string
+}
+
+// batchResult is the outcome of a batchJob
+type batchResult struct {
+	job     batchJob
+	skipped bool
+	err     error
+}
+
+// runBatch applies a chain of effects to every file matching the input globs or inside the input
+// directories, processing workers files at the same time
+func runBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	var specs specFlags
+	fs.Var(&specs, "effect", "An effect to apply, written as name:param=value,param=value. Can be repeated to chain effects")
+	specPath := fs.String("spec", "", "Path to a JSON or YAML pipeline spec, applied before any -effect flags")
+	out := fs.String("out", "", "The output directory, or a filename template using {dir}, {name} and {ext} e.g. out/{name}-oil{ext}")
+	workers := countVar(fs, "workers", 0, "The number of files processed at the same time, 0 uses the number of CPUs")
+	routines := countVar(fs, "routines", 1, "The number of goroutines used to process each image, 0 uses the number of CPUs")
+	overwrite := fs.Bool("overwrite", false, "Process files even if the output file already exists")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: goeffects batch -out DIR|TEMPLATE [-effect ...] [-spec path] input...")
+		fmt.Fprintln(fs.Output(), "  Each input is a file, glob or directory")
+		fmt.Fprintln(fs.Output(), "Sample usage: goeffects batch -effect pixelate:blockSize=12 -out out/{name}-pixelate{ext} 'photos/*.jpg'")
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+
+	inputs, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" || len(inputs) == 0 {
+		fs.Usage()
+		return errors.New("An output directory or template and at least one input are required")
+	}
+
+	pipelineSpec, err := chainSpec(*specPath, specs)
+	if err != nil {
+		return err
+	}
+	// Make sure the spec is valid before starting any work
+	if _, err := effects.NewPipeline(pipelineSpec); err != nil {
+		return err
+	}
+
+	inPaths, err := expandInputs(inputs)
+	if err != nil {
+		return err
+	}
+	if len(inPaths) == 0 {
+		return errors.New("No input images found")
+	}
+	jobs, err := batchJobs(inPaths, *out)
+	if err != nil {
+		return err
+	}
+
+	numWorkers := *workers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+
+	jobCh := make(chan batchJob, len(jobs))
+	for _, job := range jobs {
+		jobCh <- job
+	}
+	close(jobCh)
+
+	resultCh := make(chan batchResult)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+
+			// Each worker has its own pipeline so effects are never shared between goroutines
+			pipeline, _ := effects.NewPipeline(pipelineSpec)
+			for job := range jobCh {
+				resultCh <- runBatchJob(pipeline, job, *routines, *overwrite)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var failed []batchResult
+	processed, skipped, done := 0, 0, 0
+	for result := range resultCh {
+		done++
+		switch {
+		case result.err != nil:
+			failed = append(failed, result)
+			fmt.Printf("[%d/%d] failed %s: %s\n", done, len(jobs), result.job.inPath, result.err)
+		case result.skipped:
+			skipped++
+			fmt.Printf("[%d/%d] skipped %s, %s already exists\n", done, len(jobs), result.job.inPath, result.job.outPath)
+		default:
+			processed++
+			fmt.Printf("[%d/%d] %s -> %s\n", done, len(jobs), result.job.inPath, result.job.outPath)
+		}
+	}
+
+	fmt.Printf("\nProcessed: %d, skipped: %d, failed: %d\n", processed, skipped, len(failed))
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].job.inPath < failed[j].job.inPath
+	})
+	fmt.Println("\nFailures:")
+	for _, result := range failed {
+		fmt.Printf("  %s: %s\n", result.job.inPath, result.err)
+	}
+	return fmt.Errorf("%d of %d files failed", len(failed), len(jobs))
+}
+
+func runBatchJob(pipeline *effects.Pipeline, job batchJob, numRoutines int, overwrite bool) batchResult {
+	if !overwrite {
+		if _, err := os.Stat(job.outPath); err == nil {
+			return batchResult{job: job, skipped: true}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(job.outPath), 0755); err != nil {
+		return batchResult{job: job, err: err}
+	}
+
+	// The output is written to a temporary file that is renamed once it is complete, so a failed
+	// or interrupted run never leaves a partial file that later runs would skip
+	ext := filepath.Ext(job.outPath)
+	tmp, err := os.CreateTemp(filepath.Dir(job.outPath), "."+strings.TrimSuffix(filepath.Base(job.outPath), ext)+"-*"+ext)
+	if err != nil {
+		return batchResult{job: job, err: err}
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	err = process(pipeline, job.inPath, tmpPath, numRoutines)
+	if err == nil {
+		err = os.Rename(tmpPath, job.outPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return batchResult{job: job, err: err}
+}
+
+// expandInputs returns the sorted, unique image paths matching each input. An input can be a path
+// to a file, a glob or a directory, in which case every image in the directory is included
+func expandInputs(inputs []string) ([]string, error) {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, input := range inputs {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid input %s: %s", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No files match: %s", input)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+				if _, err := effects.FormatFromPath(entry.Name()); err != nil {
+					continue
+				}
+				add(filepath.Join(match, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// batchJobs pairs each input path with its output path. If out contains a { it is a template,
+// otherwise it is a directory and each output has the same name as its input
+func batchJobs(inPaths []string, out string) ([]batchJob, error) {
+	if !strings.Contains(out, "{") {
+		out = filepath.Join(out, "{name}{ext}")
+	}
+
+	outputs := map[string]string{}
+	jobs := make([]batchJob, 0, len(inPaths))
+	for _, inPath := range inPaths {
+		ext := filepath.Ext(inPath)
+		outPath := strings.NewReplacer(
+			"{dir}", filepath.Dir(inPath),
+			"{name}", strings.TrimSuffix(filepath.Base(inPath), ext),
+			"{ext}", ext,
+		).Replace(out)
+
+		if filepath.Clean(outPath) == filepath.Clean(inPath) {
+			return nil, fmt.Errorf("The output for %s would overwrite the input", inPath)
+		}
+		if other, ok := outputs[outPath]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, inPath, outPath)
+		}
+		outputs[outPath] = inPath
+		jobs = append(jobs, batchJob{inPath: inPath, outPath: outPath})
+	}
+	return jobs, nil
+}
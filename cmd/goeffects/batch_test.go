@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestImage(t, dir, "a.png")
+	b := writeTestImage(t, dir, "b.png")
+	sub := filepath.Join(dir, "sub")
+	require.Nil(t, os.Mkdir(sub, 0755))
+	c := writeTestImage(t, sub, "c.png")
+	require.Nil(t, os.WriteFile(filepath.Join(sub, "notes.txt"), []byte("not an image"), 0644))
+	require.Nil(t, os.Mkdir(filepath.Join(sub, "nested"), 0755))
+
+	// Directories include the images directly inside them, paths matched more than once are
+	// only included once and the result is sorted
+	paths, err := expandInputs([]string{sub, filepath.Join(dir, "*.png"), a})
+	require.Nil(t, err)
+	require.Equal(t, []string{a, b, c}, paths)
+
+	paths, err = expandInputs([]string{b})
+	require.Nil(t, err)
+	require.Equal(t, []string{b}, paths)
+
+	_, err = expandInputs([]string{filepath.Join(dir, "*.jpg")})
+	require.NotNil(t, err)
+	_, err = expandInputs([]string{filepath.Join(dir, "missing.png")})
+	require.NotNil(t, err)
+	_, err = expandInputs([]string{filepath.Join(dir, "[")})
+	require.NotNil(t, err)
+}
+
+func TestBatchJobs(t *testing.T) {
+	inPaths := []string{filepath.Join("photos", "a.jpg"), filepath.Join("more", "b.png")}
+
+	// A directory keeps the name of each input
+	jobs, err := batchJobs(inPaths, "out")
+	require.Nil(t, err)
+	require.Equal(t, []batchJob{
+		{inPath: inPaths[0], outPath: filepath.Join("out", "a.jpg")},
+		{inPath: inPaths[1], outPath: filepath.Join("out", "b.png")},
+	}, jobs)
+
+	jobs, err = batchJobs(inPaths, "{dir}/{name}-oil.gif")
+	require.Nil(t, err)
+	require.Equal(t, "photos/a-oil.gif", filepath.ToSlash(jobs[0].outPath))
+	require.Equal(t, "more/b-oil.gif", filepath.ToSlash(jobs[1].outPath))
+
+	jobs, err = batchJobs(inPaths, "out/{name}{ext}")
+	require.Nil(t, err)
+	require.Equal(t, "out/b.png", filepath.ToSlash(jobs[1].outPath))
+
+	_, err = batchJobs(inPaths, "{dir}/{name}{ext}")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "overwrite the input")
+	_, err = batchJobs(inPaths, "photos")
+	require.NotNil(t, err)
+	_, err = batchJobs([]string{filepath.Join("photos", "a.jpg"), filepath.Join("more", "a.png")}, "out/{name}.jpg")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "would both be written to")
+}
+
+func TestRunBatchJob(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestImage(t, dir, "in.png")
+	pipeline, err := effects.NewPipeline(effects.PipelineSpec{Effects: []effects.EffectSpec{{Effect: "sepia"}}})
+	require.Nil(t, err)
+
+	job := batchJob{inPath: in, outPath: filepath.Join(dir, "out", "in.jpg")}
+	result := runBatchJob(pipeline, job, 0, false)
+	require.Nil(t, result.err)
+	require.False(t, result.skipped)
+	_, err = effects.LoadImage(job.outPath)
+	require.Nil(t, err)
+
+	result = runBatchJob(pipeline, job, 0, false)
+	require.Nil(t, result.err)
+	require.True(t, result.skipped)
+	result = runBatchJob(pipeline, job, 0, true)
+	require.Nil(t, result.err)
+	require.False(t, result.skipped)
+
+	// webp can't be encoded, so saving fails part way through and nothing is left behind
+	// that a later run would mistake for a finished output
+	job = batchJob{inPath: in, outPath: filepath.Join(dir, "out", "in.webp")}
+	result = runBatchJob(pipeline, job, 0, false)
+	require.NotNil(t, result.err)
+	result = runBatchJob(pipeline, job, 0, false)
+	require.NotNil(t, result.err)
+	require.False(t, result.skipped)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "out"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "in.jpg", entries[0].Name())
+}
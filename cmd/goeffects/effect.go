@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+)
+
+// errUsage is returned when the command line is invalid and the problem has already been printed
+var errUsage = errors.New("invalid usage")
+
+const (
+	borderParam      = "border"
+	borderColorParam = "borderColor"
+)
+
+// paramValue is a flag.Value for an effect parameter, values are validated against the
+// ParamInfo as they are parsed
+type paramValue struct {
+	info  effects.ParamInfo
+	value interface{}
+}
+
+func (v *paramValue) String() string {
+	if v == nil || v.value == nil {
+		return ""
+	}
+	return fmt.Sprint(v.value)
+}
+
+func (v *paramValue) Set(s string) error {
+	value, err := v.info.Parse(s)
+	if err != nil {
+		return err
+	}
+	v.value = value
+	return nil
+}
+
+// IsBoolFlag allows bool params to be passed as -invert instead of -invert=true
+func (v *paramValue) IsBoolFlag() bool {
+	return v.info.Type == effects.ParamBool
+}
+
+// specFlags is a flag.Value collecting each -effect name:key=value,... flag
+type specFlags []effects.EffectSpec
+
+func (s *specFlags) String() string {
+	var names []string
+	for _, spec := range *s {
+		names = append(names, spec.Effect)
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *specFlags) Set(value string) error {
+	spec, err := parseEffectArg(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, spec)
+	return nil
+}
+
+// countFlag is a flag.Value for a number of goroutines or workers, negative values are rejected
+type countFlag int
+
+func (c *countFlag) String() string {
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("must be a whole number")
+	}
+	if v < 0 {
+		return fmt.Errorf("must not be negative, got: %d", v)
+	}
+	*c = countFlag(v)
+	return nil
+}
+
+// countVar defines a countFlag with the default value and returns a pointer to its value
+func countVar(fs *flag.FlagSet, name string, value int, usage string) *int {
+	c := countFlag(value)
+	fs.Var(&c, name, usage)
+	return (*int)(&c)
+}
+
+// runEffect runs the subcommand for a single effect, each of the effect's params is a named flag
+func runEffect(info effects.EffectInfo, args []string) error {
+	fs := flag.NewFlagSet(info.Name, flag.ContinueOnError)
+	routines := countVar(fs, "routines", 0, "The number of goroutines used to process the image, 0 uses the number of CPUs")
+	values := map[string]*paramValue{}
+	for _, pi := range info.Params {
+		v := &paramValue{info: pi}
+		values[pi.Name] = v
+		fs.Var(v, pi.Name, paramUsage(pi))
+	}
+	border := fs.String(borderParam, "", "How pixels outside the image are treated by kernel effects: shrink|clamp|mirror|wrap|constant")
+	borderColor := fs.String(borderColorParam, "", "The color used by the constant border mode, e.g. #ff0000")
+	fs.Usage = func() {
+		printEffect(fs.Output(), info)
+		fs.VisitAll(func(f *flag.Flag) {
+			if _, ok := values[f.Name]; !ok {
+				fmt.Fprintf(fs.Output(), "  -%s: %s\n", f.Name, f.Usage)
+			}
+		})
+	}
+
+	paths, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		fs.Usage()
+		return fmt.Errorf("The %s effect requires an input path and an output path", info.Name)
+	}
+
+	spec := effects.EffectSpec{Effect: info.Name, Params: effects.Params{}}
+	for name, v := range values {
+		if v.value != nil {
+			spec.Params[name] = v.value
+		}
+	}
+	if *border != "" {
+		spec.Params[borderParam] = *border
+	}
+	if *borderColor != "" {
+		spec.Params[borderColorParam] = *borderColor
+	}
+
+	pipeline, err := effects.NewPipeline(effects.PipelineSpec{Effects: []effects.EffectSpec{spec}})
+	if err != nil {
+		return err
+	}
+	return process(pipeline, paths[0], paths[1], *routines)
+}
+
+// runChain applies the effects given by -spec and -effect flags, in that order. For compatibility
+// a single -effect=name flag can be followed by the effect's params as positional args
+func runChain(args []string) error {
+	fs := flag.NewFlagSet("goeffects", flag.ContinueOnError)
+	var specs specFlags
+	fs.Var(&specs, "effect", "An effect to apply, written as name:param=value,param=value. Can be repeated to chain effects")
+	specPath := fs.String("spec", "", "Path to a JSON or YAML pipeline spec, applied before any -effect flags")
+	routines := countVar(fs, "routines", 0, "The number of goroutines used to process the image, 0 uses the number of CPUs")
+	fs.Usage = func() {
+		usage(fs.Output())
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+
+	paths, err := parseInterleaved(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) > 2 && len(specs) == 1 && len(specs[0].Params) == 0 {
+		specs[0], err = parsePositional(specs[0].Effect, paths[2:])
+		if err != nil {
+			return err
+		}
+		paths = paths[:2]
+	}
+	if len(paths) != 2 {
+		fs.Usage()
+		return errors.New("An input path and an output path are required")
+	}
+
+	pipelineSpec, err := chainSpec(*specPath, specs)
+	if err != nil {
+		return err
+	}
+	pipeline, err := effects.NewPipeline(pipelineSpec)
+	if err != nil {
+		return err
+	}
+	return process(pipeline, paths[0], paths[1], *routines)
+}
+
+// chainSpec returns the effects in the pipeline spec at specPath, if any, followed by specs
+func chainSpec(specPath string, specs specFlags) (effects.PipelineSpec, error) {
+	var pipelineSpec effects.PipelineSpec
+	if specPath != "" {
+		loaded, err := effects.LoadPipeline(specPath)
+		if err != nil {
+			return pipelineSpec, err
+		}
+		if pipelineSpec, err = loaded.Spec(); err != nil {
+			return pipelineSpec, err
+		}
+	}
+	pipelineSpec.Effects = append(pipelineSpec.Effects, specs...)
+	if len(pipelineSpec.Effects) == 0 {
+		return pipelineSpec, errors.New("At least one effect is required, use -effect or -spec")
+	}
+	return pipelineSpec, nil
+}
+
+func process(pipeline *effects.Pipeline, inPath, outPath string, numRoutines int) error {
+	inFormat, _ := effects.FormatFromPath(inPath)
+	outFormat, _ := effects.FormatFromPath(outPath)
+	if inFormat == effects.FormatGIF && outFormat == effects.FormatGIF {
+		return processAnimation(pipeline, inPath, outPath, numRoutines)
+	}
+
+	img, md, err := effects.LoadImageWithMetadata(inPath, effects.LoadOpts{})
+	if err != nil {
+		return err
+	}
+
+	outImg, err := pipeline.RunContext(context.Background(), img, numRoutines)
+	if err != nil {
+		return fmt.Errorf("Failed to apply effect: %s", err)
+	}
+	if err := outImg.Save(outPath, effects.SaveOpts{ClipToBounds: true, Metadata: md, GIFQuantizer: effects.Quantizer{}}); err != nil {
+		return fmt.Errorf("Failed to save modified image: %s", err)
+	}
+	return nil
+}
+
+// processAnimation applies the pipeline to every frame of a GIF, so animations stay animated
+func processAnimation(pipeline *effects.Pipeline, inPath, outPath string, numRoutines int) error {
+	anim, err := effects.LoadAnimation(inPath)
+	if err != nil {
+		return err
+	}
+
+	outAnim, err := anim.ApplyContext(context.Background(), pipeline, numRoutines)
+	if err != nil {
+		return fmt.Errorf("Failed to apply effect: %s", err)
+	}
+	if err := outAnim.Save(outPath, effects.AnimationOpts{ClipToBounds: true, Quantizer: effects.Quantizer{}}); err != nil {
+		return fmt.Errorf("Failed to save modified animation: %s", err)
+	}
+	return nil
+}
+
+// parseInterleaved parses args allowing flags to come after positional args, e.g. in.jpg out.jpg -levels=5
+func parseInterleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			// The flag package has already printed the error and usage
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseEffectArg parses an effect written as name:param=value,param=value. Param names can be
+// shortened to any unique prefix. Values of kernel params contain commas, so a part without
+// an = is added to the value of the previous param, e.g. convolution:kernel=0,1,0;1,-4,1;0,1,0
+func parseEffectArg(s string) (effects.EffectSpec, error) {
+	parts := strings.SplitN(s, ":", 2)
+	info, ok := effects.LookupEffect(parts[0])
+	if !ok {
+		return effects.EffectSpec{}, fmt.Errorf("unknown effect: %s", parts[0])
+	}
+
+	var pairs []string
+	if len(parts) == 2 && parts[1] != "" {
+		for _, part := range strings.Split(parts[1], ",") {
+			if len(pairs) > 0 && !strings.Contains(part, "=") {
+				pairs[len(pairs)-1] += "," + part
+				continue
+			}
+			pairs = append(pairs, part)
+		}
+	}
+
+	spec := effects.EffectSpec{Effect: info.Name, Params: effects.Params{}}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return spec, fmt.Errorf("%s: expected param=value, got: %s", info.Name, pair)
+		}
+		if err := setParam(spec, info, kv[0], kv[1]); err != nil {
+			return spec, err
+		}
+	}
+	return spec, nil
+}
+
+// setParam parses value and sets it in the spec as the param named key, or the only param whose
+// name starts with key. The border params can also be set
+func setParam(spec effects.EffectSpec, info effects.EffectInfo, key, value string) error {
+	if key == borderParam || key == borderColorParam {
+		spec.Params[key] = value
+		return nil
+	}
+	pi, err := lookupParam(info, key)
+	if err != nil {
+		return err
+	}
+	v, err := pi.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s: %s", info.Name, err)
+	}
+	spec.Params[pi.Name] = v
+	return nil
+}
+
+// lookupParam finds the param named key, or the only param whose name starts with key
+func lookupParam(info effects.EffectInfo, key string) (effects.ParamInfo, error) {
+	if pi, ok := info.Param(key); ok {
+		return pi, nil
+	}
+	var matches []effects.ParamInfo
+	for _, pi := range info.Params {
+		if strings.HasPrefix(pi.Name, key) {
+			matches = append(matches, pi)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return effects.ParamInfo{}, fmt.Errorf("%s: unknown parameter: %s", info.Name, key)
+	case 1:
+		return matches[0], nil
+	default:
+		return effects.ParamInfo{}, fmt.Errorf("%s: ambiguous parameter: %s", info.Name, key)
+	}
+}
+
+// parsePositional builds a spec from positional args, which are given in the same order as the
+// effect's params. Trailing params that are not given use their default value
+func parsePositional(name string, args []string) (effects.EffectSpec, error) {
+	info, ok := effects.LookupEffect(name)
+	if !ok {
+		return effects.EffectSpec{}, fmt.Errorf("unknown effect: %s", name)
+	}
+	spec := effects.EffectSpec{Effect: info.Name, Params: effects.Params{}}
+	if len(args) > len(info.Params) {
+		return spec, fmt.Errorf("The %s effect takes at most %d params, got: %d", info.Name, len(info.Params), len(args))
+	}
+	for i, arg := range args {
+		pi := info.Params[i]
+		v, err := pi.Parse(arg)
+		if err != nil {
+			return spec, err
+		}
+		spec.Params[pi.Name] = v
+	}
+	return spec, nil
+}
+
+func paramUsage(pi effects.ParamInfo) string {
+	usage := pi.Description
+	if pi.Default == nil {
+		usage += ", required"
+	}
+	if pi.Max > pi.Min {
+		usage += fmt.Sprintf(", %v to %v", pi.Min, pi.Max)
+	}
+	if pi.Odd {
+		usage += ", odd"
+	}
+	if len(pi.Values) > 0 {
+		usage += ", one of " + strings.Join(pi.Values, "|")
+	}
+	if pi.Default != nil {
+		usage += fmt.Sprintf(" (default %v)", pi.Default)
+	}
+	return usage
+}
+
+func printEffect(w io.Writer, info effects.EffectInfo) {
+	fmt.Fprintf(w, "%s - %s\n", info.Name, info.Description)
+	fmt.Fprintf(w, "  usage: goeffects %s [flags] input output\n", info.Name)
+	for _, pi := range info.Params {
+		fmt.Fprintf(w, "  -%s %s: %s\n", pi.Name, pi.Type, paramUsage(pi))
+	}
+}
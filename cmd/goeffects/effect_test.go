@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestImage saves a small gradient image to a png file in dir and returns its path
+func writeTestImage(t *testing.T, dir, name string) string {
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 32), B: 100, A: 255})
+		}
+	}
+	path := filepath.Join(dir, name)
+	require.Nil(t, effects.FromImage(src).Save(path, effects.SaveOpts{}))
+	return path
+}
+
+func TestParseEffectArg(t *testing.T) {
+	spec, err := parseEffectArg("oil:f=7,levels=20")
+	require.Nil(t, err)
+	require.Equal(t, effects.EffectSpec{Effect: "oil", Params: effects.Params{"filterSize": 7, "levels": 20}}, spec)
+
+	// No params uses the defaults
+	spec, err = parseEffectArg("sepia")
+	require.Nil(t, err)
+	require.Equal(t, effects.EffectSpec{Effect: "sepia", Params: effects.Params{}}, spec)
+
+	// The commas inside a kernel are joined back together
+	spec, err = parseEffectArg("convolution:kernel=0,1,0;1,-4,1;0,1,0,divisor=1,ch=luminance")
+	require.Nil(t, err)
+	require.Equal(t, [][]float64{{0, 1, 0}, {1, -4, 1}, {0, 1, 0}}, spec.Params["kernel"])
+	require.Equal(t, 1.0, spec.Params["divisor"])
+	require.Equal(t, "luminance", spec.Params["channels"])
+
+	spec, err = parseEffectArg("gaussian:sigma=2,border=mirror")
+	require.Nil(t, err)
+	require.Equal(t, "mirror", spec.Params[borderParam])
+
+	invalid := []string{
+		"unknown",
+		"oil:5",
+		"oil:unknown=5",
+		"oil:levels=many",
+		"levels:in=10",
+		"levels:inB=300",
+	}
+	for _, arg := range invalid {
+		_, err = parseEffectArg(arg)
+		require.NotNil(t, err, arg)
+	}
+	_, err = parseEffectArg("levels:in=10")
+	require.Contains(t, err.Error(), "ambiguous")
+}
+
+func TestParsePositional(t *testing.T) {
+	// Params are in the order they are registered, trailing params use their defaults
+	spec, err := parsePositional("oil", []string{"7", "20"})
+	require.Nil(t, err)
+	require.Equal(t, effects.Params{"filterSize": 7, "levels": 20}, spec.Params)
+	spec, err = parsePositional("oil", []string{"7"})
+	require.Nil(t, err)
+	require.Equal(t, effects.Params{"filterSize": 7}, spec.Params)
+
+	_, err = parsePositional("oil", []string{"7", "20", "3"})
+	require.NotNil(t, err)
+	_, err = parsePositional("oil", []string{"big"})
+	require.NotNil(t, err)
+	_, err = parsePositional("unknown", nil)
+	require.NotNil(t, err)
+}
+
+func TestParseInterleaved(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	levels := fs.Int("levels", 0, "")
+	invert := fs.Bool("invert", false, "")
+	routines := countVar(fs, "routines", 2, "")
+
+	positional, err := parseInterleaved(fs, []string{"in.jpg", "-levels=5", "out.jpg", "-invert", "extra"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"in.jpg", "out.jpg", "extra"}, positional)
+	require.Equal(t, 5, *levels)
+	require.True(t, *invert)
+	require.Equal(t, 2, *routines)
+
+	_, err = parseInterleaved(fs, []string{"in.jpg", "-unknown"})
+	require.Equal(t, errUsage, err)
+	_, err = parseInterleaved(fs, []string{"-routines=-1"})
+	require.Equal(t, errUsage, err)
+	_, err = parseInterleaved(fs, []string{"-routines=1.5"})
+	require.Equal(t, errUsage, err)
+	_, err = parseInterleaved(fs, []string{"-routines=3"})
+	require.Nil(t, err)
+	require.Equal(t, 3, *routines)
+	_, err = parseInterleaved(fs, []string{"-help"})
+	require.Equal(t, flag.ErrHelp, err)
+}
+
+func TestRunChain(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestImage(t, dir, "in.png")
+	out := filepath.Join(dir, "out.png")
+
+	// The legacy form, a single -effect flag followed by its params as positional args
+	require.Nil(t, runChain([]string{"-effect=pixelate", in, out, "4"}))
+	img, err := effects.LoadImage(out)
+	require.Nil(t, err)
+	rgba := img.ToRGBA()
+	require.Equal(t, rgba.RGBAAt(0, 0), rgba.RGBAAt(3, 3))
+	require.NotEqual(t, rgba.RGBAAt(0, 0), rgba.RGBAAt(4, 0))
+
+	require.Nil(t, runChain([]string{"-effect", "grayscale:algo=average", "-effect", "brightness:offset=10", in, out}))
+	img, err = effects.LoadImage(out)
+	require.Nil(t, err)
+	c := img.ToRGBA().RGBAAt(5, 5)
+	require.Equal(t, c.R, c.G)
+
+	require.Equal(t, errUsage, runChain([]string{"-routines=-2", "-effect=sepia", in, out}))
+	require.Equal(t, errUsage, runEffect(mustLookup(t, "sepia"), []string{"-routines", "-1", in, out}))
+	require.NotNil(t, runChain([]string{in, out}))
+	require.NotNil(t, runChain([]string{"-effect=sepia", in}))
+}
+
+func mustLookup(t *testing.T, name string) effects.EffectInfo {
+	info, ok := effects.LookupEffect(name)
+	require.True(t, ok, name)
+	return info
+}
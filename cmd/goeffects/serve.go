@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+)
+
+// server exposes the registered effects over HTTP
+type server struct {
+	// sem bounds the number of images processed at the same time
+	sem         chan struct{}
+	numRoutines int
+	maxBytes    int64
+	maxWidth    int
+	maxHeight   int
+}
+
+// httpError is an error with the HTTP status code that should be returned to the client
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func newHTTPError(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// paramJSON and effectJSON describe an effect to clients of GET /effects
+type paramJSON struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Odd         bool        `json:"odd,omitempty"`
+	Values      []string    `json:"values,omitempty"`
+}
+
+type effectJSON struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Params      []paramJSON `json:"params"`
+}
+
+// runServe starts an HTTP server exposing the effects
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "The address to listen on")
+	concurrency := countVar(fs, "concurrency", 0, "The number of images processed at the same time, 0 uses the number of CPUs")
+	routines := countVar(fs, "routines", 0, "The number of goroutines used to process each image, 0 uses the number of CPUs")
+	maxBytes := fs.Int64("max-bytes", 20<<20, "The maximum size of an uploaded image in bytes")
+	maxWidth := fs.Int("max-width", 8192, "The maximum width of an uploaded image, or of the image after any effect")
+	maxHeight := fs.Int("max-height", 8192, "The maximum height of an uploaded image, or of the image after any effect")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `Usage: goeffects serve [flags]
+
+Endpoints:
+  GET  /effects
+      Lists the effects and their params as JSON
+  POST /effects/NAME?param=value&format=png
+      Applies the effect to the image, which is the request body or the "image" field of a
+      multipart form. Params are set in the query string
+  POST /pipeline?format=png
+      Applies a JSON pipeline spec, sent as the "spec" field of a multipart form along with
+      the "image" field, or as the spec query param with the image as the request body
+
+The format and quality (for jpeg) query params select the output, by default the output has
+the same format as the input
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+
+	if _, err := parseInterleaved(fs, args); err != nil {
+		return err
+	}
+
+	n := *concurrency
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	s := &server{
+		sem:         make(chan struct{}, n),
+		numRoutines: *routines,
+		maxBytes:    *maxBytes,
+		maxWidth:    *maxWidth,
+		maxHeight:   *maxHeight,
+	}
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("goeffects listening on %s", *addr)
+	return httpServer.ListenAndServe()
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/effects", s.handleList)
+	mux.HandleFunc("/effects/", s.handleEffect)
+	mux.HandleFunc("/pipeline", s.handlePipeline)
+	return mux
+}
+
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var infos []effectJSON
+	for _, info := range effects.Effects() {
+		e := effectJSON{Name: info.Name, Description: info.Description, Params: []paramJSON{}}
+		for _, pi := range info.Params {
+			p := paramJSON{
+				Name:        pi.Name,
+				Description: pi.Description,
+				Type:        pi.Type.String(),
+				Default:     pi.Default,
+				Required:    pi.Default == nil,
+				Odd:         pi.Odd,
+				Values:      pi.Values,
+			}
+			if c, ok := pi.Default.(color.RGBA); ok {
+				p.Default = effects.FormatColor(c)
+			}
+			if pi.Max > pi.Min {
+				lo, hi := pi.Min, pi.Max
+				p.Min, p.Max = &lo, &hi
+			}
+			e.Params = append(e.Params, p)
+		}
+		infos = append(infos, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.Printf("failed to write effects: %s", err)
+	}
+}
+
+func (s *server) handleEffect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/effects/")
+	info, ok := effects.LookupEffect(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown effect: %s", name), http.StatusNotFound)
+		return
+	}
+
+	spec := effects.EffectSpec{Effect: info.Name, Params: effects.Params{}}
+	for key, values := range r.URL.Query() {
+		if key == "format" || key == "quality" {
+			continue
+		}
+		if err := setParam(spec, info, key, values[len(values)-1]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.run(w, r, effects.PipelineSpec{Effects: []effects.EffectSpec{spec}}, "")
+}
+
+func (s *server) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.run(w, r, effects.PipelineSpec{}, "spec")
+}
+
+// run reads the image from the request, applies the pipeline and writes the result. If specField
+// is not empty the pipeline spec is read from the multipart field or query param with that name
+func (s *server) run(w http.ResponseWriter, r *http.Request, spec effects.PipelineSpec, specField string) {
+	if err := s.process(w, r, spec, specField); err != nil {
+		var he *httpError
+		switch {
+		case errors.As(err, &he):
+			http.Error(w, he.msg, he.status)
+		case errors.Is(err, context.Canceled):
+			// The client has gone away, there is no one to respond to
+			log.Printf("%s %s cancelled", r.Method, r.URL.Path)
+		default:
+			log.Printf("%s %s failed: %s", r.Method, r.URL.Path, err)
+			http.Error(w, "failed to process image", http.StatusInternalServerError)
+		}
+	}
+}
+
+func (s *server) process(w http.ResponseWriter, r *http.Request, spec effects.PipelineSpec, specField string) error {
+	// The limits apply to every stage of the pipeline, not just the upload, so params like a
+	// resize width can't be used to allocate huge images
+	ctx := effects.WithMaxSize(r.Context(), s.maxWidth, s.maxHeight)
+	data, specData, err := s.readRequest(w, r, specField)
+	if err != nil {
+		return err
+	}
+
+	if specField != "" {
+		if specData == "" {
+			return newHTTPError(http.StatusBadRequest, "missing %s", specField)
+		}
+		if err := json.Unmarshal([]byte(specData), &spec); err != nil {
+			return newHTTPError(http.StatusBadRequest, "invalid spec: %s", err)
+		}
+	}
+	pipeline, err := effects.NewPipeline(spec)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "%s", err)
+	}
+
+	// The size is checked before the image is decoded, using the dimensions after the EXIF
+	// orientation is applied
+	cfg, inFormat, err := effects.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return newHTTPError(http.StatusUnsupportedMediaType, "unsupported image: %s", err)
+	}
+	if cfg.Width > s.maxWidth || cfg.Height > s.maxHeight {
+		return newHTTPError(http.StatusRequestEntityTooLarge, "image is %dx%d, the maximum is %dx%d", cfg.Width, cfg.Height, s.maxWidth, s.maxHeight)
+	}
+
+	query := r.URL.Query()
+	formatName := query.Get("format")
+	if formatName == "" {
+		formatName = inFormat
+		if formatName == string(effects.FormatWebP) {
+			// webp can't be encoded, use a lossless format instead
+			formatName = string(effects.FormatPNG)
+		}
+	}
+	format, err := effects.ParseFormat(formatName)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "%s", err)
+	}
+	if !format.CanEncode() {
+		return newHTTPError(http.StatusBadRequest, "images can't be encoded as %s", format)
+	}
+	opts := effects.SaveOpts{ClipToBounds: true, GIFQuantizer: effects.Quantizer{}}
+	if q := query.Get("quality"); q != "" {
+		if opts.JPEGCompression, err = strconv.Atoi(q); err != nil || opts.JPEGCompression < 1 || opts.JPEGCompression > 100 {
+			return newHTTPError(http.StatusBadRequest, "quality must be between 1 and 100, got: %s", q)
+		}
+	}
+
+	// Wait for a free slot, giving up if the client goes away
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	img, md, err := effects.DecodeWithMetadata(bytes.NewReader(data), effects.LoadOpts{})
+	if err != nil {
+		return newHTTPError(http.StatusUnsupportedMediaType, "%s", err)
+	}
+	opts.Metadata = md
+	outImg, err := pipeline.RunContext(ctx, img, s.numRoutines)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var sizeErr *effects.SizeError
+		if errors.As(err, &sizeErr) {
+			return newHTTPError(http.StatusRequestEntityTooLarge, "%s", err)
+		}
+		return newHTTPError(http.StatusUnprocessableEntity, "%s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := outImg.Encode(&buf, format, opts); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/"+string(format))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// readRequest returns the image and, if specField is not empty, the pipeline spec from the
+// request. Multipart forms use the image and specField fields, otherwise the image is the body
+// and the spec is a query param
+func (s *server) readRequest(w http.ResponseWriter, r *http.Request, specField string) ([]byte, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, "", readError(err)
+		}
+		if len(data) == 0 {
+			return nil, "", newHTTPError(http.StatusBadRequest, "missing image")
+		}
+		var spec string
+		if specField != "" {
+			spec = r.URL.Query().Get(specField)
+		}
+		return data, spec, nil
+	}
+
+	if err := r.ParseMultipartForm(s.maxBytes); err != nil {
+		return nil, "", readError(err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, "", newHTTPError(http.StatusBadRequest, "missing image: %s", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", readError(err)
+	}
+
+	var spec string
+	if specField != "" {
+		spec = r.FormValue(specField)
+	}
+	return data, spec, nil
+}
+
+func readError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newHTTPError(http.StatusRequestEntityTooLarge, "request is larger than %d bytes", tooLarge.Limit)
+	}
+	return newHTTPError(http.StatusBadRequest, "failed to read request: %s", err)
+}
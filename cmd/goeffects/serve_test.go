@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/markdaws/go-effects/pkg/effects"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer() *server {
+	return &server{
+		sem:       make(chan struct{}, 1),
+		maxBytes:  1 << 20,
+		maxWidth:  64,
+		maxHeight: 64,
+	}
+}
+
+// encodeTestImage returns a width x height image encoded in the format
+func encodeTestImage(t *testing.T, width, height int, format effects.Format) []byte {
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+		if i%4 == 3 {
+			src.Pix[i] = 255
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, effects.FromImage(src).Encode(&buf, format, effects.SaveOpts{}))
+	return buf.Bytes()
+}
+
+func post(s *server, target string, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+	return rec
+}
+
+func TestServeEffect(t *testing.T) {
+	s := newTestServer()
+	png := encodeTestImage(t, 16, 8, effects.FormatPNG)
+
+	// By default the output has the same format as the input
+	rec := post(s, "/effects/pixelate?block=4", png)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	img, err := effects.Decode(rec.Body)
+	require.Nil(t, err)
+	require.Equal(t, 16, img.Width)
+
+	rec = post(s, "/effects/sepia?format=jpeg&quality=50", png)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+	_, err = effects.Decode(rec.Body)
+	require.Nil(t, err)
+
+	rec = post(s, "/effects/sepia?format=gif", png)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "image/gif", rec.Header().Get("Content-Type"))
+
+	// A fully transparent image has no colors for the GIF palette
+	var clear bytes.Buffer
+	require.Nil(t, effects.FromImage(image.NewRGBA(image.Rect(0, 0, 4, 4))).Encode(&clear, effects.FormatPNG, effects.SaveOpts{}))
+	rec = post(s, "/effects/sepia?format=gif", clear.Bytes())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	for target, status := range map[string]int{
+		"/effects/unknown":               http.StatusNotFound,
+		"/effects/sepia?unknown=1":       http.StatusBadRequest,
+		"/effects/sepia?intensity=2":     http.StatusBadRequest,
+		"/effects/sepia?format=bitmap":   http.StatusBadRequest,
+		"/effects/sepia?format=webp":     http.StatusBadRequest,
+		"/effects/sepia?quality=0":       http.StatusBadRequest,
+		"/effects/sepia?quality=high":    http.StatusBadRequest,
+		"/effects/crop?width=1&height=1": http.StatusOK,
+	} {
+		rec = post(s, target, png)
+		require.Equal(t, status, rec.Code, "%s: %s", target, rec.Body.String())
+	}
+
+	rec = post(s, "/effects/sepia", []byte("not an image"))
+	require.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	rec = post(s, "/effects/sepia", nil)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/effects/sepia", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestServeList(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newTestServer().handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/effects", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var infos []effectJSON
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Equal(t, len(effects.Effects()), len(infos))
+
+	// Colors are written the same way as in pipeline specs
+	for _, info := range infos {
+		if info.Name == "rotate" {
+			require.Equal(t, "background", info.Params[1].Name)
+			require.Equal(t, effects.FormatColor(color.RGBA{}), info.Params[1].Default)
+		}
+	}
+}
+
+func TestServePipeline(t *testing.T) {
+	s := newTestServer()
+	png := encodeTestImage(t, 16, 8, effects.FormatPNG)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("image", "in.png")
+	require.Nil(t, err)
+	_, err = fw.Write(png)
+	require.Nil(t, err)
+	require.Nil(t, mw.WriteField("spec", `{"effects":[{"effect":"grayscale"},{"effect":"resize","width":8}]}`))
+	require.Nil(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/pipeline?format=png", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	img, err := effects.Decode(rec.Body)
+	require.Nil(t, err)
+	require.Equal(t, 8, img.Width)
+	require.Equal(t, 4, img.Height)
+
+	rec = post(s, "/pipeline", png)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = post(s, "/pipeline?spec="+url.QueryEscape("{"), png)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestServeLimits(t *testing.T) {
+	s := newTestServer()
+
+	// The upload is too wide
+	rec := post(s, "/effects/sepia", encodeTestImage(t, 65, 8, effects.FormatPNG))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// The params ask for an image larger than the limit, which is rejected before it is allocated
+	png := encodeTestImage(t, 1, 1, effects.FormatPNG)
+	for _, target := range []string{
+		"/effects/resize?width=65535",
+		"/effects/resize?width=65535&height=65535",
+		"/effects/resize?height=65",
+		"/pipeline?spec=" + url.QueryEscape(`{"effects":[{"effect":"resize","width":64},{"effect":"rotate","degrees":45}]}`),
+	} {
+		rec = post(s, target, png)
+		require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "%s: %s", target, rec.Body.String())
+	}
+	rec = post(s, "/effects/resize?width=64", png)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// The limits apply to the image after its EXIF orientation turns it upright, a 80x40 jpeg
+	// with an orientation of 6 is 40x80 once it is rotated
+	exif := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0, 0, 0, 0,
+	}
+	var rotated bytes.Buffer
+	src := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 80, 40)))
+	require.Nil(t, src.Encode(&rotated, effects.FormatJPEG, effects.SaveOpts{Metadata: &effects.Metadata{EXIF: exif}}))
+	s.maxWidth, s.maxHeight = 40, 80
+	rec = post(s, "/effects/sepia", rotated.Bytes())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	img, err := effects.Decode(rec.Body)
+	require.Nil(t, err)
+	require.Equal(t, 40, img.Width)
+	s.maxWidth, s.maxHeight = 80, 40
+	rec = post(s, "/effects/sepia", rotated.Bytes())
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+	s.maxWidth, s.maxHeight = 64, 64
+
+	// The request body is larger than maxBytes
+	s.maxBytes = 100
+	rec = post(s, "/effects/sepia", encodeTestImage(t, 32, 32, effects.FormatBMP))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("image", "in.bmp")
+	require.Nil(t, err)
+	_, err = fw.Write(encodeTestImage(t, 32, 32, effects.FormatBMP))
+	require.Nil(t, err)
+	require.Nil(t, mw.Close())
+	req := httptest.NewRequest(http.MethodPost, "/effects/sepia", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+}
+
+func TestServeCancel(t *testing.T) {
+	s := newTestServer()
+	png := encodeTestImage(t, 16, 8, effects.FormatPNG)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Waiting for a free slot gives up when the client goes away
+	s.sem <- struct{}{}
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/effects/sepia", bytes.NewReader(png)).WithContext(ctx))
+	require.Equal(t, 0, rec.Body.Len())
+	<-s.sem
+
+	// Processing stops when the client goes away, and nothing is written
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/effects/sepia", bytes.NewReader(png)).WithContext(ctx))
+	require.Equal(t, 0, rec.Body.Len())
+	require.Equal(t, 0, len(s.sem))
+}
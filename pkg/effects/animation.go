@@ -0,0 +1,398 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Frame is a single frame of an Animation
+type Frame struct {
+	// Image is the complete frame, as it is displayed after the frame has been drawn over the
+	// frames before it
+	Image *Image
+
+	// Delay is how long the frame is displayed for, in 100ths of a second
+	Delay int
+
+	// Disposal is what happens to the frame after it has been displayed, one of the
+	// gif.Disposal constants, or 0 if unspecified. Encode writes every frame as the complete
+	// image, so it always uses gif.DisposalBackground instead
+	Disposal byte
+}
+
+// Animation is a sequence of frames, for example loaded from an animated GIF
+type Animation struct {
+	Frames []Frame
+
+	// LoopCount controls how many times the animation is played, 0 loops forever and -1
+	// plays it once
+	LoopCount int
+}
+
+// AnimationOpts specifies how an animation is encoded as a GIF
+type AnimationOpts struct {
+	// NumColors is the maximum number of colors in each palette, between 2 and 256. If 0
+	// specified, defaults to 256. If any frame has transparent pixels one of the colors is
+	// used for transparency
+	NumColors int
+
+	// Quantizer builds the palettes, if nil the palette.Plan9 palette is used for every frame.
+	// Use a Quantizer for palettes built from the colors of the frames
+	Quantizer draw.Quantizer
+
+	// Drawer converts each frame to its palette, if nil draw.FloydSteinberg is used
+	Drawer draw.Drawer
+
+	// SharedPalette if true, a single palette built from all of the frames is used, which
+	// makes the file smaller and stops colors flickering between frames. If false each
+	// frame has its own palette, which gives more accurate colors
+	SharedPalette bool
+
+	// ClipToBounds if true only the part of each frame inside its Bounds is saved
+	ClipToBounds bool
+}
+
+// LoadAnimation loads every frame of the animated GIF at path
+func LoadAnimation(path string) (*Animation, error) {
+	srcReader, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input animation: %s, %s", path, err)
+	}
+
+	a, err := DecodeAnimation(srcReader)
+	if err != nil {
+		srcReader.Close()
+		return nil, fmt.Errorf("%s, %s", err, path)
+	}
+	err = srcReader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close animation on load: %s, %s", path, err)
+	}
+	return a, nil
+}
+
+// DecodeAnimation reads every frame of an animated GIF from r. GIF frames usually only cover the
+// part of the image that changed, so each frame is drawn over the previous frames, following
+// their disposal methods, and every Frame holds the complete image
+func DecodeAnimation(r io.Reader) (*Animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode animation on load: %s", err)
+	}
+
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, p := range g.Image {
+		screen = screen.Union(p.Bounds())
+	}
+
+	a := &Animation{LoopCount: g.LoopCount}
+	canvas := image.NewRGBA(screen)
+	for i, p := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(screen)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+		a.Frames = append(a.Frames, Frame{
+			Image:    FromImage(canvas),
+			Delay:    g.Delay[i],
+			Disposal: disposal,
+		})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return a, nil
+}
+
+// Apply applies the effect to every frame and returns a new animation with the same timing. A
+// Pipeline can be used to apply several effects
+func (a *Animation) Apply(e Effect, numRoutines int) (*Animation, error) {
+	return a.ApplyContext(context.Background(), e, numRoutines)
+}
+
+// ApplyContext is the same as Apply but stops and returns ctx.Err() if ctx is cancelled. Frames
+// are processed in parallel, numRoutines frames at a time, each on a single goroutine. If ctx was
+// created with WithProgress the fraction of frames completed is reported
+func (a *Animation) ApplyContext(ctx context.Context, e Effect, numRoutines int) (*Animation, error) {
+	numRoutines = routines(numRoutines)
+
+	out := &Animation{LoopCount: a.LoopCount, Frames: make([]Frame, len(a.Frames))}
+	indexes := make(chan int, len(a.Frames))
+	for i := range a.Frames {
+		indexes <- i
+	}
+	close(indexes)
+
+	pr := progressFromContext(ctx)
+	// The effects report progress for the whole animation, not for each frame. The remaining
+	// frames are cancelled as soon as one of them fails
+	frameCtx, cancel := context.WithCancel(withoutProgress(ctx))
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	completed := 0
+
+	wg := sync.WaitGroup{}
+	for r := 0; r < numRoutines; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if frameCtx.Err() != nil {
+					return
+				}
+
+				frame := a.Frames[i]
+				img, err := ApplyContext(frameCtx, e, frame.Image, 1)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("frame %d: %s", i, err)
+					cancel()
+				}
+				frame.Image = img
+				out.Frames[i] = frame
+				completed++
+				pr.report(float64(completed) / float64(len(a.Frames)))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return out, nil
+}
+
+// Save saves the animation as a GIF
+func (a *Animation) Save(outPath string, opts AnimationOpts) error {
+	toImg, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create animation: %s, %s", outPath, err)
+	}
+	err = a.Encode(toImg, opts)
+	if err != nil {
+		toImg.Close()
+		return fmt.Errorf("%s, %s", err, outPath)
+	}
+	err = toImg.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close animation: %s, %s", outPath, err)
+	}
+	return nil
+}
+
+// Encode writes the animation to w as an animated GIF
+func (a *Animation) Encode(w io.Writer, opts AnimationOpts) error {
+	if len(a.Frames) == 0 {
+		return fmt.Errorf("failed to encode animation: no frames")
+	}
+	numColors := opts.NumColors
+	if numColors == 0 {
+		numColors = 256
+	}
+	if numColors < 2 || numColors > 256 {
+		return fmt.Errorf("failed to encode animation: NumColors must be between 2 and 256, got: %d", numColors)
+	}
+	drawer := opts.Drawer
+	if drawer == nil {
+		drawer = draw.FloydSteinberg
+	}
+
+	frames := make([]*image.RGBA, len(a.Frames))
+	width, height := 0, 0
+	for i, f := range a.Frames {
+		frames[i] = f.Image.img
+		if opts.ClipToBounds {
+			frames[i] = f.Image.ToRGBA()
+		}
+		b := frames[i].Bounds()
+		if b.Dx() > width {
+			width = b.Dx()
+		}
+		if b.Dy() > height {
+			height = b.Dy()
+		}
+	}
+
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(frames)),
+		Delay:     make([]int, len(frames)),
+		Disposal:  make([]byte, len(frames)),
+		LoopCount: a.LoopCount,
+		Config:    image.Config{Width: width, Height: height},
+	}
+
+	var shared color.Palette
+	if opts.SharedPalette {
+		transparent := false
+		for _, f := range frames {
+			if hasTransparency(f) {
+				transparent = true
+				break
+			}
+		}
+		stack := &frameStack{frames: frames, width: width, height: height}
+		shared = gifPalette(stack, transparent, numColors, opts.Quantizer)
+		g.Config.ColorModel = shared
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i := range frames {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			src := frames[i]
+			transparent := hasTransparency(src)
+			pal := shared
+			if pal == nil {
+				pal = gifPalette(src, transparent, numColors, opts.Quantizer)
+			}
+			g.Image[i] = toPaletted(src, pal, drawer)
+			g.Delay[i] = a.Frames[i].Delay
+			// Each frame is the complete image, so it is cleared before the next frame is drawn,
+			// otherwise the previous frame would show through its transparent pixels
+			g.Disposal[i] = gif.DisposalBackground
+		}(i)
+	}
+	wg.Wait()
+
+	if err := gif.EncodeAll(w, g); err != nil {
+		return fmt.Errorf("failed to encode animation: %s", err)
+	}
+	return nil
+}
+
+// gifPalette returns a palette of at most numColors colors for img. If transparent is true the
+// last color in the palette is transparent
+func gifPalette(img image.Image, transparent bool, numColors int, q draw.Quantizer) color.Palette {
+	n := numColors
+	if transparent {
+		n--
+	}
+
+	var p color.Palette
+	if q != nil {
+		p = q.Quantize(make(color.Palette, 0, n), img)
+	} else {
+		p = append(color.Palette{}, palette.Plan9[:n]...)
+	}
+	if len(p) > n {
+		p = p[:n]
+	}
+	if transparent {
+		p = append(p, color.RGBA{})
+	}
+	return p
+}
+
+// toPaletted converts src to the palette. Pixels that are more than half transparent use the
+// transparent color in the palette, if it has one
+func toPaletted(src *image.RGBA, pal color.Palette, drawer draw.Drawer) *image.Paletted {
+	b := src.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	drawer.Draw(dst, dst.Rect, src, b.Min)
+
+	transparentIndex := -1
+	for i, c := range pal {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparentIndex = i
+			break
+		}
+	}
+	if transparentIndex == -1 {
+		return dst
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if src.RGBAAt(b.Min.X+x, b.Min.Y+y).A < 128 {
+				dst.SetColorIndex(x, y, uint8(transparentIndex))
+			}
+		}
+	}
+	return dst
+}
+
+// hasTransparency returns true if any pixel in img is more than half transparent
+func hasTransparency(img image.Image) bool {
+	if rgba, ok := img.(*image.RGBA); ok {
+		b := rgba.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			offset := rgba.PixOffset(b.Min.X, y)
+			for x := 0; x < b.Dx(); x++ {
+				if rgba.Pix[offset+x*4+3] < 128 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a < 0x8000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frameStack is an image made of every frame stacked on top of each other, used to build a
+// single palette for all of the frames without copying them
+type frameStack struct {
+	frames        []*image.RGBA
+	width, height int
+}
+
+func (s *frameStack) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (s *frameStack) Bounds() image.Rectangle {
+	return image.Rect(0, 0, s.width, s.height*len(s.frames))
+}
+
+func (s *frameStack) At(x, y int) color.Color {
+	f := s.frames[y/s.height]
+	b := f.Bounds()
+	p := image.Pt(b.Min.X+x, b.Min.Y+y%s.height)
+	if !p.In(b) {
+		return color.RGBA{}
+	}
+	return f.RGBAAt(p.X, p.Y)
+}
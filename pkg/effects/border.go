@@ -0,0 +1,220 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// BorderMode specifies how effects that read a neighbourhood of pixels around each pixel,
+// such as Gaussian, Sobel, OilPainting and Cartoon, handle pixels near the edge of the image
+type BorderMode int
+
+const (
+	// BorderShrink does not sample outside the image, instead the Bounds of the output image
+	// shrink by the radius of the effect. This is the default behavior of every effect
+	BorderShrink BorderMode = iota
+
+	// BorderClamp replicates the edge pixels outwards e.g. aaa|abcd|ddd
+	BorderClamp
+
+	// BorderMirror reflects the image at the edges, without repeating the edge pixel e.g. dcb|abcd|cba
+	BorderMirror
+
+	// BorderWrap tiles the image, so pixels past one edge come from the opposite edge e.g. bcd|abcd|abc
+	BorderWrap
+
+	// BorderConstant treats every pixel outside the image as Border.Color
+	BorderConstant
+)
+
+// String returns the name of the border mode as used in pipeline specs
+func (m BorderMode) String() string {
+	switch m {
+	case BorderShrink:
+		return "shrink"
+	case BorderClamp:
+		return "clamp"
+	case BorderMirror:
+		return "mirror"
+	case BorderWrap:
+		return "wrap"
+	case BorderConstant:
+		return "constant"
+	default:
+		return fmt.Sprintf("BorderMode(%d)", int(m))
+	}
+}
+
+func parseBorderMode(s string) (BorderMode, error) {
+	for _, m := range []BorderMode{BorderShrink, BorderClamp, BorderMirror, BorderWrap, BorderConstant} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown border mode: %s", s)
+}
+
+// Border specifies how an effect handles pixels around the edges of the image
+type Border struct {
+	// Mode is the border mode, BorderShrink by default
+	Mode BorderMode
+
+	// Color is the color of pixels outside the image when Mode is BorderConstant
+	Color color.RGBA
+}
+
+// kernelEffect is implemented by effects that read a neighbourhood of pixels around each
+// output pixel. kernelRadius is the number of pixels the effect shrinks the Bounds by on
+// each side of the image
+type kernelEffect interface {
+	kernelRadius() int
+}
+
+type bordered struct {
+	effect Effect
+	border Border
+}
+
+// WithBorder returns an effect that applies e using the specified border handling. For
+// any mode other than BorderShrink the image is extended past its Bounds before e is
+// applied, so that the output image has the same Width, Height and Bounds as the input.
+// Effects that do not read neighbouring pixels are applied unchanged
+func WithBorder(e Effect, border Border) Effect {
+	return &bordered{effect: e, border: border}
+}
+
+func (b *bordered) Apply(img *Image, numRoutines int) (*Image, error) {
+	return b.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (b *bordered) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	ke, ok := b.effect.(kernelEffect)
+	if !ok || b.border.Mode == BorderShrink {
+		return ApplyContext(ctx, b.effect, img, numRoutines)
+	}
+	radius := ke.kernelRadius()
+	if radius <= 0 {
+		return ApplyContext(ctx, b.effect, img, numRoutines)
+	}
+
+	numRoutines = routines(numRoutines)
+
+	padded, err := padImage(subProgress(ctx, 0, 0.05), img, radius, b.border, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+	paddedOut, err := ApplyContext(subProgress(ctx, 0.05, 1), b.effect, padded, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: img.Bounds,
+	}
+	draw.Draw(out.img, out.Bounds.ToImageRect(), paddedOut.img, image.Point{X: radius, Y: radius}, draw.Src)
+	return out, nil
+}
+
+func (b *bordered) Spec() EffectSpec {
+	s, ok := b.effect.(Serializable)
+	if !ok {
+		return EffectSpec{}
+	}
+	spec := s.Spec()
+	params := Params{}
+	for k, v := range spec.Params {
+		params[k] = v
+	}
+	params[borderParam] = b.border.Mode.String()
+	if b.border.Mode == BorderConstant {
+		params[borderColorParam] = b.border.Color
+	}
+	spec.Params = params
+	return spec
+}
+
+func (b *bordered) kernelRadius() int {
+	if b.border.Mode != BorderShrink {
+		return 0
+	}
+	if ke, ok := b.effect.(kernelEffect); ok {
+		return ke.kernelRadius()
+	}
+	return 0
+}
+
+// padImage returns a new image containing the pixels inside the Bounds of img, extended by
+// radius pixels on every side according to the border mode
+func padImage(ctx context.Context, img *Image, radius int, border Border, numRoutines int) (*Image, error) {
+	w := img.Bounds.Width
+	h := img.Bounds.Height
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("image bounds are empty")
+	}
+
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: w + 2*radius, Y: h + 2*radius},
+		}),
+		Width:  w + 2*radius,
+		Height: h + 2*radius,
+		Bounds: Rect{X: 0, Y: 0, Width: w + 2*radius, Height: h + 2*radius},
+	}
+
+	srcPix := img.img.Pix
+	srcStride := img.img.Stride
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		sx, okX := borderCoord(x-radius, w, border.Mode)
+		sy, okY := borderCoord(y-radius, h, border.Mode)
+		if !okX || !okY {
+			outPix[offset] = border.Color.R
+			outPix[offset+1] = border.Color.G
+			outPix[offset+2] = border.Color.B
+			outPix[offset+3] = border.Color.A
+			return
+		}
+		sOffset := (img.Bounds.Y+sy)*srcStride + (img.Bounds.X+sx)*4
+		copy(outPix[offset:offset+4], srcPix[sOffset:sOffset+4])
+	}
+	if err := runParallel(ctx, numRoutines, out, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// borderCoord maps the coordinate i, which may be outside of [0, n), to the coordinate of the
+// pixel that should be sampled. false is returned if the pixel should have the constant border color
+func borderCoord(i, n int, mode BorderMode) (int, bool) {
+	if i >= 0 && i < n {
+		return i, true
+	}
+
+	switch mode {
+	case BorderClamp:
+		return rangeInt(i, 0, n-1), true
+	case BorderMirror:
+		if n == 1 {
+			return 0, true
+		}
+		period := 2 * (n - 1)
+		i = ((i % period) + period) % period
+		if i >= n {
+			i = period - i
+		}
+		return i, true
+	case BorderWrap:
+		return ((i % n) + n) % n, true
+	default:
+		return 0, false
+	}
+}
@@ -1,31 +1,49 @@
 package effects
 
 import (
+	"context"
 	"image"
-	"runtime"
 )
 
 type brightness struct {
 	offset int
 }
 
+func init() {
+	Register(EffectInfo{
+		Name:        "brightness",
+		Description: "Adds a fixed offset to the red, green and blue channels",
+		Params: []ParamInfo{
+			{Name: "offset", Description: "amount added to each channel", Type: ParamInt, Default: 0, Min: -255, Max: 255},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewBrightness(p.Int("offset")), nil
+		},
+	})
+}
+
 // Apply applies the brgihtness effect to the input image
 func (br *brightness) Apply(img *Image, numRoutines int) (*Image, error) {
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	return br.ApplyContext(context.Background(), img, numRoutines)
+}
+
+// ApplyContext applies the brightness effect to the input image, stopping early if ctx is cancelled
+func (br *brightness) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	numRoutines = routines(numRoutines)
 
 	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
 
-		r := int(inPix[offset]) + br.offset
-		g := int(inPix[offset+1]) + br.offset
-		b := int(inPix[offset+2]) + br.offset
-		a := inPix[offset+3]
+		// The pixels are premultiplied, so the offset is scaled by alpha
+		a := int(inPix[offset+3])
+		o := br.offset * a / 255
+		r := int(inPix[offset]) + o
+		g := int(inPix[offset+1]) + o
+		b := int(inPix[offset+2]) + o
 
-		outPix[offset] = uint8(rangeInt(r, 0, 255))
-		outPix[offset+1] = uint8(rangeInt(g, 0, 255))
-		outPix[offset+2] = uint8(rangeInt(b, 0, 255))
-		outPix[offset+3] = a
+		outPix[offset] = uint8(rangeInt(r, 0, a))
+		outPix[offset+1] = uint8(rangeInt(g, 0, a))
+		outPix[offset+2] = uint8(rangeInt(b, 0, a))
+		outPix[offset+3] = uint8(a)
 	}
 
 	out := &Image{
@@ -37,7 +55,9 @@ func (br *brightness) Apply(img *Image, numRoutines int) (*Image, error) {
 		Height: img.Height,
 		Bounds: img.Bounds,
 	}
-	runParallel(numRoutines, img, out.Bounds, out, pf, 0)
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
@@ -46,3 +66,7 @@ func (br *brightness) Apply(img *Image, numRoutines int) (*Image, error) {
 func NewBrightness(offset int) Effect {
 	return &brightness{offset: offset}
 }
+
+func (br *brightness) Spec() EffectSpec {
+	return EffectSpec{Effect: "brightness", Params: Params{"offset": br.offset}}
+}
@@ -0,0 +1,251 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+)
+
+// CannyOpts options to pass to the Canny effect
+type CannyOpts struct {
+	// BlurKernelSize is the gaussian blur kernel size used to remove noise before the
+	// gradients are computed, it must be odd. If 0 it is derived from BlurSigma, if both are
+	// 0 the blur is skipped
+	BlurKernelSize int
+
+	// BlurSigma is the sigma of the gaussian blur, if 0 it is derived from BlurKernelSize
+	BlurSigma float64
+
+	// LowThreshold is the gradient intensity below which a pixel is never an edge. Pixels
+	// with an intensity between LowThreshold and HighThreshold are only edges if they are
+	// connected to a pixel above HighThreshold
+	LowThreshold int
+
+	// HighThreshold is the gradient intensity at or above which a pixel is always an edge.
+	// Intensities are on the same scale as the Sobel effect
+	HighThreshold int
+
+	// Invert if true draws edges as 0 on a 255 background, instead of 255 on 0
+	Invert bool
+}
+
+type canny struct {
+	opts CannyOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "canny",
+		Description: "Detects thin edges using non-maximum suppression and hysteresis thresholds",
+		Params: []ParamInfo{
+			{Name: "blurKernelSize", Description: "size of the gaussian blur applied first, 0 derives it from blurSigma or skips the blur if that is also 0", Type: ParamInt, Default: 5, Min: 0, Max: 255, Odd: true},
+			{Name: "blurSigma", Description: "sigma of the gaussian blur, 0 derives it from blurKernelSize", Type: ParamFloat, Default: 0.0, Min: 0, Max: 100},
+			{Name: "lowThreshold", Description: "gradient magnitude that weak edges must exceed", Type: ParamInt, Default: 40, Min: 0, Max: 1500},
+			{Name: "highThreshold", Description: "gradient magnitude that strong edges must exceed", Type: ParamInt, Default: 100, Min: 0, Max: 1500},
+			{Name: "invert", Description: "draw black edges on a white background", Type: ParamBool, Default: false},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewCanny(CannyOpts{
+				BlurKernelSize: p.Int("blurKernelSize"),
+				BlurSigma:      p.Float("blurSigma"),
+				LowThreshold:   p.Int("lowThreshold"),
+				HighThreshold:  p.Int("highThreshold"),
+				Invert:         p.Bool("invert"),
+			}), nil
+		},
+	})
+}
+
+// NewCanny returns an effect that finds edges in the image using the Canny edge detector. The
+// image is blurred, the Sobel operator is used to find the intensity and direction of the gradient
+// at each pixel, then pixels that are not the maximum along their gradient direction are removed,
+// leaving thin edges. Finally hysteresis using the low and high thresholds removes the weak edges
+// that are not connected to strong edges. Edge pixels have r,g,b values of 255, all other pixels
+// are 0. Some starting values are:
+// BlurKernelSize: 5
+// LowThreshold: 40
+// HighThreshold: 100
+func NewCanny(opts CannyOpts) Effect {
+	return &canny{opts: opts}
+}
+
+func (c *canny) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *canny) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if c.opts.LowThreshold > c.opts.HighThreshold {
+		return nil, fmt.Errorf("low threshold must not be greater than the high threshold")
+	}
+
+	numRoutines = routines(numRoutines)
+
+	blurImg := img
+	if c.blurs() {
+		var err error
+		gaussian := NewGaussian(c.opts.BlurKernelSize, c.opts.BlurSigma)
+		blurImg, err = ApplyContext(subProgress(ctx, 0, 0.4), gaussian, img, numRoutines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := img.Width
+	gradBounds := shrinkRect(blurImg.Bounds, 1)
+	edgeBounds := shrinkRect(gradBounds, 1)
+	if edgeBounds.Width <= 0 || edgeBounds.Height <= 0 {
+		return nil, fmt.Errorf("image is too small for the canny effect")
+	}
+
+	// Gradient magnitude and direction of each pixel, the direction is quantized to one of
+	// 4 directions, horizontal, the two diagonals and vertical
+	magnitude := make([]float64, img.Width*img.Height)
+	direction := make([]uint8, img.Width*img.Height)
+	sobelX, sobelY := sobelKernels(blurImg.img.Stride)
+	pfGradient := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		gx := sobelX.sumLuminosity(offset, inPix)
+		gy := sobelY.sumLuminosity(offset, inPix)
+		i := y*w + x
+		magnitude[i] = math.Sqrt(gx*gx + gy*gy)
+
+		angle := math.Atan2(gy, gx) * 180 / math.Pi
+		if angle < 0 {
+			angle += 180
+		}
+		switch {
+		case angle < 22.5 || angle >= 157.5:
+			direction[i] = 0
+		case angle < 67.5:
+			direction[i] = 1
+		case angle < 112.5:
+			direction[i] = 2
+		default:
+			direction[i] = 3
+		}
+	}
+	if err := runParallel(subProgress(ctx, 0.4, 0.7), numRoutines, blurImg, gradBounds, blurImg, pfGradient, 0); err != nil {
+		return nil, err
+	}
+
+	// Non-maximum suppression, only keep pixels that are the maximum along the gradient direction,
+	// then classify what is left as strong or weak edges
+	const (
+		notEdge uint8 = iota
+		weakEdge
+		strongEdge
+	)
+	// Offset to the neighbouring pixels along each of the gradient directions
+	neighbours := [4]int{1, w + 1, w, w - 1}
+	low := float64(c.opts.LowThreshold)
+	high := float64(c.opts.HighThreshold)
+	edges := make([]uint8, img.Width*img.Height)
+	pfSuppress := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		i := y*w + x
+		m := magnitude[i]
+		if m < low {
+			return
+		}
+		d := neighbours[direction[i]]
+		if m < magnitude[i+d] || m < magnitude[i-d] {
+			return
+		}
+		if m >= high {
+			edges[i] = strongEdge
+		} else {
+			edges[i] = weakEdge
+		}
+	}
+	if err := runParallel(subProgress(ctx, 0.7, 0.9), numRoutines, blurImg, edgeBounds, blurImg, pfSuppress, 0); err != nil {
+		return nil, err
+	}
+
+	// Hysteresis, weak edges are promoted to strong edges if they are connected to a strong edge
+	var stack []int
+	for y := edgeBounds.Y; y < edgeBounds.Y+edgeBounds.Height; y++ {
+		for x := edgeBounds.X; x < edgeBounds.X+edgeBounds.Width; x++ {
+			if edges[y*w+x] == strongEdge {
+				stack = append(stack, y*w+x)
+			}
+		}
+	}
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for dy := -w; dy <= w; dy += w {
+			for dx := -1; dx <= 1; dx++ {
+				if edges[i+dy+dx] == weakEdge {
+					edges[i+dy+dx] = strongEdge
+					stack = append(stack, i+dy+dx)
+				}
+			}
+		}
+	}
+
+	var edgeVal, bgVal uint8 = 255, 0
+	if c.opts.Invert {
+		edgeVal, bgVal = 0, 255
+	}
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		val := bgVal
+		if edges[y*w+x] == strongEdge {
+			val = edgeVal
+		}
+		a := inPix[offset+3]
+		val = premultiply(val, a)
+		outPix[offset] = val
+		outPix[offset+1] = val
+		outPix[offset+2] = val
+		outPix[offset+3] = a
+	}
+
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: edgeBounds,
+	}
+	if err := runParallel(subProgress(ctx, 0.9, 1), numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// blurs returns true if the image is blurred before the gradients are computed
+func (c *canny) blurs() bool {
+	return c.opts.BlurKernelSize > 0 || c.opts.BlurSigma > 0
+}
+
+func (c *canny) kernelRadius() int {
+	radius := 2
+	if c.blurs() {
+		radius += NewGaussian(c.opts.BlurKernelSize, c.opts.BlurSigma).(kernelEffect).kernelRadius()
+	}
+	return radius
+}
+
+// shrinkRect returns r with n pixels removed from every side
+func shrinkRect(r Rect, n int) Rect {
+	return Rect{
+		X:      r.X + n,
+		Y:      r.Y + n,
+		Width:  r.Width - 2*n,
+		Height: r.Height - 2*n,
+	}
+}
+
+func (c *canny) Spec() EffectSpec {
+	return EffectSpec{Effect: "canny", Params: Params{
+		"blurKernelSize": c.opts.BlurKernelSize,
+		"blurSigma":      c.opts.BlurSigma,
+		"lowThreshold":   c.opts.LowThreshold,
+		"highThreshold":  c.opts.HighThreshold,
+		"invert":         c.opts.Invert,
+	}}
+}
@@ -1,10 +1,43 @@
 package effects
 
 import (
+	"context"
+	"fmt"
 	"image"
-	"runtime"
 )
 
+// EdgeDetector is the algorithm used to find the edges in an image
+type EdgeDetector int
+
+const (
+	// EdgeSobel thresholds the gradient intensity computed by the Sobel operator
+	EdgeSobel EdgeDetector = iota
+
+	// EdgeCanny uses the Canny edge detector, which produces thinner and less noisy edges
+	EdgeCanny
+)
+
+// String returns the name of the edge detector as used in pipeline specs
+func (d EdgeDetector) String() string {
+	switch d {
+	case EdgeSobel:
+		return "sobel"
+	case EdgeCanny:
+		return "canny"
+	default:
+		return fmt.Sprintf("EdgeDetector(%d)", int(d))
+	}
+}
+
+func parseEdgeDetector(s string) (EdgeDetector, error) {
+	for _, d := range []EdgeDetector{EdgeSobel, EdgeCanny} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown edge detector: %s", s)
+}
+
 // CTOpts options to pass to the Cartoon effect
 type CTOpts struct {
 	// BlurKernelSize is the gaussian blur kernel size. You might need to blur
@@ -18,6 +51,14 @@ type CTOpts struct {
 	// as edges
 	EdgeThreshold int
 
+	// EdgeDetector is the algorithm used to find the edges drawn on top of the image,
+	// defaults to EdgeSobel
+	EdgeDetector EdgeDetector
+
+	// EdgeLowThreshold is only used by EdgeCanny, it is the low hysteresis threshold and
+	// EdgeThreshold is the high threshold. If 0, defaults to half of EdgeThreshold
+	EdgeLowThreshold int
+
 	// OilFilterSize specifies how bold the simulated strokes will be when turning the
 	// style towards a painting, something around 5,10,15 should work well
 	OilFilterSize int
@@ -36,19 +77,50 @@ type cartoon struct {
 	opts CTOpts
 }
 
+func init() {
+	Register(EffectInfo{
+		Name:        "cartoon",
+		Description: "Flattens colors with an oil painting effect and outlines the edges",
+		Params: []ParamInfo{
+			{Name: "blurKernelSize", Description: "size of the blur applied before detecting edges, 0 for no blur", Type: ParamInt, Default: 21, Min: 0, Max: 255, Odd: true},
+			{Name: "edgeThreshold", Description: "gradient magnitude above which a pixel is an edge", Type: ParamInt, Default: 40, Min: 0, Max: 255},
+			{Name: "oilFilterSize", Description: "filter size of the oil painting effect", Type: ParamInt, Default: 15, Min: 3, Max: 101},
+			{Name: "oilLevels", Description: "intensity levels of the oil painting effect", Type: ParamInt, Default: 15, Min: 1, Max: 256},
+			{Name: "edgeDetector", Description: "algorithm used to find edges", Type: ParamString, Default: EdgeSobel.String(), Values: []string{EdgeSobel.String(), EdgeCanny.String()}},
+			{Name: "edgeLowThreshold", Description: "canny low threshold, 0 uses half of edgeThreshold", Type: ParamInt, Default: 0, Min: 0, Max: 255},
+		},
+		New: func(p Params) (Effect, error) {
+			detector, err := parseEdgeDetector(p.String("edgeDetector"))
+			if err != nil {
+				return nil, err
+			}
+			return NewCartoon(CTOpts{
+				BlurKernelSize:   p.Int("blurKernelSize"),
+				EdgeThreshold:    p.Int("edgeThreshold"),
+				EdgeDetector:     detector,
+				EdgeLowThreshold: p.Int("edgeLowThreshold"),
+				OilFilterSize:    p.Int("oilFilterSize"),
+				OilLevels:        p.Int("oilLevels"),
+			}), nil
+		},
+	})
+}
+
 // Apply runs the image through the cartoon filter
 func (c *cartoon) Apply(img *Image, numRoutines int) (*Image, error) {
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
 
-	pipeline := Pipeline{}
-	if c.opts.BlurKernelSize > 0 {
-		pipeline.Add(NewGaussian(c.opts.BlurKernelSize, 1), nil)
+// ApplyContext runs the image through the cartoon filter, stopping early if ctx is cancelled
+func (c *cartoon) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if c.opts.EdgeThreshold < 0 || c.opts.EdgeThreshold > 255 {
+		return nil, fmt.Errorf("edge threshold must be between 0 and 255, got: %d", c.opts.EdgeThreshold)
 	}
-	pipeline.Add(NewGrayscale(GSLUMINOSITY), nil)
-	pipeline.Add(NewSobel(c.opts.EdgeThreshold, false), nil)
-	edgeImg, err := pipeline.Run(img, numRoutines)
+
+	numRoutines = routines(numRoutines)
+
+	pipeline := c.edgePipeline()
+	edgeImg, err := pipeline.RunContext(subProgress(ctx, 0, 0.3), img, numRoutines)
 	if err != nil {
 		return nil, err
 	}
@@ -59,8 +131,9 @@ func (c *cartoon) Apply(img *Image, numRoutines int) (*Image, error) {
 		g := inPix[offset+1]
 		b := inPix[offset+2]
 
-		rEdge := edgePix[offset]
-		if rEdge == 255 {
+		// The thresholded edges are premultiplied by the alpha of the input, so an edge has the
+		// same value as its alpha
+		if edgePix[offset+3] != 0 && edgePix[offset] == edgePix[offset+3] {
 			r = 0
 			b = 0
 			g = 0
@@ -69,11 +142,11 @@ func (c *cartoon) Apply(img *Image, numRoutines int) (*Image, error) {
 		outPix[offset] = r
 		outPix[offset+1] = g
 		outPix[offset+2] = b
-		outPix[offset+3] = 255
+		outPix[offset+3] = inPix[offset+3]
 	}
 
 	oil := NewOilPainting(c.opts.OilFilterSize, c.opts.OilLevels)
-	oilImg, err := oil.Apply(img, numRoutines)
+	oilImg, err := ApplyContext(subProgress(ctx, 0.3, 0.9), oil, img, numRoutines)
 	if err != nil {
 		return nil, err
 	}
@@ -91,10 +164,54 @@ func (c *cartoon) Apply(img *Image, numRoutines int) (*Image, error) {
 		// the oil painting effect
 		Bounds: oilImg.Bounds.Intersect(edgeImg.Bounds),
 	}
-	runParallel(numRoutines, oilImg, out.Bounds, out, pf, 0)
+	if err := runParallel(subProgress(ctx, 0.9, 1), numRoutines, oilImg, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
+// edgePipeline returns the pipeline used to find the edges that are drawn on top of the image
+func (c *cartoon) edgePipeline() *Pipeline {
+	pipeline := &Pipeline{}
+	if c.opts.EdgeDetector == EdgeCanny {
+		low := c.opts.EdgeLowThreshold
+		if low == 0 {
+			low = c.opts.EdgeThreshold / 2
+		}
+		opts := CannyOpts{
+			BlurKernelSize: c.opts.BlurKernelSize,
+			LowThreshold:   low,
+			HighThreshold:  c.opts.EdgeThreshold,
+		}
+		if opts.BlurKernelSize > 0 {
+			opts.BlurSigma = 1
+		}
+		pipeline.Add(NewCanny(opts), nil)
+		return pipeline
+	}
+
+	if c.opts.BlurKernelSize > 0 {
+		pipeline.Add(NewGaussian(c.opts.BlurKernelSize, 1), nil)
+	}
+	pipeline.Add(NewGrayscale(GSLUMINOSITY), nil)
+	pipeline.Add(NewSobel(c.opts.EdgeThreshold, false), nil)
+	return pipeline
+}
+
+func (c *cartoon) kernelRadius() int {
+	edgeRadius := 0
+	for _, item := range c.edgePipeline().effects {
+		if ke, ok := item.effect.(kernelEffect); ok {
+			edgeRadius += ke.kernelRadius()
+		}
+	}
+	oilRadius := NewOilPainting(c.opts.OilFilterSize, c.opts.OilLevels).(kernelEffect).kernelRadius()
+	if oilRadius > edgeRadius {
+		return oilRadius
+	}
+	return edgeRadius
+}
+
 // NewCartoon returns an effect that renders images as if they are drawn like a cartoon.
 // It works by rendering the input image using the OilPainting effect, then drawing lines
 // ontop of the image based on the Sobel edge detection method. You will probably have to
@@ -108,3 +225,14 @@ func NewCartoon(opts CTOpts) Effect {
 		opts: opts,
 	}
 }
+
+func (c *cartoon) Spec() EffectSpec {
+	return EffectSpec{Effect: "cartoon", Params: Params{
+		"blurKernelSize":   c.opts.BlurKernelSize,
+		"edgeThreshold":    c.opts.EdgeThreshold,
+		"edgeDetector":     c.opts.EdgeDetector.String(),
+		"edgeLowThreshold": c.opts.EdgeLowThreshold,
+		"oilFilterSize":    c.opts.OilFilterSize,
+		"oilLevels":        c.opts.OilLevels,
+	}}
+}
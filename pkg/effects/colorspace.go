@@ -0,0 +1,182 @@
+package effects
+
+import (
+	"image/color"
+	"math"
+)
+
+// The conversions below take and return r,g,b values between 0 and 255 that are not premultiplied
+// by alpha. Hues are in degrees, between 0 and 360
+
+// RGBToHSL converts a color to hue, saturation and lightness. Saturation and lightness are
+// between 0 and 1
+func RGBToHSL(r, g, b uint8) (h, s, l float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(math.Max(rf, gf), bf)
+	min := math.Min(math.Min(rf, gf), bf)
+	l = (max + min) / 2
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	if l > 0.5 {
+		s = d / (2 - max - min)
+	} else {
+		s = d / (max + min)
+	}
+	return hue(rf, gf, bf, max, d), s, l
+}
+
+// HSLToRGB converts hue, saturation and lightness to a color, it is the inverse of RGBToHSL
+func HSLToRGB(h, s, l float64) (r, g, b uint8) {
+	s = clamp01(s)
+	l = clamp01(l)
+	c := (1 - math.Abs(2*l-1)) * s
+	return hueToRGB(h, c, l-c/2)
+}
+
+// RGBToHSV converts a color to hue, saturation and value. Saturation and value are between 0 and 1
+func RGBToHSV(r, g, b uint8) (h, s, v float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(math.Max(rf, gf), bf)
+	min := math.Min(math.Min(rf, gf), bf)
+	if max == 0 {
+		return 0, 0, 0
+	}
+	d := max - min
+	if d == 0 {
+		return 0, 0, max
+	}
+	return hue(rf, gf, bf, max, d), d / max, max
+}
+
+// HSVToRGB converts hue, saturation and value to a color, it is the inverse of RGBToHSV
+func HSVToRGB(h, s, v float64) (r, g, b uint8) {
+	s = clamp01(s)
+	v = clamp01(v)
+	c := v * s
+	return hueToRGB(h, c, v-c)
+}
+
+// RGBToLab converts an sRGB color to CIE L*a*b* using the D65 white point. L is between 0 and 100,
+// a and b are roughly between -128 and 127. Unlike HSL and HSV, equal distances in Lab are
+// roughly equal differences in how the colors are perceived
+func RGBToLab(r, g, b uint8) (l, a, bb float64) {
+	rl, gl, bl := srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	x := (0.4124564*rl + 0.3575761*gl + 0.1804375*bl) / d65X
+	y := 0.2126729*rl + 0.7151522*gl + 0.0721750*bl
+	z := (0.0193339*rl + 0.1191920*gl + 0.9503041*bl) / d65Z
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// LabToRGB converts a CIE L*a*b* color to sRGB, it is the inverse of RGBToLab. Colors outside the
+// sRGB gamut are clamped
+func LabToRGB(l, a, bb float64) (r, g, b uint8) {
+	fy := (l + 16) / 116
+	x := labFInv(fy+a/500) * d65X
+	y := labFInv(fy)
+	z := labFInv(fy-bb/200) * d65Z
+
+	rl := 3.2404542*x - 1.5371385*y - 0.4985314*z
+	gl := -0.9692660*x + 1.8760108*y + 0.0415560*z
+	bl := 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return linearToSRGB(rl), linearToSRGB(gl), linearToSRGB(bl)
+}
+
+// RGBToYCbCr converts a color to the full range Y'CbCr used by JPEG, Y is the luma of the color
+// and Cb, Cr the blue and red differences, all between 0 and 255
+func RGBToYCbCr(r, g, b uint8) (y, cb, cr uint8) {
+	return color.RGBToYCbCr(r, g, b)
+}
+
+// YCbCrToRGB converts a full range Y'CbCr color to RGB, it is the inverse of RGBToYCbCr
+func YCbCrToRGB(y, cb, cr uint8) (r, g, b uint8) {
+	return color.YCbCrToRGB(y, cb, cr)
+}
+
+const (
+	d65X = 0.95047
+	d65Z = 1.08883
+)
+
+// hue returns the hue in degrees of a color with channels between 0 and 1, the largest channel
+// max and the difference between the largest and smallest channel d
+func hue(r, g, b, max, d float64) float64 {
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// hueToRGB returns the color with hue h and chroma c, with m added to each channel to match its
+// lightness or value
+func hueToRGB(h, c, m float64) (uint8, uint8, uint8) {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return clampUint8((r + m) * 255), clampUint8((g + m) * 255), clampUint8((b + m) * 255)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(f float64) uint8 {
+	if f <= 0.0031308 {
+		return clampUint8(f * 12.92 * 255)
+	}
+	return clampUint8((1.055*math.Pow(f, 1/2.4) - 0.055) * 255)
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func labFInv(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389 {
+		return t3
+	}
+	return (116*t - 16) * 27 / 24389
+}
+
+func clamp01(v float64) float64 {
+	return math.Min(math.Max(v, 0), 1)
+}
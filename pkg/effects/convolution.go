@@ -0,0 +1,290 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image"
+)
+
+// ConvChannels specifies which values of each pixel a convolution kernel is applied to
+type ConvChannels int
+
+const (
+	// ConvRGB applies the kernel to the r,g,b channels independently
+	ConvRGB ConvChannels = iota
+
+	// ConvLuminance applies the kernel to the luminosity of each pixel, the output
+	// image is grayscale
+	ConvLuminance
+)
+
+// String returns the name of the channels value as used in pipeline specs
+func (c ConvChannels) String() string {
+	switch c {
+	case ConvRGB:
+		return "rgb"
+	case ConvLuminance:
+		return "luminance"
+	default:
+		return fmt.Sprintf("ConvChannels(%d)", int(c))
+	}
+}
+
+func parseConvChannels(s string) (ConvChannels, error) {
+	for _, c := range []ConvChannels{ConvRGB, ConvLuminance} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown channels value: %s", s)
+}
+
+// ConvOpts options to pass to the Convolution effect
+type ConvOpts struct {
+	// Divisor the weighted sum of the pixels is divided by. If 0 the sum of the kernel
+	// weights is used, or 1 if the weights sum to 0
+	Divisor float64
+
+	// Bias is added to every value after it has been divided by the divisor, for example
+	// 128 is commonly used with an emboss kernel
+	Bias float64
+
+	// Channels specifies if the kernel is applied to each of the r,g,b channels or to
+	// the luminosity of the pixels
+	Channels ConvChannels
+}
+
+type convolution struct {
+	kernel [][]float64
+	opts   ConvOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "convolution",
+		Description: "Convolves the image with a user defined kernel",
+		Params: []ParamInfo{
+			{Name: "kernel", Description: "odd sized kernel weights, rows of numbers", Type: ParamKernel},
+			{Name: "divisor", Description: "divides the weighted sum, 0 uses the sum of the weights", Type: ParamFloat, Default: 0.0},
+			{Name: "bias", Description: "added to the result after dividing", Type: ParamFloat, Default: 0.0, Min: -255, Max: 255},
+			{Name: "channels", Description: "channels the kernel is applied to", Type: ParamString, Default: ConvRGB.String(), Values: []string{ConvRGB.String(), ConvLuminance.String()}},
+		},
+		New: func(p Params) (Effect, error) {
+			channels, err := parseConvChannels(p.String("channels"))
+			if err != nil {
+				return nil, err
+			}
+			return NewConvolution(p.Kernel("kernel"), ConvOpts{
+				Divisor:  p.Float("divisor"),
+				Bias:     p.Float("bias"),
+				Channels: channels,
+			}), nil
+		},
+	})
+}
+
+// NewConvolution returns an effect that convolves the image with the specified kernel. The kernel
+// is indexed as kernel[row][column], can be any size as long as the number of rows and columns
+// are odd and every row has the same length. The value of each output pixel is:
+//
+//	sum(kernel[dy][dx] * in[y+dy][x+dx]) / divisor + bias
+//
+// clamped to the range 0-255. Like the other kernel based effects, the Bounds of the output image
+// shrink by the radius of the kernel, use WithBorder to keep the input dimensions
+func NewConvolution(kernel [][]float64, opts ConvOpts) Effect {
+	return &convolution{kernel: kernel, opts: opts}
+}
+
+func (c *convolution) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *convolution) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := validateKernel(c.kernel); err != nil {
+		return nil, err
+	}
+
+	numRoutines = routines(numRoutines)
+
+	k := newKernel(c.kernel, img.img.Stride)
+	divisor := c.opts.Divisor
+	if divisor == 0 {
+		divisor = k.sum
+		if divisor == 0 {
+			divisor = 1
+		}
+	}
+	scale := 1 / divisor
+	bias := c.opts.Bias
+
+	var pf pixelFunc
+	switch c.opts.Channels {
+	case ConvRGB:
+		pf = func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+			r, g, b := k.sumRGB(offset, inPix)
+			a := k.alpha(offset, inPix)
+			// The pixels are premultiplied, so the bias is scaled by alpha too
+			aBias := bias * a / 255
+			outPix[offset] = clampAlpha(r*scale+aBias, a)
+			outPix[offset+1] = clampAlpha(g*scale+aBias, a)
+			outPix[offset+2] = clampAlpha(b*scale+aBias, a)
+			outPix[offset+3] = clampUint8(a)
+		}
+	case ConvLuminance:
+		pf = func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+			a := k.alpha(offset, inPix)
+			val := clampAlpha(k.sumLuminosity(offset, inPix)*scale+bias*a/255, a)
+			outPix[offset] = val
+			outPix[offset+1] = val
+			outPix[offset+2] = val
+			outPix[offset+3] = clampUint8(a)
+		}
+	default:
+		return nil, fmt.Errorf("unknown channels value: %d", c.opts.Channels)
+	}
+
+	rx, ry := k.radii()
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: Rect{
+			X:      img.Bounds.X + rx,
+			Y:      img.Bounds.Y + ry,
+			Width:  img.Bounds.Width - 2*rx,
+			Height: img.Bounds.Height - 2*ry,
+		},
+	}
+	if out.Bounds.Width <= 0 || out.Bounds.Height <= 0 {
+		return nil, fmt.Errorf("kernel size is larger than the image")
+	}
+
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *convolution) kernelRadius() int {
+	if validateKernel(c.kernel) != nil {
+		return 0
+	}
+	rx, ry := (len(c.kernel[0])-1)/2, (len(c.kernel)-1)/2
+	if rx > ry {
+		return rx
+	}
+	return ry
+}
+
+func validateKernel(kernel [][]float64) error {
+	if len(kernel) == 0 || len(kernel[0]) == 0 {
+		return fmt.Errorf("kernel must not be empty")
+	}
+	if !isOddInt(len(kernel)) || !isOddInt(len(kernel[0])) {
+		return fmt.Errorf("kernel width and height must be odd")
+	}
+	for _, row := range kernel {
+		if len(row) != len(kernel[0]) {
+			return fmt.Errorf("kernel rows must all be the same length")
+		}
+	}
+	return nil
+}
+
+// kernel is a convolution kernel prepared for an image with a specific stride. Only the
+// non-zero weights are stored, along with the offset of the pixel they apply to relative
+// to the center pixel, so they can be applied directly to a Pix buffer
+type kernel struct {
+	weights []float64
+	offsets []int
+	width   int
+	height  int
+	sum     float64
+}
+
+func newKernel(weights [][]float64, stride int) *kernel {
+	k := &kernel{height: len(weights), width: len(weights[0])}
+	rx, ry := k.radii()
+	for dy, row := range weights {
+		for dx, w := range row {
+			k.sum += w
+			if w == 0 {
+				continue
+			}
+			k.weights = append(k.weights, w)
+			k.offsets = append(k.offsets, (dy-ry)*stride+(dx-rx)*4)
+		}
+	}
+	return k
+}
+
+// radii returns the number of pixels either side of the center pixel the kernel covers
+// horizontally and vertically
+func (k *kernel) radii() (int, int) {
+	return (k.width - 1) / 2, (k.height - 1) / 2
+}
+
+// sumRGB returns the weighted sums of the r,g,b values of the pixels around offset
+func (k *kernel) sumRGB(offset int, pix []uint8) (r, g, b float64) {
+	for i, w := range k.weights {
+		pOffset := offset + k.offsets[i]
+		r += w * float64(pix[pOffset])
+		g += w * float64(pix[pOffset+1])
+		b += w * float64(pix[pOffset+2])
+	}
+	return r, g, b
+}
+
+// alpha returns the alpha of the output pixel at offset. Kernels whose weights sum to zero, such as
+// edge detectors, keep the alpha of the pixel, otherwise it is the weighted average of the alpha
+// of the pixels around offset, so transparent areas blur in to opaque ones
+func (k *kernel) alpha(offset int, pix []uint8) float64 {
+	if k.sum == 0 {
+		return float64(pix[offset+3])
+	}
+	var a float64
+	for i, w := range k.weights {
+		a += w * float64(pix[offset+k.offsets[i]+3])
+	}
+	return a / k.sum
+}
+
+// sumLuminosity returns the weighted sum of the luminosity of the pixels around offset
+func (k *kernel) sumLuminosity(offset int, pix []uint8) float64 {
+	var l float64
+	for i, w := range k.weights {
+		pOffset := offset + k.offsets[i]
+		l += w * luminosity(pix[pOffset], pix[pOffset+1], pix[pOffset+2])
+	}
+	return l
+}
+
+// clampAlpha clamps a premultiplied color value to the range 0 to alpha
+func clampAlpha(v, alpha float64) uint8 {
+	if v >= alpha {
+		return clampUint8(alpha)
+	}
+	return clampUint8(v)
+}
+
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func (c *convolution) Spec() EffectSpec {
+	return EffectSpec{Effect: "convolution", Params: Params{
+		"kernel":   c.kernel,
+		"divisor":  c.opts.Divisor,
+		"bias":     c.opts.Bias,
+		"channels": c.opts.Channels.String(),
+	}}
+}
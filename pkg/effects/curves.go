@@ -0,0 +1,208 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CurvePoint is a control point of a tone curve, the input value X is mapped to the output
+// value Y. Both are between 0 and 255
+type CurvePoint struct {
+	X float64
+	Y float64
+}
+
+// CurvesOpts options to pass to the curves effect. Each curve is a list of control points, a
+// smooth curve is drawn through them and used to map the values of the channel. An empty list
+// leaves the channel unchanged. The red, green and blue curves are applied first, then Master
+// is applied to all three channels
+type CurvesOpts struct {
+	Master []CurvePoint
+	Red    []CurvePoint
+	Green  []CurvePoint
+	Blue   []CurvePoint
+}
+
+type curves struct {
+	opts CurvesOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "curves",
+		Description: "Maps each channel through a smooth curve drawn through control points",
+		Params: []ParamInfo{
+			{Name: "master", Description: "control points applied to every channel, as x,y pairs e.g. 0,0;64,48;192,208;255,255", Type: ParamKernel, Default: [][]float64{}},
+			{Name: "red", Description: "control points for the red channel", Type: ParamKernel, Default: [][]float64{}},
+			{Name: "green", Description: "control points for the green channel", Type: ParamKernel, Default: [][]float64{}},
+			{Name: "blue", Description: "control points for the blue channel", Type: ParamKernel, Default: [][]float64{}},
+		},
+		New: func(p Params) (Effect, error) {
+			var opts CurvesOpts
+			var err error
+			for _, c := range []struct {
+				name   string
+				points *[]CurvePoint
+			}{
+				{"master", &opts.Master},
+				{"red", &opts.Red},
+				{"green", &opts.Green},
+				{"blue", &opts.Blue},
+			} {
+				if *c.points, err = rowsToPoints(p.Kernel(c.name)); err != nil {
+					return nil, fmt.Errorf("%s: %s", c.name, err)
+				}
+			}
+			if err := opts.validate(); err != nil {
+				return nil, err
+			}
+			return NewCurves(opts), nil
+		},
+	})
+}
+
+// NewCurves returns an effect that maps the channels of the image through tone curves. The curve
+// passes through every control point and is a monotone cubic spline, so it does not overshoot
+// between points. Inputs left of the first point and right of the last point are mapped to the
+// Y of that point. For example an S shaped curve through 0,0 64,48 192,208 255,255 increases
+// the contrast of the midtones
+func NewCurves(opts CurvesOpts) Effect {
+	return &curves{opts: opts}
+}
+
+func (c *curves) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *curves) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := c.opts.validate(); err != nil {
+		return nil, err
+	}
+
+	master := newCurve(c.opts.Master)
+	var lut toneLUT
+	for i, points := range [][]CurvePoint{c.opts.Red, c.opts.Green, c.opts.Blue} {
+		channel := newCurve(points)
+		for v := 0; v < 256; v++ {
+			lut[i][v] = clampUint8(master(channel(float64(v))))
+		}
+	}
+	return applyToneLUT(ctx, img, numRoutines, &lut)
+}
+
+func (c *curves) Spec() EffectSpec {
+	return EffectSpec{Effect: "curves", Params: Params{
+		"master": pointsToRows(c.opts.Master),
+		"red":    pointsToRows(c.opts.Red),
+		"green":  pointsToRows(c.opts.Green),
+		"blue":   pointsToRows(c.opts.Blue),
+	}}
+}
+
+func (opts CurvesOpts) validate() error {
+	for _, c := range []struct {
+		name   string
+		points []CurvePoint
+	}{
+		{"master", opts.Master},
+		{"red", opts.Red},
+		{"green", opts.Green},
+		{"blue", opts.Blue},
+	} {
+		if len(c.points) == 1 {
+			return fmt.Errorf("%s curve must have at least 2 points", c.name)
+		}
+		seen := map[float64]bool{}
+		for _, p := range c.points {
+			if p.X < 0 || p.X > 255 || p.Y < 0 || p.Y > 255 {
+				return fmt.Errorf("%s curve points must be between 0 and 255, got: %v,%v", c.name, p.X, p.Y)
+			}
+			if seen[p.X] {
+				return fmt.Errorf("%s curve has more than one point with x: %v", c.name, p.X)
+			}
+			seen[p.X] = true
+		}
+	}
+	return nil
+}
+
+// newCurve returns a function evaluating the monotone cubic spline through the points, using the
+// Fritsch-Carlson method to choose the tangents. With no points the function returns its input
+func newCurve(points []CurvePoint) func(v float64) float64 {
+	if len(points) == 0 {
+		return func(v float64) float64 {
+			return v
+		}
+	}
+
+	p := append([]CurvePoint{}, points...)
+	sort.Slice(p, func(i, j int) bool {
+		return p[i].X < p[j].X
+	})
+
+	n := len(p)
+	slopes := make([]float64, n-1)
+	for i := 0; i < n-1; i++ {
+		slopes[i] = (p[i+1].Y - p[i].Y) / (p[i+1].X - p[i].X)
+	}
+	tangents := make([]float64, n)
+	tangents[0] = slopes[0]
+	tangents[n-1] = slopes[n-2]
+	for i := 1; i < n-1; i++ {
+		if slopes[i-1]*slopes[i] <= 0 {
+			// A local minimum or maximum, flat so the curve doesn't overshoot it
+			continue
+		}
+		tangents[i] = (slopes[i-1] + slopes[i]) / 2
+	}
+	for i := 0; i < n-1; i++ {
+		if slopes[i] == 0 {
+			tangents[i] = 0
+			tangents[i+1] = 0
+			continue
+		}
+		a, b := tangents[i]/slopes[i], tangents[i+1]/slopes[i]
+		if s := a*a + b*b; s > 9 {
+			t := 3 / math.Sqrt(s)
+			tangents[i] = t * a * slopes[i]
+			tangents[i+1] = t * b * slopes[i]
+		}
+	}
+
+	return func(v float64) float64 {
+		if v <= p[0].X {
+			return p[0].Y
+		}
+		if v >= p[n-1].X {
+			return p[n-1].Y
+		}
+		i := sort.Search(n, func(i int) bool { return p[i].X > v }) - 1
+		h := p[i+1].X - p[i].X
+		t := (v - p[i].X) / h
+		t2, t3 := t*t, t*t*t
+		return (2*t3-3*t2+1)*p[i].Y + (t3-2*t2+t)*h*tangents[i] +
+			(-2*t3+3*t2)*p[i+1].Y + (t3-t2)*h*tangents[i+1]
+	}
+}
+
+// rowsToPoints converts rows of x,y pairs, as used in pipeline specs, to curve points
+func rowsToPoints(rows [][]float64) ([]CurvePoint, error) {
+	points := make([]CurvePoint, len(rows))
+	for i, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("each curve point must be an x,y pair, got: %v", row)
+		}
+		points[i] = CurvePoint{X: row[0], Y: row[1]}
+	}
+	return points, nil
+}
+
+func pointsToRows(points []CurvePoint) [][]float64 {
+	rows := make([][]float64, len(points))
+	for i, p := range points {
+		rows[i] = []float64{p.X, p.Y}
+	}
+	return rows
+}
@@ -1,8 +1,9 @@
 package effects
 
 import (
+	"context"
+	"image"
 	"math"
-	"sync"
 )
 
 // Effect interface for any effect type
@@ -11,49 +12,36 @@ type Effect interface {
 	Apply(img *Image, numRoutines int) (*Image, error)
 }
 
-type pixelFunc func(ri, x, y, offset, inStride int, inPix, outPix []uint8)
+// ContextEffect is an Effect that can be cancelled while it is running. All of the
+// effects in this package implement ContextEffect
+type ContextEffect interface {
+	Effect
 
-func runParallel(numRoutines int, inImg *Image, inBounds Rect, outImg *Image, pf pixelFunc, blockWidth int) {
-	w := inBounds.Width
-	h := inBounds.Height
-
-	minX := inBounds.X
-	minY := inBounds.Y
-
-	stride := inImg.img.Stride
-	inPix := inImg.img.Pix
-	outPix := outImg.img.Pix
-
-	wg := sync.WaitGroup{}
-	xOffset := minX
+	// ApplyContext applies the effect to the input image and returns an output image. If
+	// ctx is cancelled before the effect completes, ctx.Err() is returned
+	ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error)
+}
 
-	var widthPerRoutine int
-	if blockWidth != 0 {
-		widthPerRoutine = blockWidth
-	} else {
-		widthPerRoutine = w / numRoutines
+// ApplyContext applies the effect to the input image, returning ctx.Err() if ctx is
+// cancelled. If e does not implement ContextEffect the context is only checked before
+// and after the effect is applied
+func ApplyContext(ctx context.Context, e Effect, img *Image, numRoutines int) (*Image, error) {
+	if ce, ok := e.(ContextEffect); ok {
+		return ce.ApplyContext(ctx, img, numRoutines)
 	}
 
-	for r := 0; r < numRoutines; r++ {
-		wg.Add(1)
-
-		if r == numRoutines-1 {
-			widthPerRoutine = (minX + w) - xOffset
-		}
-
-		go func(ri, xStart, yStart, width, height int) {
-			for x := xStart; x < xStart+width; x++ {
-				for y := yStart; y < yStart+height; y++ {
-					offset := y*stride + x*4
-					pf(ri, x, y, offset, stride, inPix, outPix)
-				}
-			}
-			wg.Done()
-		}(r, xOffset, minY, widthPerRoutine, h)
-
-		xOffset += widthPerRoutine
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	out, err := e.Apply(img, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	wg.Wait()
+	progressFromContext(ctx).report(1)
+	return out, nil
 }
 
 func roundToInt32(a float64) int32 {
@@ -76,3 +64,66 @@ func reset(s []int) {
 		s[i] = 0
 	}
 }
+
+// premultiply scales the color value v by alpha. Pixels are stored premultiplied by their alpha,
+// so a color value is never larger than the alpha of its pixel
+func premultiply(v, alpha uint8) uint8 {
+	return uint8((uint32(v)*uint32(alpha) + 127) / 255)
+}
+
+// unpremultiply returns the color value v of a pixel without its alpha premultiplied in to it,
+// alpha must not be 0
+func unpremultiply(v, alpha uint8) uint8 {
+	u := (uint32(v)*255 + uint32(alpha)/2) / uint32(alpha)
+	if u > 255 {
+		return 255
+	}
+	return uint8(u)
+}
+
+// mapColors returns a new image with the color of every pixel replaced by the result of f. f is
+// passed the red, green and blue values without alpha premultiplied in to them, the alpha of each
+// pixel is kept, so it is used by the effects that change the color of each pixel independently
+func mapColors(ctx context.Context, img *Image, numRoutines int, f func(r, g, b uint8) (uint8, uint8, uint8)) (*Image, error) {
+	return mapColorsAt(ctx, img, numRoutines, func(x, y int, r, g, b uint8) (uint8, uint8, uint8) {
+		return f(r, g, b)
+	})
+}
+
+// mapColorsAt is the same as mapColors but f is also passed the position of the pixel, for effects
+// where the new color depends on where the pixel is in the image
+func mapColorsAt(ctx context.Context, img *Image, numRoutines int, f func(x, y int, r, g, b uint8) (uint8, uint8, uint8)) (*Image, error) {
+	numRoutines = routines(numRoutines)
+
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		a := inPix[offset+3]
+		switch a {
+		case 0:
+			outPix[offset] = 0
+			outPix[offset+1] = 0
+			outPix[offset+2] = 0
+		case 255:
+			outPix[offset], outPix[offset+1], outPix[offset+2] = f(x, y, inPix[offset], inPix[offset+1], inPix[offset+2])
+		default:
+			r, g, b := f(x, y, unpremultiply(inPix[offset], a), unpremultiply(inPix[offset+1], a), unpremultiply(inPix[offset+2], a))
+			outPix[offset] = premultiply(r, a)
+			outPix[offset+1] = premultiply(g, a)
+			outPix[offset+2] = premultiply(b, a)
+		}
+		outPix[offset+3] = a
+	}
+
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: img.Bounds,
+	}
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
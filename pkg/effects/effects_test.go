@@ -1,12 +1,27 @@
 package effects_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/markdaws/go-effects/pkg/effects"
 	"github.com/markdaws/go-timing"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 const cabinPath = "../../test/cabin.jpg"
@@ -216,6 +231,11 @@ func TestCartoon(t *testing.T) {
 	err = cartoonImg.Save("../../test/turtle-cartoon.jpg", effects.SaveOpts{ClipToBounds: true})
 	require.Nil(t, err)
 
+	// A threshold of -1 would give sobel's raw magnitudes, which can't be drawn as edges
+	opts.EdgeThreshold = -1
+	_, err = effects.NewCartoon(opts).Apply(img, 0)
+	require.NotNil(t, err)
+
 	fmt.Println(img.Bounds)
 	fmt.Println(timing)
 }
@@ -265,3 +285,1646 @@ func TestBrightness(t *testing.T) {
 	fmt.Println(img.Bounds)
 	fmt.Println(timing)
 }
+
+func TestEncodeDecode(t *testing.T) {
+	f, err := os.Open(cabinPath)
+	require.Nil(t, err)
+	defer f.Close()
+
+	img, err := effects.Decode(f)
+	require.Nil(t, err)
+	require.NotNil(t, img)
+
+	var buf bytes.Buffer
+	err = img.Encode(&buf, effects.FormatPNG, effects.SaveOpts{})
+	require.Nil(t, err)
+
+	pngImg, err := effects.Decode(&buf)
+	require.Nil(t, err)
+	require.Equal(t, img.Width, pngImg.Width)
+	require.Equal(t, img.Height, pngImg.Height)
+
+	buf.Reset()
+	err = img.Encode(&buf, effects.FormatJPEG, effects.SaveOpts{JPEGCompression: 80})
+	require.Nil(t, err)
+	require.True(t, buf.Len() > 0)
+
+	err = img.Encode(&buf, effects.Format("xyz"), effects.SaveOpts{})
+	require.NotNil(t, err)
+
+	_, err = effects.Decode(bytes.NewReader([]byte("not an image")))
+	require.NotNil(t, err)
+}
+
+func TestFormats(t *testing.T) {
+	img := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 40, 30)))
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 6), G: uint8(y * 8), B: 128, A: 255})
+		}
+	}
+
+	for _, format := range []effects.Format{effects.FormatPNG, effects.FormatGIF, effects.FormatBMP, effects.FormatTIFF} {
+		require.True(t, format.CanEncode(), format)
+		var buf bytes.Buffer
+		err := img.Encode(&buf, format, effects.SaveOpts{})
+		require.Nil(t, err, format)
+
+		decoded, err := effects.Decode(&buf)
+		require.Nil(t, err, format)
+		require.Equal(t, img.Width, decoded.Width)
+		require.Equal(t, img.Height, decoded.Height)
+		if format != effects.FormatGIF {
+			require.Equal(t, img.RGBAAt(39, 29), decoded.RGBAAt(39, 29), format)
+		}
+	}
+
+	require.False(t, effects.FormatWebP.CanEncode())
+	require.False(t, effects.Format("xyz").CanEncode())
+
+	// PNG compression levels produce valid, differently sized files
+	var fast, best bytes.Buffer
+	err := img.Encode(&fast, effects.FormatPNG, effects.SaveOpts{PNGCompression: png.NoCompression})
+	require.Nil(t, err)
+	err = img.Encode(&best, effects.FormatPNG, effects.SaveOpts{PNGCompression: png.BestCompression})
+	require.Nil(t, err)
+	require.True(t, best.Len() < fast.Len())
+
+	// GIF palettes are limited to GIFNumColors
+	var buf bytes.Buffer
+	err = img.Encode(&buf, effects.FormatGIF, effects.SaveOpts{GIFNumColors: 16})
+	require.Nil(t, err)
+	paletted, err := gif.Decode(&buf)
+	require.Nil(t, err)
+	require.True(t, len(paletted.(*image.Paletted).Palette) <= 16)
+
+	// Transparent pixels survive a GIF round trip, with either palette
+	half := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			half.SetRGBA(x, y, color.RGBA{R: 200, G: 10, B: 10, A: 255})
+		}
+	}
+	for _, q := range []draw.Quantizer{nil, effects.Quantizer{}} {
+		buf.Reset()
+		err = half.Encode(&buf, effects.FormatGIF, effects.SaveOpts{GIFQuantizer: q})
+		require.Nil(t, err)
+		decoded, err := effects.Decode(&buf)
+		require.Nil(t, err)
+		require.Equal(t, color.RGBA{}, decoded.RGBAAt(6, 0))
+		require.Equal(t, uint8(255), decoded.RGBAAt(1, 0).A)
+		require.True(t, decoded.RGBAAt(1, 0).R > 150)
+	}
+
+	// The format in SaveOpts overrides the extension
+	outPath := t.TempDir() + "/out.img"
+	err = img.Save(outPath, effects.SaveOpts{Format: effects.FormatTIFF})
+	require.Nil(t, err)
+	loaded, err := effects.LoadImage(outPath)
+	require.Nil(t, err)
+	require.Equal(t, img.RGBAAt(10, 10), loaded.RGBAAt(10, 10))
+
+	for _, name := range []string{"a.jpg", "a.JPEG", "a.png", "a.gif", "a.bmp", "a.tif", "a.tiff", "a.webp"} {
+		_, err := effects.FormatFromPath(name)
+		require.Nil(t, err, name)
+	}
+	_, err = effects.FormatFromPath("a.xyz")
+	require.NotNil(t, err)
+
+	webp, err := effects.LoadImage("../../test/blue-purple-pink.webp")
+	require.Nil(t, err)
+	require.True(t, webp.Width > 0 && webp.Height > 0)
+	err = webp.Encode(&buf, effects.FormatWebP, effects.SaveOpts{})
+	require.NotNil(t, err)
+}
+
+func TestFromImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(10, 20, 50, 40))
+	src.SetRGBA(10, 20, color.RGBA{R: 255, A: 255})
+	src.SetRGBA(49, 39, color.RGBA{B: 255, A: 255})
+
+	img := effects.FromImage(src)
+	require.Equal(t, 40, img.Width)
+	require.Equal(t, 20, img.Height)
+	require.Equal(t, effects.Rect{X: 0, Y: 0, Width: 40, Height: 20}, img.Bounds)
+	require.Equal(t, color.RGBA{R: 255, A: 255}, img.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{B: 255, A: 255}, img.RGBAAt(39, 19))
+
+	img.Bounds = effects.Rect{X: 5, Y: 5, Width: 35, Height: 15}
+	rgba := img.ToRGBA()
+	require.Equal(t, image.Rect(0, 0, 35, 15), rgba.Bounds())
+	require.Equal(t, color.RGBA{B: 255, A: 255}, rgba.RGBAAt(34, 14))
+
+	sub := img.SubImage(effects.Rect{X: 0, Y: 0, Width: 10, Height: 10})
+	require.Equal(t, effects.Rect{X: 0, Y: 0, Width: 5, Height: 5}, sub.Bounds)
+	require.Equal(t, 5, sub.Width)
+}
+
+func TestApplyContext(t *testing.T) {
+	img, err := effects.LoadImage(cabinPath)
+	require.Nil(t, err)
+	require.NotNil(t, img)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	oil := effects.NewOilPainting(5, 30)
+	outImg, err := effects.ApplyContext(ctx, oil, img, 0)
+	require.Equal(t, context.Canceled, err)
+	require.Nil(t, outImg)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	outImg, err = effects.ApplyContext(ctx, oil, img, 1)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Nil(t, outImg)
+
+	pipeline := effects.Pipeline{}
+	pipeline.Add(effects.NewGrayscale(effects.GSLUMINOSITY), nil)
+	pipeline.Add(effects.NewSobel(-1, false), nil)
+	ctx, cancel = context.WithCancel(context.Background())
+	pipeline.Add(effects.NewBrightness(10), func(*effects.Image) { cancel() })
+	pipeline.Add(effects.NewBrightness(10), func(*effects.Image) { t.Fatal("stage should not run") })
+	outImg, err = pipeline.RunContext(ctx, img, 0)
+	require.Equal(t, context.Canceled, err)
+	require.Nil(t, outImg)
+
+	outImg, err = effects.ApplyContext(context.Background(), effects.NewGrayscale(effects.GSAVERAGE), img, 0)
+	require.Nil(t, err)
+	require.NotNil(t, outImg)
+}
+
+func TestProgress(t *testing.T) {
+	img, err := effects.LoadImage("../../test/turtle.jpg")
+	require.Nil(t, err)
+	require.NotNil(t, img)
+
+	var updates []effects.Progress
+	ctx := effects.WithProgress(context.Background(), func(p effects.Progress) {
+		updates = append(updates, p)
+	})
+
+	pipeline := effects.Pipeline{}
+	pipeline.Add(effects.NewGrayscale(effects.GSLUMINOSITY), nil)
+	pipeline.Add(effects.NewPencil(5), nil)
+	outImg, err := pipeline.RunContext(ctx, img, 0)
+	require.Nil(t, err)
+	require.NotNil(t, outImg)
+
+	require.True(t, len(updates) > 2)
+	last := 0.0
+	for _, p := range updates {
+		require.True(t, p.Fraction > last)
+		require.Equal(t, 2, p.StageCount)
+		last = p.Fraction
+	}
+	require.Equal(t, "grayscale", updates[0].Stage)
+	require.Equal(t, 0, updates[0].StageIndex)
+	require.Equal(t, "pencil", updates[len(updates)-1].Stage)
+	require.Equal(t, 1, updates[len(updates)-1].StageIndex)
+	require.Equal(t, 1.0, updates[len(updates)-1].Fraction)
+
+	updates = nil
+	ctx = effects.WithProgress(context.Background(), func(p effects.Progress) {
+		updates = append(updates, p)
+	})
+	outImg, err = effects.ApplyContext(ctx, effects.NewOilPainting(5, 30), img, 0)
+	require.Nil(t, err)
+	require.NotNil(t, outImg)
+	require.True(t, len(updates) > 0)
+	require.Equal(t, "", updates[0].Stage)
+	require.Equal(t, 1.0, updates[len(updates)-1].Fraction)
+}
+
+// referenceGaussian is a direct two dimensional gaussian convolution used to check the
+// separable implementation against
+func referenceGaussian(img *image.RGBA, kernelSize int, sigma float64, x, y int) [4]float64 {
+	r := (kernelSize - 1) / 2
+	var sum float64
+	var out [4]float64
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			w := math.Exp(-float64(dx*dx+dy*dy) / (2 * sigma * sigma))
+			c := img.RGBAAt(x+dx, y+dy)
+			out[0] += w * float64(c.R)
+			out[1] += w * float64(c.G)
+			out[2] += w * float64(c.B)
+			out[3] += w * float64(c.A)
+			sum += w
+		}
+	}
+	for i := range out {
+		out[i] /= sum
+	}
+	return out
+}
+
+func TestGaussianReference(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := image.NewRGBA(image.Rect(0, 0, 41, 33))
+	for i := 0; i < len(src.Pix); i += 4 {
+		// The pixels are premultiplied, so the colors can't be larger than alpha
+		a := rnd.Intn(256)
+		src.Pix[i] = uint8(rnd.Intn(a + 1))
+		src.Pix[i+1] = uint8(rnd.Intn(a + 1))
+		src.Pix[i+2] = uint8(rnd.Intn(a + 1))
+		src.Pix[i+3] = uint8(a)
+	}
+	img := effects.FromImage(src)
+
+	cases := []struct {
+		kernelSize int
+		sigma      float64
+		expected   int
+	}{
+		{kernelSize: 3, sigma: 1, expected: 3},
+		{kernelSize: 9, sigma: 2.5, expected: 9},
+		{kernelSize: 0, sigma: 1.5, expected: 11},
+		{kernelSize: 7, sigma: 0, expected: 7},
+	}
+	for _, c := range cases {
+		outImg, err := effects.NewGaussian(c.kernelSize, c.sigma).Apply(img, 0)
+		require.Nil(t, err)
+
+		offset := (c.expected - 1) / 2
+		require.Equal(t, effects.Rect{
+			X:      offset,
+			Y:      offset,
+			Width:  img.Width - 2*offset,
+			Height: img.Height - 2*offset,
+		}, outImg.Bounds)
+
+		sigma := c.sigma
+		if sigma == 0 {
+			sigma = 0.3*(float64(c.expected-1)*0.5-1) + 0.8
+		}
+		b := outImg.Bounds
+		for y := b.Y; y < b.Y+b.Height; y++ {
+			for x := b.X; x < b.X+b.Width; x++ {
+				ref := referenceGaussian(src, c.expected, sigma, x, y)
+				px := outImg.RGBAAt(x, y)
+				require.InDelta(t, ref[0], float64(px.R), 1.5)
+				require.InDelta(t, ref[1], float64(px.G), 1.5)
+				require.InDelta(t, ref[2], float64(px.B), 1.5)
+				require.InDelta(t, ref[3], float64(px.A), 1.5)
+			}
+		}
+	}
+
+	_, err := effects.NewGaussian(4, 1).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewGaussian(0, 0).Apply(img, 0)
+	require.NotNil(t, err)
+}
+
+func TestBorder(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 16))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 200, 100, 50, 255
+	}
+	img := effects.FromImage(src)
+
+	modes := []effects.BorderMode{effects.BorderClamp, effects.BorderMirror, effects.BorderWrap}
+	for _, mode := range modes {
+		gaussian := effects.WithBorder(effects.NewGaussian(5, 1), effects.Border{Mode: mode})
+		outImg, err := gaussian.Apply(img, 0)
+		require.Nil(t, err)
+		require.Equal(t, img.Bounds, outImg.Bounds)
+		require.Equal(t, img.Width, outImg.Width)
+		require.Equal(t, img.Height, outImg.Height)
+
+		// A uniform image stays uniform, since every sampled pixel has the same color
+		require.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 255}, outImg.RGBAAt(0, 0))
+		require.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 255}, outImg.RGBAAt(19, 15))
+	}
+
+	black := effects.Border{Mode: effects.BorderConstant, Color: color.RGBA{A: 255}}
+	outImg, err := effects.WithBorder(effects.NewGaussian(5, 1), black).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.Bounds, outImg.Bounds)
+	require.True(t, outImg.RGBAAt(0, 0).R < 200)
+	require.Equal(t, uint8(200), outImg.RGBAAt(10, 8).R)
+
+	outImg, err = effects.WithBorder(effects.NewGaussian(5, 1), effects.Border{}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, effects.Rect{X: 2, Y: 2, Width: 16, Height: 12}, outImg.Bounds)
+
+	turtle, err := effects.LoadImage("../../test/turtle.jpg")
+	require.Nil(t, err)
+	opts := effects.CTOpts{
+		BlurKernelSize: 9,
+		EdgeThreshold:  40,
+		OilFilterSize:  15,
+		OilLevels:      12,
+	}
+	cartoon := effects.WithBorder(effects.NewCartoon(opts), effects.Border{Mode: effects.BorderMirror})
+	cartoonImg, err := cartoon.Apply(turtle, 0)
+	require.Nil(t, err)
+	require.Equal(t, turtle.Bounds, cartoonImg.Bounds)
+
+	err = cartoonImg.Save("../../test/turtle-cartoon-mirror.jpg", effects.SaveOpts{ClipToBounds: true})
+	require.Nil(t, err)
+}
+
+func TestConvolution(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	src := image.NewRGBA(image.Rect(0, 0, 24, 18))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(rnd.Intn(256))
+		if i%4 == 3 {
+			src.Pix[i] = 255
+		}
+	}
+	img := effects.FromImage(src)
+
+	identity := effects.NewConvolution([][]float64{
+		{0, 0, 0},
+		{0, 1, 0},
+		{0, 0, 0},
+	}, effects.ConvOpts{})
+	outImg, err := identity.Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, effects.Rect{X: 1, Y: 1, Width: 22, Height: 16}, outImg.Bounds)
+	require.Equal(t, img.RGBAAt(5, 7), outImg.RGBAAt(5, 7))
+
+	// Rectangular kernels only shrink the bounds in the direction they extend
+	boxH := effects.NewConvolution([][]float64{{1, 1, 1, 1, 1}}, effects.ConvOpts{})
+	outImg, err = boxH.Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, effects.Rect{X: 2, Y: 0, Width: 20, Height: 18}, outImg.Bounds)
+	var sum int
+	for dx := -2; dx <= 2; dx++ {
+		sum += int(img.RGBAAt(10+dx, 4).G)
+	}
+	require.InDelta(t, float64(sum)/5, float64(outImg.RGBAAt(10, 4).G), 0.5)
+
+	emboss := effects.NewConvolution([][]float64{
+		{-1, -1, 0},
+		{-1, 0, 1},
+		{0, 1, 1},
+	}, effects.ConvOpts{Channels: effects.ConvLuminance, Bias: 128})
+	outImg, err = effects.WithBorder(emboss, effects.Border{Mode: effects.BorderClamp}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.Bounds, outImg.Bounds)
+	px := outImg.RGBAAt(12, 9)
+	require.Equal(t, px.R, px.G)
+	require.Equal(t, px.R, px.B)
+
+	_, err = effects.NewConvolution([][]float64{{1, 1}}, effects.ConvOpts{}).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewConvolution([][]float64{{1, 1, 1}, {1}, {1, 1, 1}}, effects.ConvOpts{}).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewConvolution(nil, effects.ConvOpts{}).Apply(img, 0)
+	require.NotNil(t, err)
+
+	turtle, err := effects.LoadImage("../../test/turtle.jpg")
+	require.Nil(t, err)
+	laplacian := effects.NewConvolution([][]float64{
+		{0, 1, 0},
+		{1, -4, 1},
+		{0, 1, 0},
+	}, effects.ConvOpts{Channels: effects.ConvLuminance, Divisor: 1})
+	outImg, err = laplacian.Apply(turtle, 0)
+	require.Nil(t, err)
+	err = outImg.Save("../../test/turtle-laplacian.jpg", effects.SaveOpts{ClipToBounds: true})
+	require.Nil(t, err)
+}
+
+func TestSharpen(t *testing.T) {
+	timing := timing.New()
+
+	timing.Time("load")
+	img, err := effects.LoadImage("../../test/face.jpg")
+	timing.TimeEnd("load")
+	require.Nil(t, err)
+	require.NotNil(t, img)
+
+	timing.Time("unsharp-mask")
+	usm := effects.NewUnsharpMask(effects.USMOpts{Sigma: 2, Amount: 1.5, Threshold: 3})
+	usmImg, err := usm.Apply(img, 0)
+	timing.TimeEnd("unsharp-mask")
+	require.Nil(t, err)
+	require.NotNil(t, usmImg)
+	require.Equal(t, effects.Rect{X: 6, Y: 6, Width: img.Width - 12, Height: img.Height - 12}, usmImg.Bounds)
+	err = usmImg.Save("../../test/face-unsharp-mask.jpg", effects.SaveOpts{ClipToBounds: true})
+	require.Nil(t, err)
+
+	timing.Time("sharpen")
+	sharpen := effects.WithBorder(effects.NewSharpen(1), effects.Border{Mode: effects.BorderClamp})
+	sharpImg, err := sharpen.Apply(img, 0)
+	timing.TimeEnd("sharpen")
+	require.Nil(t, err)
+	require.NotNil(t, sharpImg)
+	require.Equal(t, img.Bounds, sharpImg.Bounds)
+	err = sharpImg.Save("../../test/face-sharpen.jpg", effects.SaveOpts{})
+	require.Nil(t, err)
+
+	// A uniform image has no detail to sharpen
+	src := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for i := range src.Pix {
+		src.Pix[i] = 120
+	}
+	uniform := effects.FromImage(src)
+	usmImg, err = effects.NewUnsharpMask(effects.USMOpts{KernelSize: 5, Amount: 2}).Apply(uniform, 0)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 120, G: 120, B: 120, A: 120}, usmImg.RGBAAt(10, 10))
+	sharpImg, err = effects.NewSharpen(0.5).Apply(uniform, 0)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 120, G: 120, B: 120, A: 120}, sharpImg.RGBAAt(10, 10))
+
+	fmt.Println(img.Bounds)
+	fmt.Println(timing)
+}
+
+func TestCanny(t *testing.T) {
+	timing := timing.New()
+
+	timing.Time("load")
+	img, err := effects.LoadImage("../../test/turtle.jpg")
+	timing.TimeEnd("load")
+	require.Nil(t, err)
+	require.NotNil(t, img)
+
+	timing.Time("canny")
+	canny := effects.NewCanny(effects.CannyOpts{BlurKernelSize: 5, LowThreshold: 40, HighThreshold: 100})
+	cannyImg, err := canny.Apply(img, 0)
+	timing.TimeEnd("canny")
+	require.Nil(t, err)
+	require.NotNil(t, cannyImg)
+	require.Equal(t, effects.Rect{X: 4, Y: 4, Width: img.Width - 8, Height: img.Height - 8}, cannyImg.Bounds)
+
+	// Without a kernel size it is derived from the sigma, 2*ceil(3*sigma)+1
+	fromSigma, err := effects.NewCanny(effects.CannyOpts{BlurSigma: 1, LowThreshold: 40, HighThreshold: 100}).Apply(img, 0)
+	require.Nil(t, err)
+	explicit, err := effects.NewCanny(effects.CannyOpts{BlurKernelSize: 7, BlurSigma: 1, LowThreshold: 40, HighThreshold: 100}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, explicit.Bounds, fromSigma.Bounds)
+	require.Equal(t, explicit.ToRGBA().Pix, fromSigma.ToRGBA().Pix)
+	err = cannyImg.Save("../../test/turtle-canny.jpg", effects.SaveOpts{ClipToBounds: true})
+	require.Nil(t, err)
+
+	sobelImg, err := effects.NewSobel(100, false).Apply(img, 0)
+	require.Nil(t, err)
+
+	// Non-maximum suppression thins the edges, so there should be fewer edge pixels than
+	// the thresholded sobel image
+	var cannyCount, sobelCount int
+	b := cannyImg.Bounds
+	for y := b.Y; y < b.Y+b.Height; y++ {
+		for x := b.X; x < b.X+b.Width; x++ {
+			v := cannyImg.RGBAAt(x, y).R
+			require.True(t, v == 0 || v == 255)
+			if v == 255 {
+				cannyCount++
+			}
+			if sobelImg.RGBAAt(x, y).R == 255 {
+				sobelCount++
+			}
+		}
+	}
+	require.True(t, cannyCount > 0)
+	require.True(t, cannyCount < sobelCount)
+
+	_, err = effects.NewCanny(effects.CannyOpts{LowThreshold: 100, HighThreshold: 40}).Apply(img, 0)
+	require.NotNil(t, err)
+
+	timing.Time("cartoon-canny")
+	opts := effects.CTOpts{
+		BlurKernelSize: 5,
+		EdgeThreshold:  80,
+		EdgeDetector:   effects.EdgeCanny,
+		OilFilterSize:  15,
+		OilLevels:      12,
+	}
+	cartoonImg, err := effects.NewCartoon(opts).Apply(img, 0)
+	timing.TimeEnd("cartoon-canny")
+	require.Nil(t, err)
+	require.NotNil(t, cartoonImg)
+	err = cartoonImg.Save("../../test/turtle-cartoon-canny.jpg", effects.SaveOpts{ClipToBounds: true})
+	require.Nil(t, err)
+
+	fmt.Println(img.Bounds)
+	fmt.Println(timing)
+}
+
+func TestTransforms(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: uint8(x * 10), G: uint8(y * 10), A: 255})
+		}
+	}
+	img := effects.FromImage(src)
+
+	outImg, err := effects.NewRotate90().Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, outImg.Width)
+	require.Equal(t, 4, outImg.Height)
+	require.Equal(t, img.RGBAAt(0, 0), outImg.RGBAAt(2, 0))
+	require.Equal(t, img.RGBAAt(0, 2), outImg.RGBAAt(0, 0))
+
+	outImg, err = effects.NewRotate180().Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.RGBAAt(0, 0), outImg.RGBAAt(3, 2))
+
+	outImg, err = effects.NewRotate270().Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.RGBAAt(0, 0), outImg.RGBAAt(0, 3))
+
+	outImg, err = effects.NewFlipH().Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.RGBAAt(0, 1), outImg.RGBAAt(3, 1))
+
+	outImg, err = effects.NewFlipV().Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, img.RGBAAt(1, 0), outImg.RGBAAt(1, 2))
+
+	outImg, err = effects.NewCrop(effects.Rect{X: 1, Y: 1, Width: 10, Height: 10}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, effects.Rect{X: 0, Y: 0, Width: 3, Height: 2}, outImg.Bounds)
+	require.Equal(t, img.RGBAAt(1, 1), outImg.RGBAAt(0, 0))
+	_, err = effects.NewCrop(effects.Rect{X: 10, Y: 10, Width: 10, Height: 10}).Apply(img, 0)
+	require.NotNil(t, err)
+
+	outImg, err = effects.NewRotate(90, color.RGBA{}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, outImg.Width)
+	require.Equal(t, 4, outImg.Height)
+	require.Equal(t, img.RGBAAt(0, 0), outImg.RGBAAt(2, 0))
+
+	outImg, err = effects.NewRotate(45, color.RGBA{B: 255, A: 255}).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, 5, outImg.Width)
+	require.Equal(t, 5, outImg.Height)
+	require.Equal(t, color.RGBA{B: 255, A: 255}, outImg.RGBAAt(0, 0))
+
+	uniform := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for i := range uniform.Pix {
+		uniform.Pix[i] = 90
+	}
+	filters := []effects.ResampleFilter{
+		effects.ResampleNearest,
+		effects.ResampleBilinear,
+		effects.ResampleBicubic,
+		effects.ResampleLanczos,
+	}
+	for _, filter := range filters {
+		outImg, err = effects.NewResize(12, 0, filter).Apply(effects.FromImage(uniform), 0)
+		require.Nil(t, err)
+		require.Equal(t, 12, outImg.Width)
+		require.Equal(t, 8, outImg.Height)
+		require.Equal(t, color.RGBA{R: 90, G: 90, B: 90, A: 90}, outImg.RGBAAt(5, 5))
+
+		outImg, err = effects.NewResize(0, 50, filter).Apply(effects.FromImage(uniform), 0)
+		require.Nil(t, err)
+		require.Equal(t, 75, outImg.Width)
+		require.Equal(t, 50, outImg.Height)
+		require.Equal(t, color.RGBA{R: 90, G: 90, B: 90, A: 90}, outImg.RGBAAt(70, 45))
+	}
+	_, err = effects.NewResize(0, 0, effects.ResampleBilinear).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "resize"})
+	require.NotNil(t, err)
+
+	// The negative lobes of bicubic and lanczos overshoot next to a sharp edge from opaque white
+	// to transparent, the colors stay premultiplied
+	edge := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 8; x++ {
+			edge.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+		}
+	}
+	for _, filter := range []effects.ResampleFilter{effects.ResampleBicubic, effects.ResampleLanczos} {
+		for _, width := range []int{40, 7} {
+			outImg, err = effects.NewResize(width, 16, filter).Apply(effects.FromImage(edge), 0)
+			require.Nil(t, err)
+			for x := 0; x < outImg.Width; x++ {
+				c := outImg.RGBAAt(x, 8)
+				require.True(t, c.R <= c.A && c.G <= c.A && c.B <= c.A, "%s %d: %v at %d", filter, width, c, x)
+			}
+		}
+	}
+
+	turtle, err := effects.LoadImage("../../test/turtle.jpg")
+	require.Nil(t, err)
+	pipeline := effects.Pipeline{}
+	pipeline.Add(effects.NewResize(400, 0, effects.ResampleLanczos), nil)
+	pipeline.Add(effects.NewRotate(30, color.RGBA{R: 255, G: 255, B: 255, A: 255}), nil)
+	pipeline.Add(effects.NewFlipH(), nil)
+	outImg, err = pipeline.Run(turtle, 0)
+	require.Nil(t, err)
+	err = outImg.Save("../../test/turtle-transform.jpg", effects.SaveOpts{})
+	require.Nil(t, err)
+
+	// Effects that change the size of the image respect the maximum size in the context
+	ctx := effects.WithMaxSize(context.Background(), 100, 60)
+	small := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 40, 80)))
+	var sizeErr *effects.SizeError
+	_, err = effects.ApplyContext(ctx, effects.NewResize(65535, 0, effects.ResampleNearest), small, 0)
+	require.True(t, errors.As(err, &sizeErr), "%v", err)
+	require.Equal(t, effects.SizeError{Width: 65535, Height: 131070, MaxWidth: 100, MaxHeight: 60}, *sizeErr)
+	_, err = effects.ApplyContext(ctx, effects.NewRotate(45, color.RGBA{}), small, 0)
+	require.True(t, errors.As(err, &sizeErr), "%v", err)
+	outImg, err = effects.ApplyContext(ctx, effects.NewRotate90(), small, 0)
+	require.Nil(t, err)
+	require.Equal(t, 80, outImg.Width)
+	_, err = effects.ApplyContext(ctx, effects.NewRotate90(), outImg, 0)
+	require.True(t, errors.As(err, &sizeErr), "%v", err)
+	sized := effects.Pipeline{}
+	sized.Add(effects.NewGrayscale(effects.GSLUMINOSITY), nil)
+	sized.Add(effects.NewResize(0, 61, effects.ResampleBilinear), nil)
+	_, err = sized.RunContext(ctx, small, 0)
+	require.True(t, errors.As(err, &sizeErr), "%v", err)
+}
+
+func TestPipelineSpec(t *testing.T) {
+	data := []byte(`{"effects": [
+		{"effect": "gaussian", "kernelSize": 5, "sigma": 1, "border": "mirror"},
+		{"effect": "oil", "filterSize": 5, "levels": 30},
+		{"effect": "rotate", "degrees": 10, "background": "#ffffff"}
+	]}`)
+
+	var pipeline effects.Pipeline
+	err := json.Unmarshal(data, &pipeline)
+	require.Nil(t, err)
+
+	img, err := effects.LoadImage("../../test/face.jpg")
+	require.Nil(t, err)
+	outImg, err := pipeline.Run(img, 0)
+	require.Nil(t, err)
+	require.NotNil(t, outImg)
+
+	out, err := json.Marshal(pipeline)
+	require.Nil(t, err)
+	require.Equal(t, `{"effects":[`+
+		`{"effect":"gaussian","border":"mirror","kernelSize":5,"sigma":1},`+
+		`{"effect":"oil","filterSize":5,"levels":30},`+
+		`{"effect":"rotate","background":"#ffffffff","degrees":10}]}`, string(out))
+
+	yamlData, err := yaml.Marshal(pipeline)
+	require.Nil(t, err)
+	var fromYAML effects.Pipeline
+	err = yaml.Unmarshal(yamlData, &fromYAML)
+	require.Nil(t, err)
+	out2, err := json.Marshal(fromYAML)
+	require.Nil(t, err)
+	require.Equal(t, string(out), string(out2))
+
+	yamlData = []byte(`
+effects:
+  - effect: grayscale
+    algo: average
+  - effect: convolution
+    channels: luminance
+    kernel:
+      - [0, 1, 0]
+      - [1, -4, 1]
+      - [0, 1, 0]
+    divisor: 1
+`)
+	err = yaml.Unmarshal(yamlData, &fromYAML)
+	require.Nil(t, err)
+	spec, err := fromYAML.Spec()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(spec.Effects))
+	require.Equal(t, "average", spec.Effects[0].Params["algo"])
+	require.Equal(t, [][]float64{{0, 1, 0}, {1, -4, 1}, {0, 1, 0}}, spec.Effects[1].Params["kernel"])
+
+	// Every built in effect can be written out and read back again
+	all := effects.Pipeline{}
+	all.Add(effects.NewBrightness(20), nil)
+	all.Add(effects.NewCartoon(effects.CTOpts{BlurKernelSize: 5, EdgeThreshold: 40, EdgeDetector: effects.EdgeCanny, OilFilterSize: 5, OilLevels: 10}), nil)
+	all.Add(effects.NewGaussian(5, 1), nil)
+	all.Add(effects.NewGrayscale(effects.GSLIGHTNESS), nil)
+	all.Add(effects.NewOilPainting(5, 30), nil)
+	all.Add(effects.NewPencil(5), nil)
+	all.Add(effects.NewPixelate(10), nil)
+	all.Add(effects.NewSobel(100, true), nil)
+	all.Add(effects.NewConvolution([][]float64{{1, 2, 1}}, effects.ConvOpts{Bias: 10}), nil)
+	all.Add(effects.NewUnsharpMask(effects.USMOpts{Sigma: 1, Amount: 1}), nil)
+	all.Add(effects.NewSharpen(0.5), nil)
+	all.Add(effects.NewCanny(effects.CannyOpts{BlurKernelSize: 5, LowThreshold: 10, HighThreshold: 20}), nil)
+	all.Add(effects.NewResize(100, 0, effects.ResampleLanczos), nil)
+	all.Add(effects.NewCrop(effects.Rect{X: 1, Y: 2, Width: 30, Height: 40}), nil)
+	all.Add(effects.NewRotate90(), nil)
+	all.Add(effects.NewRotate180(), nil)
+	all.Add(effects.NewRotate270(), nil)
+	all.Add(effects.NewRotate(33, color.RGBA{R: 1, G: 2, B: 3, A: 4}), nil)
+	all.Add(effects.NewFlipH(), nil)
+	all.Add(effects.NewFlipV(), nil)
+	all.Add(effects.NewContrast(1.5, 100), nil)
+	all.Add(effects.NewGamma(2.2), nil)
+	all.Add(effects.NewLevels(effects.LevelsOpts{InBlack: 10, InWhite: 240, Gamma: 1.2, OutWhite: 250}), nil)
+	all.Add(effects.NewCurves(effects.CurvesOpts{Master: []effects.CurvePoint{{X: 0, Y: 10}, {X: 255, Y: 240}}, Blue: []effects.CurvePoint{{X: 0, Y: 0}, {X: 128, Y: 100}, {X: 255, Y: 255}}}), nil)
+	all.Add(effects.NewHueSaturation(-30, 1.2, 0.1), nil)
+	all.Add(effects.NewVibrance(0.4), nil)
+	all.Add(effects.NewColorize(200, 0.3, 0.8), nil)
+	all.Add(effects.NewAutoLevels(1), nil)
+	all.Add(effects.NewAutoContrast(0), nil)
+	all.Add(effects.NewEqualize(), nil)
+	all.Add(effects.NewCLAHE(effects.CLAHEOpts{Tiles: 4, ClipLimit: 3}), nil)
+	all.Add(effects.NewSepia(0.7), nil)
+	all.Add(effects.NewDuotone(color.RGBA{R: 10, G: 20, B: 90, A: 255}, color.RGBA{R: 250, G: 200, B: 150, A: 255}), nil)
+	all.Add(effects.NewGradientMap([]effects.GradientStop{{Pos: 0, Color: color.RGBA{A: 255}}, {Pos: 0.4, Color: color.RGBA{R: 200, G: 30, B: 10, A: 255}}, {Pos: 1, Color: color.RGBA{R: 255, G: 255, B: 200, A: 255}}}), nil)
+	all.Add(effects.NewQuantize(effects.QuantizeOpts{NumColors: 32, Algo: effects.QuantizeKMeans, Dither: effects.DitherOrdered}), nil)
+	all.Add(effects.NewQuantize(effects.QuantizeOpts{Palette: color.Palette{color.RGBA{A: 255}, color.RGBA{R: 250, G: 240, B: 230, A: 255}}, Dither: effects.DitherFloydSteinberg}), nil)
+	all.Add(effects.NewPosterize(5), nil)
+	all.Add(effects.WithBorder(effects.NewSobel(-1, false), effects.Border{Mode: effects.BorderConstant, Color: color.RGBA{R: 9, A: 255}}), nil)
+	expected, err := all.Spec()
+	require.Nil(t, err)
+
+	out, err = json.Marshal(all)
+	require.Nil(t, err)
+	var allFromJSON effects.Pipeline
+	err = json.Unmarshal(out, &allFromJSON)
+	require.Nil(t, err)
+	actual, err := allFromJSON.Spec()
+	require.Nil(t, err)
+	require.Equal(t, expected, actual)
+
+	yamlData, err = yaml.Marshal(all)
+	require.Nil(t, err)
+	var allFromYAML effects.Pipeline
+	err = yaml.Unmarshal(yamlData, &allFromYAML)
+	require.Nil(t, err)
+	actual, err = allFromYAML.Spec()
+	require.Nil(t, err)
+	require.Equal(t, expected, actual)
+
+	specPath := t.TempDir() + "/pipeline.yaml"
+	err = os.WriteFile(specPath, yamlData, 0644)
+	require.Nil(t, err)
+	loaded, err := effects.LoadPipeline(specPath)
+	require.Nil(t, err)
+	actual, err = loaded.Spec()
+	require.Nil(t, err)
+	require.Equal(t, expected, actual)
+
+	invalid := []string{
+		`{"effects": [{"effect": "unknown"}]}`,
+		`{"effects": [{"filterSize": 5}]}`,
+		`{"effects": [{"effect": "oil", "filterSize": 5.5}]}`,
+		`{"effects": [{"effect": "oil", "unknown": 5}]}`,
+		`{"effects": [{"effect": "sobel", "invert": "yes"}]}`,
+		`{"effects": [{"effect": "crop", "width": 10}]}`,
+		`{"effects": [{"effect": "grayscale", "algo": "unknown"}]}`,
+		`{"effects": [{"effect": "rotate", "degrees": 10, "background": "red"}]}`,
+		`{"effects": [{"effect": "gaussian", "border": "unknown"}]}`,
+	}
+	for _, data := range invalid {
+		err = json.Unmarshal([]byte(data), &pipeline)
+		require.NotNil(t, err, data)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	infos := effects.Effects()
+	require.True(t, len(infos) > 0)
+	for i, info := range infos {
+		if i > 0 {
+			require.True(t, infos[i-1].Name < info.Name)
+		}
+		require.NotEmpty(t, info.Description, info.Name)
+		for _, pi := range info.Params {
+			require.NotEmpty(t, pi.Description, info.Name+"."+pi.Name)
+		}
+	}
+
+	info, ok := effects.LookupEffect("gaussian")
+	require.True(t, ok)
+	require.Equal(t, "gaussian", info.Name)
+	_, ok = effects.LookupEffect("unknown")
+	require.False(t, ok)
+
+	kernelSize, ok := info.Param("kernelSize")
+	require.True(t, ok)
+	require.True(t, kernelSize.Odd)
+	for _, v := range []interface{}{0, 5, 255} {
+		_, err := kernelSize.Validate(v)
+		require.Nil(t, err, v)
+	}
+	for _, v := range []interface{}{4, -1, 257, 2.5, "5"} {
+		_, err := kernelSize.Validate(v)
+		require.NotNil(t, err, v)
+	}
+	v, err := kernelSize.Parse("7")
+	require.Nil(t, err)
+	require.Equal(t, 7, v)
+	_, err = kernelSize.Parse("seven")
+	require.NotNil(t, err)
+
+	info, _ = effects.LookupEffect("grayscale")
+	algo, _ := info.Param("algo")
+	require.Equal(t, []string{"lightness", "average", "luminosity"}, algo.Values)
+	_, err = algo.Parse("average")
+	require.Nil(t, err)
+	_, err = algo.Parse("unknown")
+	require.NotNil(t, err)
+
+	info, _ = effects.LookupEffect("convolution")
+	kernel, _ := info.Param("kernel")
+	v, err = kernel.Parse("0,1,0; 1,-4,1; 0,1,0")
+	require.Nil(t, err)
+	require.Equal(t, [][]float64{{0, 1, 0}, {1, -4, 1}, {0, 1, 0}}, v)
+
+	invalid := []effects.EffectSpec{
+		{Effect: "oil", Params: effects.Params{"filterSize": 1}},
+		{Effect: "pencil", Params: effects.Params{"blurFactor": 4}},
+		{Effect: "pencil", Params: effects.Params{"blurFactor": 0}},
+		{Effect: "brightness", Params: effects.Params{"offset": 300}},
+		{Effect: "cartoon", Params: effects.Params{"edgeDetector": "laplace"}},
+	}
+	for _, spec := range invalid {
+		_, err = effects.NewEffect(spec)
+		require.NotNil(t, err, spec.Effect)
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	// A red background, then a blue square that is cleared after it is shown, then a green square
+	pal := color.Palette{color.RGBA{}, color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}, color.RGBA{G: 255, A: 255}}
+	frame := func(r image.Rectangle, index uint8) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		for i := range p.Pix {
+			p.Pix[i] = index
+		}
+		return p
+	}
+	src := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 20, 20), 1),
+			frame(image.Rect(5, 5, 10, 10), 2),
+			frame(image.Rect(10, 10, 15, 15), 3),
+		},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{ColorModel: pal, Width: 20, Height: 20},
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, src)
+	require.Nil(t, err)
+
+	anim, err := effects.DecodeAnimation(&buf)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(anim.Frames))
+	require.Equal(t, 20, anim.Frames[1].Delay)
+	require.Equal(t, byte(gif.DisposalBackground), anim.Frames[1].Disposal)
+	require.Equal(t, color.RGBA{B: 255, A: 255}, anim.Frames[1].Image.RGBAAt(7, 7))
+	require.Equal(t, color.RGBA{}, anim.Frames[2].Image.RGBAAt(7, 7))
+	require.Equal(t, color.RGBA{G: 255, A: 255}, anim.Frames[2].Image.RGBAAt(12, 12))
+	require.Equal(t, color.RGBA{R: 255, A: 255}, anim.Frames[2].Image.RGBAAt(0, 0))
+
+	pipeline := &effects.Pipeline{}
+	pipeline.Add(effects.NewGrayscale(effects.GSAVERAGE), nil)
+	pipeline.Add(effects.NewBrightness(10), nil)
+	var fractions []float64
+	ctx := effects.WithProgress(context.Background(), func(p effects.Progress) {
+		fractions = append(fractions, p.Fraction)
+	})
+	gray, err := anim.ApplyContext(ctx, pipeline, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(gray.Frames))
+	require.Equal(t, 30, gray.Frames[2].Delay)
+	require.Equal(t, color.RGBA{R: 95, G: 95, B: 95, A: 255}, gray.Frames[0].Image.RGBAAt(0, 0))
+	require.Equal(t, 1.0, fractions[len(fractions)-1])
+
+	for _, shared := range []bool{true, false} {
+		buf.Reset()
+		err = anim.Encode(&buf, effects.AnimationOpts{SharedPalette: shared, NumColors: 64})
+		require.Nil(t, err)
+		data := buf.Bytes()
+		out, err := gif.DecodeAll(bytes.NewReader(data))
+		require.Nil(t, err)
+		require.Equal(t, []int{10, 20, 30}, out.Delay)
+		// Every frame is a complete image, so it is cleared before the next one is drawn
+		require.Equal(t, []byte{gif.DisposalBackground, gif.DisposalBackground, gif.DisposalBackground}, out.Disposal)
+		for _, p := range out.Image {
+			require.True(t, len(p.Palette) <= 64)
+			if shared {
+				require.Equal(t, len(out.Config.ColorModel.(color.Palette)), len(p.Palette))
+			}
+		}
+
+		// The cleared square is still transparent
+		decoded, err := effects.DecodeAnimation(bytes.NewReader(data))
+		require.Nil(t, err)
+		require.Equal(t, uint8(0), decoded.Frames[2].Image.RGBAAt(7, 7).A)
+	}
+
+	// A transparent pixel in a later frame doesn't show the earlier frames through it
+	clear := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	ghost := &effects.Animation{Frames: []effects.Frame{
+		{Image: anim.Frames[0].Image, Delay: 10, Disposal: gif.DisposalNone},
+		{Image: clear, Delay: 10, Disposal: gif.DisposalNone},
+	}}
+	buf.Reset()
+	err = ghost.Encode(&buf, effects.AnimationOpts{})
+	require.Nil(t, err)
+	decoded, err := effects.DecodeAnimation(&buf)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{}, decoded.Frames[1].Image.RGBAAt(0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = anim.ApplyContext(ctx, effects.NewOilPainting(5, 30), 0)
+	require.Equal(t, context.Canceled, err)
+
+	// The remaining frames are skipped once a frame fails
+	reports := 0
+	ctx = effects.WithProgress(context.Background(), func(p effects.Progress) {
+		reports++
+	})
+	_, err = anim.ApplyContext(ctx, effects.NewCrop(effects.Rect{X: 100, Y: 100, Width: 5, Height: 5}), 1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "frame 0")
+	require.Equal(t, 1, reports)
+
+	err = (&effects.Animation{}).Encode(&buf, effects.AnimationOpts{})
+	require.NotNil(t, err)
+}
+
+func TestOrientation(t *testing.T) {
+	// Left half red, right half blue
+	img := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 32, 16)))
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 16 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	// Big endian TIFF header and IFD0 containing only the orientation tag, 6 means the
+	// image has to be rotated 90 degrees clockwise to be upright
+	exif := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0, 0, 0, 0,
+	}
+	icc := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(icc)
+
+	var buf bytes.Buffer
+	err := img.Encode(&buf, effects.FormatJPEG, effects.SaveOpts{Metadata: &effects.Metadata{EXIF: exif, ICCProfile: icc}})
+	require.Nil(t, err)
+	data := append([]byte{}, buf.Bytes()...)
+
+	// DecodeConfig gives the dimensions of the upright image without decoding it
+	cfg, name, err := effects.DecodeConfig(bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, "jpeg", name)
+	require.Equal(t, 16, cfg.Width)
+	require.Equal(t, 32, cfg.Height)
+
+	upright, md, err := effects.DecodeWithMetadata(bytes.NewReader(data), effects.LoadOpts{})
+	require.Nil(t, err)
+	require.Equal(t, 16, upright.Width)
+	require.Equal(t, 32, upright.Height)
+	require.True(t, upright.RGBAAt(8, 4).R > 200)
+	require.True(t, upright.RGBAAt(8, 28).B > 200)
+	require.Equal(t, 6, md.Orientation)
+	require.Equal(t, icc, md.ICCProfile)
+
+	// Saving with the metadata keeps the profile but resets the orientation
+	buf.Reset()
+	err = upright.Encode(&buf, effects.FormatJPEG, effects.SaveOpts{Metadata: md})
+	require.Nil(t, err)
+	again, md2, err := effects.DecodeWithMetadata(&buf, effects.LoadOpts{})
+	require.Nil(t, err)
+	require.Equal(t, 1, md2.Orientation)
+	require.Equal(t, icc, md2.ICCProfile)
+	require.Equal(t, upright.Width, again.Width)
+
+	stored, md, err := effects.DecodeWithMetadata(bytes.NewReader(data), effects.LoadOpts{IgnoreOrientation: true})
+	require.Nil(t, err)
+	require.Equal(t, 32, stored.Width)
+	require.Equal(t, 6, md.Orientation)
+
+	for orientation, size := range map[byte][2]int{1: {32, 16}, 3: {32, 16}, 5: {16, 32}, 8: {16, 32}} {
+		exif[19] = orientation
+		buf.Reset()
+		err = img.Encode(&buf, effects.FormatJPEG, effects.SaveOpts{Metadata: &effects.Metadata{EXIF: exif}})
+		require.Nil(t, err)
+		oriented, err := effects.Decode(&buf)
+		require.Nil(t, err)
+		require.Equal(t, size, [2]int{oriented.Width, oriented.Height}, orientation)
+	}
+
+	// Images without EXIF are unchanged
+	loaded, md, err := effects.LoadImageWithMetadata(cabinPath, effects.LoadOpts{})
+	require.Nil(t, err)
+	require.Equal(t, 1, md.Orientation)
+	require.True(t, loaded.Width > loaded.Height)
+}
+
+func TestTransparency(t *testing.T) {
+	const logoPath = "../../test/logo.png"
+	img, err := effects.LoadImage(logoPath)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{}, img.ToRGBA().RGBAAt(0, 0))
+	require.Equal(t, uint8(255), img.ToRGBA().RGBAAt(48, 48).A)
+	require.Equal(t, uint8(128), img.ToRGBA().RGBAAt(16, 80).A)
+
+	// Params that have no default, or whose default doesn't suit the image
+	params := map[string]effects.Params{
+		"convolution": {"kernel": [][]float64{{0, -1, 0}, {-1, 5, -1}, {0, -1, 0}}},
+		"crop":        {"x": 0, "y": 0, "width": 96, "height": 96},
+		"pixelate":    {"blockSize": 8},
+		"resize":      {"width": 48},
+		"rotate":      {"degrees": 30},
+	}
+	// Effects that only change the color of each pixel, so must keep the alpha of every pixel
+	pointEffects := map[string]bool{
+		"autoContrast":  true,
+		"autoLevels":    true,
+		"brightness":    true,
+		"clahe":         true,
+		"colorize":      true,
+		"contrast":      true,
+		"curves":        true,
+		"duotone":       true,
+		"equalize":      true,
+		"gamma":         true,
+		"gradientMap":   true,
+		"grayscale":     true,
+		"hueSaturation": true,
+		"levels":        true,
+		"posterize":     true,
+		"quantize":      true,
+		"sepia":         true,
+		"vibrance":      true,
+	}
+
+	for _, info := range effects.Effects() {
+		e, err := effects.NewEffect(effects.EffectSpec{Effect: info.Name, Params: params[info.Name]})
+		require.Nil(t, err, info.Name)
+		out, err := e.Apply(img, 0)
+		require.Nil(t, err, info.Name)
+
+		rgba := out.ToRGBA()
+		b := rgba.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := rgba.RGBAAt(x, y)
+				if c.R > c.A || c.G > c.A || c.B > c.A {
+					require.Fail(t, "color is not premultiplied", "%s: %v at %d,%d", info.Name, c, x, y)
+				}
+			}
+		}
+		require.Equal(t, uint8(0), rgba.RGBAAt(b.Max.X-1, b.Min.Y).A, info.Name)
+		require.Equal(t, uint8(255), rgba.RGBAAt(b.Dx()/2, b.Dy()/2).A, info.Name)
+		if pointEffects[info.Name] {
+			require.Equal(t, uint8(128), rgba.RGBAAt(16, 80).A, info.Name)
+		}
+	}
+
+	// Blurring the edge of the logo must not darken it, the transparent pixels have no color
+	blurImg, err := effects.NewGaussian(9, 2).Apply(img, 0)
+	require.Nil(t, err)
+	edge := blurImg.ToRGBA().RGBAAt(48+21-4, 48-4)
+	require.True(t, edge.A > 0 && edge.A < 255, "%v", edge)
+	require.True(t, float64(edge.R)/float64(edge.A) > 0.75, "%v", edge)
+
+	pixelImg, err := effects.NewPixelate(8).Apply(img, 0)
+	require.Nil(t, err)
+	block := pixelImg.ToRGBA().RGBAAt(16, 80)
+	require.Equal(t, uint8(128), block.A)
+	require.True(t, block.B > block.R, "%v", block)
+
+	var buf bytes.Buffer
+	require.Nil(t, img.Encode(&buf, effects.FormatPNG, effects.SaveOpts{}))
+	decoded, err := effects.Decode(&buf)
+	require.Nil(t, err)
+	// Colors are premultiplied, so no channel can be larger than alpha
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "rotate", Params: effects.Params{"degrees": 10, "background": "#ff000080"}})
+	require.NotNil(t, err)
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "rotate", Params: effects.Params{"degrees": 10, "background": "#80000080"}})
+	require.Nil(t, err)
+
+	// PNG stores colors without premultiplying, so only the alpha survives exactly
+	before, after := img.ToRGBA().Pix, decoded.ToRGBA().Pix
+	require.Equal(t, len(before), len(after))
+	for i := 3; i < len(before); i += 4 {
+		require.Equal(t, before[i], after[i])
+	}
+}
+
+func TestTone(t *testing.T) {
+	// Every value from 0 to 255 in the red channel, green is constant and blue is inverted
+	src := image.NewRGBA(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		src.SetRGBA(x, 0, color.RGBA{R: uint8(x), G: 100, B: uint8(255 - x), A: 255})
+	}
+	img := effects.FromImage(src)
+
+	apply := func(e effects.Effect) *image.RGBA {
+		out, err := e.Apply(img, 0)
+		require.Nil(t, err)
+		require.Equal(t, img.Bounds, out.Bounds)
+		return out.ToRGBA()
+	}
+	red := func(out *image.RGBA, x int) int {
+		return int(out.RGBAAt(x, 0).R)
+	}
+
+	out := apply(effects.NewContrast(1, 128))
+	require.Equal(t, src.Pix, out.Pix)
+	out = apply(effects.NewContrast(0, 90))
+	require.Equal(t, 90, red(out, 0))
+	require.Equal(t, 90, red(out, 255))
+	out = apply(effects.NewContrast(2, 128))
+	require.Equal(t, 72, red(out, 100))
+	require.Equal(t, 255, red(out, 200))
+	require.Equal(t, 0, red(out, 10))
+
+	out = apply(effects.NewGamma(1))
+	require.Equal(t, src.Pix, out.Pix)
+	out = apply(effects.NewGamma(2))
+	require.Equal(t, 128, red(out, 64))
+	require.Equal(t, 0, red(out, 0))
+	require.Equal(t, 255, red(out, 255))
+	_, err := effects.NewGamma(0).Apply(img, 0)
+	require.NotNil(t, err)
+
+	out = apply(effects.NewLevels(effects.LevelsOpts{InBlack: 50, InWhite: 200, OutWhite: 255}))
+	require.Equal(t, 0, red(out, 20))
+	require.Equal(t, 0, red(out, 50))
+	require.Equal(t, 128, red(out, 125))
+	require.Equal(t, 255, red(out, 200))
+	require.Equal(t, 255, red(out, 230))
+	out = apply(effects.NewLevels(effects.LevelsOpts{InWhite: 255, OutBlack: 255, OutWhite: 0}))
+	require.Equal(t, 255, red(out, 0))
+	require.Equal(t, 0, red(out, 255))
+	_, err = effects.NewLevels(effects.LevelsOpts{InBlack: 200, InWhite: 100}).Apply(img, 0)
+	require.NotNil(t, err)
+
+	out = apply(effects.NewCurves(effects.CurvesOpts{Master: []effects.CurvePoint{{X: 0, Y: 0}, {X: 255, Y: 255}}}))
+	require.Equal(t, src.Pix, out.Pix)
+
+	// An S curve passes through its points, never decreases and doesn't overshoot
+	sCurve := []effects.CurvePoint{{X: 255, Y: 255}, {X: 64, Y: 48}, {X: 0, Y: 0}, {X: 192, Y: 208}}
+	out = apply(effects.NewCurves(effects.CurvesOpts{Master: sCurve}))
+	for _, p := range sCurve {
+		require.Equal(t, int(p.Y), red(out, int(p.X)))
+	}
+	for x := 1; x < 256; x++ {
+		require.True(t, red(out, x) >= red(out, x-1), x)
+	}
+	require.True(t, red(out, 100) < 100)
+	require.True(t, red(out, 160) > 160)
+
+	// Channel curves only change their channel, then the master curve is applied
+	out = apply(effects.NewCurves(effects.CurvesOpts{
+		Red:    []effects.CurvePoint{{X: 0, Y: 255}, {X: 255, Y: 0}},
+		Master: []effects.CurvePoint{{X: 0, Y: 0}, {X: 255, Y: 200}},
+	}))
+	require.Equal(t, color.RGBA{R: 200, G: 78, B: 200, A: 255}, out.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{R: 0, G: 78, B: 0, A: 255}, out.RGBAAt(255, 0))
+
+	invalid := []effects.EffectSpec{
+		{Effect: "curves", Params: effects.Params{"master": [][]float64{{0, 0}}}},
+		{Effect: "curves", Params: effects.Params{"red": [][]float64{{0, 0, 0}, {255, 255, 255}}}},
+		{Effect: "curves", Params: effects.Params{"green": [][]float64{{0, 0}, {0, 255}}}},
+		{Effect: "curves", Params: effects.Params{"blue": [][]float64{{0, 0}, {300, 255}}}},
+		{Effect: "levels", Params: effects.Params{"inBlack": 100, "inWhite": 100}},
+		{Effect: "gamma", Params: effects.Params{"gamma": 0}},
+		{Effect: "contrast", Params: effects.Params{"amount": -1}},
+	}
+	for _, spec := range invalid {
+		_, err = effects.NewEffect(spec)
+		require.NotNil(t, err, spec)
+	}
+	info, _ := effects.LookupEffect("curves")
+	master, _ := info.Param("master")
+	v, err := master.Parse("0,0;128,160;255,255")
+	require.Nil(t, err)
+	require.Equal(t, [][]float64{{0, 0}, {128, 160}, {255, 255}}, v)
+}
+
+func TestColorSpace(t *testing.T) {
+	h, s, l := effects.RGBToHSL(255, 0, 0)
+	require.Equal(t, []float64{0, 1, 0.5}, []float64{h, s, l})
+	h, s, v := effects.RGBToHSV(0, 0, 255)
+	require.Equal(t, []float64{240, 1, 1}, []float64{h, s, v})
+	h, s, l = effects.RGBToHSL(128, 128, 128)
+	require.Equal(t, 0.0, s)
+	require.InDelta(t, 0.502, l, 0.001)
+	lab := func(r, g, b uint8) []float64 {
+		l, a, bb := effects.RGBToLab(r, g, b)
+		return []float64{l, a, bb}
+	}
+	require.InDeltaSlice(t, []float64{100, 0, 0}, lab(255, 255, 255), 0.01)
+	require.InDeltaSlice(t, []float64{0, 0, 0}, lab(0, 0, 0), 0.01)
+	require.InDeltaSlice(t, []float64{53.24, 80.09, 67.20}, lab(255, 0, 0), 0.01)
+	y, cb, cr := effects.RGBToYCbCr(255, 255, 255)
+	require.Equal(t, []uint8{255, 128, 128}, []uint8{y, cb, cr})
+
+	// Converting to each color space and back gives the original color
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c := []uint8{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+		r, g, b := effects.HSLToRGB(effects.RGBToHSL(c[0], c[1], c[2]))
+		require.Equal(t, c, []uint8{r, g, b})
+		r, g, b = effects.HSVToRGB(effects.RGBToHSV(c[0], c[1], c[2]))
+		require.Equal(t, c, []uint8{r, g, b})
+		r, g, b = effects.LabToRGB(effects.RGBToLab(c[0], c[1], c[2]))
+		require.Equal(t, c, []uint8{r, g, b})
+		r, g, b = effects.YCbCrToRGB(effects.RGBToYCbCr(c[0], c[1], c[2]))
+		require.InDeltaSlice(t, []float64{float64(c[0]), float64(c[1]), float64(c[2])}, []float64{float64(r), float64(g), float64(b)}, 2)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	src.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+	src.SetRGBA(1, 0, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+	src.SetRGBA(2, 0, color.RGBA{R: 140, G: 120, B: 100, A: 255})
+	src.SetRGBA(3, 0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	img := effects.FromImage(src)
+	apply := func(e effects.Effect) *image.RGBA {
+		out, err := e.Apply(img, 0)
+		require.Nil(t, err)
+		return out.ToRGBA()
+	}
+
+	out := apply(effects.NewHueSaturation(0, 1, 0))
+	require.Equal(t, src.Pix, out.Pix)
+	out = apply(effects.NewHueSaturation(120, 1, 0))
+	require.Equal(t, color.RGBA{G: 255, A: 255}, out.RGBAAt(0, 0))
+	require.Equal(t, src.RGBAAt(1, 0), out.RGBAAt(1, 0))
+	out = apply(effects.NewHueSaturation(0, 0, 0))
+	require.Equal(t, color.RGBA{R: 128, G: 128, B: 128, A: 255}, out.RGBAAt(0, 0))
+	out = apply(effects.NewHueSaturation(0, 1, 1))
+	require.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, out.RGBAAt(0, 0))
+	out = apply(effects.NewHueSaturation(0, 1, -1))
+	require.Equal(t, color.RGBA{A: 255}, out.RGBAAt(0, 0))
+
+	// Vibrance boosts muted colors more than saturated ones and doesn't change grays
+	out = apply(effects.NewVibrance(1))
+	require.Equal(t, src.RGBAAt(1, 0), out.RGBAAt(1, 0))
+	require.Equal(t, src.RGBAAt(0, 0), out.RGBAAt(0, 0))
+	_, before, _ := effects.RGBToHSL(140, 120, 100)
+	c := out.RGBAAt(2, 0)
+	_, after, _ := effects.RGBToHSL(c.R, c.G, c.B)
+	require.True(t, after > before*1.5, "%v %v", before, after)
+
+	out = apply(effects.NewColorize(240, 1, 1))
+	require.Equal(t, color.RGBA{B: 255, A: 255}, out.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{R: 1, G: 1, B: 255, A: 255}, out.RGBAAt(1, 0))
+	require.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, out.RGBAAt(3, 0))
+	out = apply(effects.NewColorize(240, 1, 0))
+	require.Equal(t, src.Pix, out.Pix)
+
+	_, err := effects.NewEffect(effects.EffectSpec{Effect: "vibrance", Params: effects.Params{"amount": 2}})
+	require.NotNil(t, err)
+	_, err = effects.NewColorize(0, 1, 2).Apply(img, 0)
+	require.NotNil(t, err)
+}
+
+func TestNegativeRoutines(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			src.SetRGBA(x, y, color.RGBA{R: uint8(x * 10), G: uint8(y * 15), B: 80, A: 255})
+		}
+	}
+	img := effects.FromImage(src)
+
+	// A negative number of goroutines is treated as 1, it gives the same result as 1
+	for _, name := range []string{"oil", "clahe", "quantize", "equalize", "autoLevels", "pencil", "sobel", "gaussian"} {
+		e, err := effects.NewEffect(effects.EffectSpec{Effect: name})
+		require.Nil(t, err, name)
+		want, err := e.Apply(img, 1)
+		require.Nil(t, err, name)
+		got, err := e.Apply(img, -1)
+		require.Nil(t, err, name)
+		require.Equal(t, want.ToRGBA().Pix, got.ToRGBA().Pix, name)
+	}
+
+	kMeans, err := effects.NewQuantize(effects.QuantizeOpts{NumColors: 4, Algo: effects.QuantizeKMeans}).Apply(img, -1)
+	require.Nil(t, err)
+	require.Equal(t, img.Width, kMeans.Width)
+	require.Equal(t, effects.NewHistogram(img, 1), effects.NewHistogram(img, -1))
+	palette, err := effects.NewPalette(img, 4, effects.QuantizeKMeans, -1)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(palette))
+	require.Equal(t, 4, len(effects.Quantizer{NumRoutines: -1}.Quantize(make(color.Palette, 0, 4), src)))
+
+	anim := &effects.Animation{Frames: []effects.Frame{{Image: img}, {Image: img}}}
+	out, err := anim.Apply(effects.NewGrayscale(effects.GSAVERAGE), -1)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(out.Frames))
+	require.NotNil(t, out.Frames[1].Image)
+}
+
+func TestHistogram(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 256, 2))
+	for x := 0; x < 256; x++ {
+		src.SetRGBA(x, 0, color.RGBA{R: uint8(x), G: 100, B: uint8(255 - x), A: 255})
+	}
+	// Transparent pixels aren't counted, other pixels are counted by their unpremultiplied color
+	src.SetRGBA(0, 1, color.RGBA{R: 50, G: 50, B: 50, A: 128})
+	img := effects.FromImage(src)
+
+	h := effects.NewHistogram(img, 0)
+	require.Equal(t, 257, h.Count)
+	require.Equal(t, 257, h.Luminance.Total())
+	require.Equal(t, 256+1, h.Green[100])
+	require.Equal(t, 2, h.Red[100])
+	for v := 0; v < 256; v++ {
+		if v != 100 {
+			require.Equal(t, 1, h.Red[v])
+			require.Equal(t, 1, h.Blue[v])
+		}
+	}
+	require.Equal(t, 0, h.Red.Percentile(0))
+	require.Equal(t, 127, h.Red.Percentile(50))
+	require.Equal(t, 255, h.Red.Percentile(100))
+	require.Equal(t, 100, h.Green.Percentile(1))
+	require.InDelta(t, 127.5, h.Blue.Mean(), 0.5)
+
+	h = effects.NewHistogramRect(img, effects.Rect{X: 10, Y: 0, Width: 10, Height: 100}, 0)
+	require.Equal(t, 10, h.Count)
+	require.Equal(t, 1, h.Red[10])
+	require.Equal(t, 0, h.Red[20])
+
+	// The result doesn't depend on how many goroutines count the pixels
+	cabin, err := effects.LoadImage(cabinPath)
+	require.Nil(t, err)
+	require.Equal(t, effects.NewHistogram(cabin, 1), effects.NewHistogram(cabin, 7))
+
+	// A low contrast image with a color cast, red is 100-150 and blue 60-110
+	src = image.NewRGBA(image.Rect(0, 0, 51, 1))
+	for x := 0; x <= 50; x++ {
+		src.SetRGBA(x, 0, color.RGBA{R: uint8(100 + x), G: 80, B: uint8(60 + x), A: 255})
+	}
+	img = effects.FromImage(src)
+
+	out, err := effects.NewAutoLevels(0).Apply(img, 0)
+	require.Nil(t, err)
+	rgba := out.ToRGBA()
+	require.Equal(t, color.RGBA{R: 0, G: 80, B: 0, A: 255}, rgba.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{R: 255, G: 80, B: 255, A: 255}, rgba.RGBAAt(50, 0))
+
+	out, err = effects.NewAutoContrast(0).Apply(img, 0)
+	require.Nil(t, err)
+	rgba = out.ToRGBA()
+	require.Equal(t, color.RGBA{R: 113, G: 57, B: 0, A: 255}, rgba.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{R: 255, G: 57, B: 142, A: 255}, rgba.RGBAAt(50, 0))
+
+	// Clipping ignores the few pixels at either end
+	out, err = effects.NewAutoLevels(10).Apply(img, 0)
+	require.Nil(t, err)
+	rgba = out.ToRGBA()
+	require.Equal(t, uint8(0), rgba.RGBAAt(4, 0).R)
+	require.Equal(t, uint8(255), rgba.RGBAAt(46, 0).R)
+
+	out, err = effects.NewEqualize().Apply(img, 0)
+	require.Nil(t, err)
+	h = effects.NewHistogram(out, 0)
+	require.True(t, h.Luminance.Percentile(0) < 10, "%d", h.Luminance.Percentile(0))
+	require.True(t, h.Luminance.Percentile(100) > 235, "%d", h.Luminance.Percentile(100))
+	// The colors are kept, each channel moves by the same amount
+	rgba = out.ToRGBA()
+	c := rgba.RGBAAt(25, 0)
+	require.Equal(t, int(c.R)-int(c.G), 125-80)
+
+	// CLAHE brings out local detail, but a flat image stays flat
+	out, err = effects.NewCLAHE(effects.CLAHEOpts{Tiles: 8, ClipLimit: 2}).Apply(cabin, 0)
+	require.Nil(t, err)
+	require.Equal(t, cabin.Bounds, out.Bounds)
+	require.NotEqual(t, cabin.ToRGBA().Pix, out.ToRGBA().Pix)
+
+	flat := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+		if i%4 == 3 {
+			flat.Pix[i] = 255
+		}
+	}
+	out, err = effects.NewCLAHE(effects.CLAHEOpts{}).Apply(effects.FromImage(flat), 0)
+	require.Nil(t, err)
+	c = out.ToRGBA().RGBAAt(31, 20)
+	require.InDelta(t, 100, float64(c.R), 3)
+
+	_, err = effects.NewAutoContrast(60).Apply(img, 0)
+	require.NotNil(t, err)
+}
+
+func TestToning(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	src.SetRGBA(0, 0, color.RGBA{A: 255})
+	src.SetRGBA(1, 0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	src.SetRGBA(2, 0, color.RGBA{R: 100, G: 100, B: 100, A: 255})
+	src.SetRGBA(3, 0, color.RGBA{R: 64, G: 64, B: 64, A: 255})
+	img := effects.FromImage(src)
+	colors := func(e effects.Effect) []color.RGBA {
+		out, err := e.Apply(img, 0)
+		require.Nil(t, err)
+		rgba := out.ToRGBA()
+		var c []color.RGBA
+		for x := 0; x < 4; x++ {
+			c = append(c, rgba.RGBAAt(x, 0))
+		}
+		return c
+	}
+
+	c := colors(effects.NewSepia(1))
+	require.Equal(t, color.RGBA{R: 40, G: 20, B: 0, A: 255}, c[0])
+	require.Equal(t, color.RGBA{R: 255, G: 255, B: 235, A: 255}, c[1])
+	require.Equal(t, color.RGBA{R: 140, G: 120, B: 80, A: 255}, c[2])
+	c = colors(effects.NewSepia(0.5))
+	require.Equal(t, color.RGBA{R: 120, G: 110, B: 90, A: 255}, c[2])
+	c = colors(effects.NewSepia(0))
+	require.Equal(t, color.RGBA{R: 100, G: 100, B: 100, A: 255}, c[2])
+
+	blue, yellow := color.RGBA{B: 255, A: 255}, color.RGBA{R: 255, G: 255, A: 255}
+	c = colors(effects.NewDuotone(blue, yellow))
+	require.Equal(t, blue, c[0])
+	require.Equal(t, yellow, c[1])
+	require.Equal(t, color.RGBA{R: 64, G: 64, B: 191, A: 255}, c[3])
+
+	// Black to red to yellow, the stops don't have to be in order
+	heat := []effects.GradientStop{
+		{Pos: 1, Color: yellow},
+		{Pos: 0, Color: color.RGBA{A: 255}},
+		{Pos: 0.5, Color: color.RGBA{R: 255, A: 255}},
+	}
+	c = colors(effects.NewGradientMap(heat))
+	require.Equal(t, color.RGBA{A: 255}, c[0])
+	require.Equal(t, yellow, c[1])
+	require.Equal(t, color.RGBA{R: 128, A: 255}, c[3])
+	c = colors(effects.NewGradientMap([]effects.GradientStop{{Pos: 0.5, Color: blue}}))
+	require.Equal(t, []color.RGBA{blue, blue, blue, blue}, c)
+
+	e, err := effects.NewEffect(effects.EffectSpec{Effect: "gradientMap", Params: effects.Params{
+		"stops": [][]float64{{0, 0, 0, 0}, {0.5, 255, 0, 0}, {1, 255, 255, 0}},
+	}})
+	require.Nil(t, err)
+	require.Equal(t, colors(effects.NewGradientMap(heat)), colors(e))
+
+	invalid := []effects.Effect{
+		effects.NewSepia(1.5),
+		effects.NewDuotone(color.RGBA{B: 128, A: 128}, yellow),
+		effects.NewGradientMap(nil),
+		effects.NewGradientMap([]effects.GradientStop{{Pos: 2, Color: blue}}),
+	}
+	for _, e := range invalid {
+		_, err = e.Apply(img, 0)
+		require.NotNil(t, err)
+	}
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "gradientMap", Params: effects.Params{"stops": [][]float64{{0, 0, 0}}}})
+	require.NotNil(t, err)
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "gradientMap", Params: effects.Params{"stops": [][]float64{{0, 0, 0, 300}}}})
+	require.NotNil(t, err)
+	// A translucent duotone color is rejected when the spec is loaded, not when it is applied
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "duotone", Params: effects.Params{"highlight": "#40304080"}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "opaque")
+}
+
+func TestQuantize(t *testing.T) {
+	// Four blocks of solid color, with more pixels of red than the others
+	red := color.RGBA{R: 200, G: 30, B: 20, A: 255}
+	green := color.RGBA{R: 40, G: 180, B: 60, A: 255}
+	blue := color.RGBA{R: 10, G: 40, B: 220, A: 255}
+	white := color.RGBA{R: 250, G: 250, B: 250, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 40, 10))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 10; y++ {
+			c := red
+			switch {
+			case x >= 34:
+				c = white
+			case x >= 28:
+				c = blue
+			case x >= 22:
+				c = green
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+	img := effects.FromImage(src)
+	sorted := func(p color.Palette) []color.RGBA {
+		var c []color.RGBA
+		for _, pc := range p {
+			c = append(c, pc.(color.RGBA))
+		}
+		sort.Slice(c, func(i, j int) bool {
+			return c[i].R < c[j].R || (c[i].R == c[j].R && c[i].G < c[j].G)
+		})
+		return c
+	}
+
+	// With enough colors the palette is exactly the colors in the image
+	for _, algo := range []effects.QuantizeAlgo{effects.QuantizeMedianCut, effects.QuantizeKMeans} {
+		p, err := effects.NewPalette(img, 8, algo, 0)
+		require.Nil(t, err)
+		require.Equal(t, []color.RGBA{blue, green, red, white}, sorted(p), algo.String())
+		out, err := effects.NewQuantize(effects.QuantizeOpts{NumColors: 4, Algo: algo}).Apply(img, 3)
+		require.Nil(t, err)
+		require.Equal(t, src.Pix, out.ToRGBA().Pix)
+	}
+
+	// Two colors, the box is split at the median red value, which is inside the red pixels, so
+	// white is on its own and the other color is the average of the rest
+	p, err := effects.NewPalette(img, 2, effects.QuantizeMedianCut, 0)
+	require.Nil(t, err)
+	require.Equal(t, []color.RGBA{{R: 138, G: 58, B: 62, A: 255}, white}, sorted(p))
+
+	// Each palette has at most the requested number of colors and the output only uses them
+	cabin, err := effects.LoadImage("../../test/cabin.jpg")
+	require.Nil(t, err)
+	for _, opts := range []effects.QuantizeOpts{
+		{NumColors: 8},
+		{NumColors: 8, Algo: effects.QuantizeKMeans},
+		{NumColors: 8, Dither: effects.DitherFloydSteinberg},
+		{NumColors: 8, Algo: effects.QuantizeKMeans, Dither: effects.DitherOrdered},
+	} {
+		p, err := effects.NewPalette(cabin, opts.NumColors, opts.Algo, 0)
+		require.Nil(t, err)
+		require.Equal(t, 8, len(p))
+		inPalette := map[color.RGBA]bool{}
+		for _, c := range p {
+			inPalette[c.(color.RGBA)] = true
+		}
+		out, err := effects.NewQuantize(opts).Apply(cabin, 0)
+		require.Nil(t, err)
+		rgba := out.ToRGBA()
+		for i := 0; i < len(rgba.Pix); i += 4 {
+			c := color.RGBA{R: rgba.Pix[i], G: rgba.Pix[i+1], B: rgba.Pix[i+2], A: rgba.Pix[i+3]}
+			if !inPalette[c] {
+				require.Fail(t, "color is not in the palette", "%v: %v", opts, c)
+			}
+		}
+	}
+
+	// Dithering a flat gray to black and white gives about half of each
+	gray := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range gray.Pix {
+		gray.Pix[i] = 128
+		if i%4 == 3 {
+			gray.Pix[i] = 255
+		}
+	}
+	bw := color.Palette{color.Black, color.White}
+	for _, dither := range []effects.DitherMode{effects.DitherNone, effects.DitherFloydSteinberg, effects.DitherOrdered} {
+		out, err := effects.NewQuantize(effects.QuantizeOpts{Palette: bw, Dither: dither}).Apply(effects.FromImage(gray), 0)
+		require.Nil(t, err)
+		h := effects.NewHistogram(out, 0)
+		require.Equal(t, h.Count, h.Red[0]+h.Red[255], dither.String())
+		if dither == effects.DitherNone {
+			require.Equal(t, h.Count, h.Red[255])
+		} else {
+			require.InDelta(t, 0.5, float64(h.Red[255])/float64(h.Count), 0.02, dither.String())
+		}
+	}
+
+	// The Quantizer gives GIFs a palette made from the image, so the colors survive exactly
+	var buf bytes.Buffer
+	err = img.Encode(&buf, effects.FormatGIF, effects.SaveOpts{GIFQuantizer: effects.Quantizer{}})
+	require.Nil(t, err)
+	decoded, err := effects.Decode(&buf)
+	require.Nil(t, err)
+	require.Equal(t, src.Pix, decoded.ToRGBA().Pix)
+
+	// A fully transparent image has no colors to build a palette from, it is saved with a
+	// transparent palette entry rather than an empty palette
+	buf.Reset()
+	clear := effects.FromImage(image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	err = clear.Encode(&buf, effects.FormatGIF, effects.SaveOpts{GIFQuantizer: effects.Quantizer{}})
+	require.Nil(t, err)
+	decoded, err = effects.Decode(&buf)
+	require.Nil(t, err)
+	require.Equal(t, clear.ToRGBA().Pix, decoded.ToRGBA().Pix)
+	for _, dither := range []effects.DitherMode{effects.DitherNone, effects.DitherFloydSteinberg, effects.DitherOrdered} {
+		out, err := effects.NewQuantize(effects.QuantizeOpts{Dither: dither}).Apply(clear, 0)
+		require.Nil(t, err, dither.String())
+		require.Equal(t, clear.ToRGBA().Pix, out.ToRGBA().Pix, dither.String())
+	}
+
+	out, err := effects.NewPosterize(3).Apply(effects.FromImage(gray), 0)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 128, G: 128, B: 128, A: 255}, out.ToRGBA().RGBAAt(0, 0))
+	out, err = effects.NewPosterize(2).Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{R: 255, A: 255}, out.ToRGBA().RGBAAt(0, 0))
+
+	e, err := effects.NewEffect(effects.EffectSpec{Effect: "quantize", Params: effects.Params{"palette": [][]float64{{0, 0, 0}, {255, 255, 255}}}})
+	require.Nil(t, err)
+	out, err = e.Apply(img, 0)
+	require.Nil(t, err)
+	require.Equal(t, color.RGBA{A: 255}, out.ToRGBA().RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, out.ToRGBA().RGBAAt(39, 0))
+
+	_, err = effects.NewPalette(img, 1, effects.QuantizeMedianCut, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewQuantize(effects.QuantizeOpts{NumColors: 300}).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewPosterize(1).Apply(img, 0)
+	require.NotNil(t, err)
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "quantize", Params: effects.Params{"palette": [][]float64{{0, 0}}}})
+	require.NotNil(t, err)
+	_, err = effects.NewEffect(effects.EffectSpec{Effect: "quantize", Params: effects.Params{"dither": "random"}})
+	require.NotNil(t, err)
+}
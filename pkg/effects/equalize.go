@@ -0,0 +1,345 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+type autoLevels struct {
+	clip     float64
+	separate bool
+}
+
+type equalize struct{}
+
+// CLAHEOpts options to pass to the CLAHE effect
+type CLAHEOpts struct {
+	// Tiles is the number of tiles the image is split in to horizontally and vertically, each
+	// tile is equalized separately. If 0, defaults to 8
+	Tiles int
+
+	// ClipLimit limits how much the contrast is increased, a histogram bin can hold at most
+	// ClipLimit times the average number of pixels in a bin, the rest are spread over the other
+	// bins. Values around 2-4 work well, 0 means there is no limit
+	ClipLimit float64
+}
+
+type clahe struct {
+	opts CLAHEOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "autoLevels",
+		Description: "Stretches each channel separately so its darkest and lightest values become black and white",
+		Params: []ParamInfo{
+			{Name: "clip", Description: "percent of the darkest and lightest pixels clipped to black and white", Type: ParamFloat, Default: 0.5, Min: 0, Max: 50},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewAutoLevels(p.Float("clip")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "autoContrast",
+		Description: "Stretches all channels together so the darkest and lightest values become black and white",
+		Params: []ParamInfo{
+			{Name: "clip", Description: "percent of the darkest and lightest pixels clipped to black and white", Type: ParamFloat, Default: 0.5, Min: 0, Max: 50},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewAutoContrast(p.Float("clip")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "equalize",
+		Description: "Spreads the luminance of the pixels evenly over the whole range",
+		New: func(p Params) (Effect, error) {
+			return NewEqualize(), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "clahe",
+		Description: "Contrast limited adaptive histogram equalization, brings out local detail",
+		Params: []ParamInfo{
+			{Name: "tiles", Description: "number of tiles across and down the image that are equalized separately", Type: ParamInt, Default: 8, Min: 1, Max: 256},
+			{Name: "clipLimit", Description: "limits how much the contrast is increased, 0 for no limit", Type: ParamFloat, Default: 2.0, Min: 0, Max: 256},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewCLAHE(CLAHEOpts{Tiles: p.Int("tiles"), ClipLimit: p.Float("clipLimit")}), nil
+		},
+	})
+}
+
+// NewAutoLevels returns an effect that stretches each channel separately, so the darkest value
+// in the channel becomes 0 and the lightest 255. clip is the percent, between 0 and 50, of the
+// darkest and lightest pixels that are ignored when finding the values, so a few stray pixels
+// don't stop the image from being stretched. Stretching the channels separately also removes
+// color casts, use NewAutoContrast to keep the colors of the image
+func NewAutoLevels(clip float64) Effect {
+	return &autoLevels{clip: clip, separate: true}
+}
+
+// NewAutoContrast returns an effect that stretches the channels of the image together, so the
+// darkest value of any channel becomes 0 and the lightest 255. clip is the percent, between 0 and
+// 50, of the darkest and lightest pixels that are ignored when finding the values
+func NewAutoContrast(clip float64) Effect {
+	return &autoLevels{clip: clip}
+}
+
+func (al *autoLevels) Apply(img *Image, numRoutines int) (*Image, error) {
+	return al.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (al *autoLevels) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if al.clip < 0 || al.clip > 50 {
+		return nil, fmt.Errorf("clip must be between 0 and 50, got: %v", al.clip)
+	}
+
+	h, err := computeHistogram(subProgress(ctx, 0, 0.5), img, img.Bounds, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []*HistogramChannel{&h.Red, &h.Green, &h.Blue}
+	var black, white [3]int
+	for i, c := range channels {
+		black[i] = c.Percentile(al.clip)
+		white[i] = c.Percentile(100 - al.clip)
+	}
+	if !al.separate {
+		lo, hi := black[0], white[0]
+		for i := 1; i < 3; i++ {
+			if black[i] < lo {
+				lo = black[i]
+			}
+			if white[i] > hi {
+				hi = white[i]
+			}
+		}
+		black = [3]int{lo, lo, lo}
+		white = [3]int{hi, hi, hi}
+	}
+
+	var lut toneLUT
+	for i := range lut {
+		for v := 0; v < 256; v++ {
+			if black[i] >= white[i] {
+				// A single value, there is nothing to stretch
+				lut[i][v] = uint8(v)
+				continue
+			}
+			lut[i][v] = clampUint8(float64(v-black[i]) * 255 / float64(white[i]-black[i]))
+		}
+	}
+	return applyToneLUT(subProgress(ctx, 0.5, 1), img, numRoutines, &lut)
+}
+
+func (al *autoLevels) Spec() EffectSpec {
+	name := "autoContrast"
+	if al.separate {
+		name = "autoLevels"
+	}
+	return EffectSpec{Effect: name, Params: Params{"clip": al.clip}}
+}
+
+// NewEqualize returns an effect that applies histogram equalization to the luminance of the
+// image, so the luminance of the pixels is spread evenly from black to white. This brings out
+// detail in images where most pixels have a similar brightness, the red, green and blue channels
+// are all shifted by the change in luminance so the colors are kept
+func NewEqualize() Effect {
+	return &equalize{}
+}
+
+func (e *equalize) Apply(img *Image, numRoutines int) (*Image, error) {
+	return e.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (e *equalize) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	h, err := computeHistogram(subProgress(ctx, 0, 0.5), img, img.Bounds, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+	lut := equalizeLUT(&h.Luminance, 0)
+	return mapColors(subProgress(ctx, 0.5, 1), img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		l := luminosity(r, g, b)
+		return shiftLuminance(r, g, b, lut[clampUint8(l)]-l)
+	})
+}
+
+func (e *equalize) Spec() EffectSpec {
+	return EffectSpec{Effect: "equalize", Params: Params{}}
+}
+
+// NewCLAHE returns an effect that applies contrast limited adaptive histogram equalization. The
+// image is split in to tiles that are each equalized separately, so detail is brought out in both
+// the dark and light areas of the image, and the results are interpolated between the tiles so
+// their edges don't show. Like NewEqualize it works on the luminance of the image
+func NewCLAHE(opts CLAHEOpts) Effect {
+	return &clahe{opts: opts}
+}
+
+func (c *clahe) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *clahe) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if c.opts.Tiles < 0 || c.opts.ClipLimit < 0 {
+		return nil, fmt.Errorf("tiles and clip limit must not be negative, got: %d, %v", c.opts.Tiles, c.opts.ClipLimit)
+	}
+	numRoutines = routines(numRoutines)
+
+	b := img.Bounds
+	if b.IsEmpty() {
+		return nil, fmt.Errorf("image bounds are empty")
+	}
+	tiles := c.opts.Tiles
+	if tiles == 0 {
+		tiles = 8
+	}
+	nx, ny := tiles, tiles
+	if nx > b.Width {
+		nx = b.Width
+	}
+	if ny > b.Height {
+		ny = b.Height
+	}
+	tileIndex := func(x, y int) int {
+		return ((y-b.Y)*ny/b.Height)*nx + (x-b.X)*nx/b.Width
+	}
+
+	// Each goroutine counts the luminance of every tile, then they are added together
+	partials := make([][]HistogramChannel, numRoutines)
+	for ri := range partials {
+		partials[ri] = make([]HistogramChannel, nx*ny)
+	}
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		a := inPix[offset+3]
+		if a == 0 {
+			return
+		}
+		r, g, bl := inPix[offset], inPix[offset+1], inPix[offset+2]
+		if a != 255 {
+			r, g, bl = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(bl, a)
+		}
+		partials[ri][tileIndex(x, y)][clampUint8(luminosity(r, g, bl))]++
+	}
+	if err := runParallel(subProgress(ctx, 0, 0.4), numRoutines, img, b, img, pf, 0); err != nil {
+		return nil, err
+	}
+
+	luts := make([]*[256]float64, nx*ny)
+	for t := range luts {
+		var hist HistogramChannel
+		for ri := range partials {
+			for v, n := range partials[ri][t] {
+				hist[v] += n
+			}
+		}
+		luts[t] = equalizeLUT(&hist, c.opts.ClipLimit)
+	}
+
+	// Each tile's mapping is exact at the center of the tile, between centers the mappings of the
+	// four closest tiles are bilinearly interpolated
+	tileW := float64(b.Width) / float64(nx)
+	tileH := float64(b.Height) / float64(ny)
+	neighbours := func(p, size float64, n int) (int, int, float64) {
+		f := p/size - 0.5
+		i0 := int(math.Floor(f))
+		w := f - float64(i0)
+		if i0 < 0 {
+			return 0, 0, 0
+		}
+		if i0 >= n-1 {
+			return n - 1, n - 1, 0
+		}
+		return i0, i0 + 1, w
+	}
+	return mapColorsAt(subProgress(ctx, 0.4, 1), img, numRoutines, func(x, y int, r, g, bl uint8) (uint8, uint8, uint8) {
+		x0, x1, wx := neighbours(float64(x-b.X)+0.5, tileW, nx)
+		y0, y1, wy := neighbours(float64(y-b.Y)+0.5, tileH, ny)
+		l := luminosity(r, g, bl)
+		v := clampUint8(l)
+		top := luts[y0*nx+x0][v]*(1-wx) + luts[y0*nx+x1][v]*wx
+		bottom := luts[y1*nx+x0][v]*(1-wx) + luts[y1*nx+x1][v]*wx
+		return shiftLuminance(r, g, bl, top*(1-wy)+bottom*wy-l)
+	})
+}
+
+func (c *clahe) Spec() EffectSpec {
+	tiles := c.opts.Tiles
+	if tiles == 0 {
+		tiles = 8
+	}
+	return EffectSpec{Effect: "clahe", Params: Params{"tiles": tiles, "clipLimit": c.opts.ClipLimit}}
+}
+
+// equalizeLUT returns the mapping that spreads the values in the histogram evenly from 0 to 255.
+// If clipLimit is greater than 0, no bin can hold more than clipLimit times the average number
+// of pixels in a bin, the excess is spread evenly over all of the bins, which limits how much the
+// contrast is increased
+func equalizeLUT(c *HistogramChannel, clipLimit float64) *[256]float64 {
+	var lut [256]float64
+	total := c.Total()
+	if total == 0 {
+		for v := range lut {
+			lut[v] = float64(v)
+		}
+		return &lut
+	}
+
+	var hist [256]float64
+	for v, n := range c {
+		hist[v] = float64(n)
+	}
+
+	if clipLimit > 0 {
+		limit := clipLimit * float64(total) / 256
+		if limit < 1 {
+			limit = 1
+		}
+		excess := 0.0
+		for v := range hist {
+			if hist[v] > limit {
+				excess += hist[v] - limit
+				hist[v] = limit
+			}
+		}
+		for v := range hist {
+			hist[v] += excess / 256
+		}
+
+		cumulative := 0.0
+		for v := range hist {
+			cumulative += hist[v]
+			lut[v] = cumulative * 255 / float64(total)
+		}
+		return &lut
+	}
+
+	// Without clipping the darkest value maps to 0, so the full range is used
+	cdfMin := 0.0
+	for _, n := range hist {
+		if n > 0 {
+			cdfMin = n
+			break
+		}
+	}
+	if cdfMin == float64(total) {
+		for v := range lut {
+			lut[v] = float64(v)
+		}
+		return &lut
+	}
+	cumulative := 0.0
+	for v := range hist {
+		cumulative += hist[v]
+		lut[v] = math.Max(cumulative-cdfMin, 0) * 255 / (float64(total) - cdfMin)
+	}
+	return &lut
+}
+
+// shiftLuminance adds d to every channel, which changes the luminance of the color by d while
+// keeping the differences between the channels, so the color stays the same
+func shiftLuminance(r, g, b uint8, d float64) (uint8, uint8, uint8) {
+	return clampUint8(float64(r) + d), clampUint8(float64(g) + d), clampUint8(float64(b) + d)
+}
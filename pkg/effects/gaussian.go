@@ -1,10 +1,9 @@
 package effects
 
 import (
+	"context"
 	"fmt"
-	"image"
 	"math"
-	"runtime"
 )
 
 type gaussian struct {
@@ -12,7 +11,24 @@ type gaussian struct {
 	sigma      float64
 }
 
-// NewGaussian is an effect that applies a gaussian blur to the image
+func init() {
+	Register(EffectInfo{
+		Name:        "gaussian",
+		Description: "Blurs the image with a gaussian kernel",
+		Params: []ParamInfo{
+			{Name: "kernelSize", Description: "size of the kernel, 0 derives it from sigma", Type: ParamInt, Default: 0, Min: 0, Max: 255, Odd: true},
+			{Name: "sigma", Description: "standard deviation of the kernel, 0 derives it from kernelSize", Type: ParamFloat, Default: 1.0, Min: 0, Max: 100},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewGaussian(p.Int("kernelSize"), p.Float("sigma")), nil
+		},
+	})
+}
+
+// NewGaussian is an effect that applies a gaussian blur to the image. kernelSize must be odd,
+// if it is 0 it is derived from sigma so that the kernel covers 3 standard deviations either
+// side of the center pixel. If sigma is 0 it is derived from kernelSize. The blur is applied
+// as two separate horizontal and vertical passes, so large kernels remain fast
 func NewGaussian(kernelSize int, sigma float64) Effect {
 	return &gaussian{
 		kernelSize: kernelSize,
@@ -21,79 +37,85 @@ func NewGaussian(kernelSize int, sigma float64) Effect {
 }
 
 func (g *gaussian) Apply(img *Image, numRoutines int) (*Image, error) {
-	if !isOddInt(g.kernelSize) {
-		return nil, fmt.Errorf("kernel size must be odd")
-	}
+	return g.ApplyContext(context.Background(), img, numRoutines)
+}
 
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
+func (g *gaussian) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	kernelSize, sigma, err := g.params()
+	if err != nil {
+		return nil, err
 	}
 
-	kernel := gaussianKernel(g.kernelSize, g.sigma)
-	kernelOffset := (g.kernelSize - 1) / 2
-	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
-		var gr, gb, gg float64
-		for dy := -kernelOffset; dy <= kernelOffset; dy++ {
-			for dx := -kernelOffset; dx <= kernelOffset; dx++ {
-				pOffset := offset + (dx*4 + dy*inStride)
-				r := inPix[pOffset]
-				g := inPix[pOffset+1]
-				b := inPix[pOffset+2]
+	numRoutines = routines(numRoutines)
 
-				scale := kernel[dx+kernelOffset][dy+kernelOffset]
-				gr += scale * float64(r)
-				gg += scale * float64(g)
-				gb += scale * float64(b)
-			}
-		}
+	// The gaussian function is separable, so rather than a single pass with a two dimensional
+	// kernel, the image is blurred horizontally and then vertically with one dimensional kernels
+	kernel := gaussianKernel(kernelSize, sigma)
+	column := make([][]float64, kernelSize)
+	for i, w := range kernel {
+		column[i] = []float64{w}
+	}
+	horizontal := NewConvolution([][]float64{kernel}, ConvOpts{Divisor: 1})
+	vertical := NewConvolution(column, ConvOpts{Divisor: 1})
 
-		outPix[offset] = uint8(gr)
-		outPix[offset+1] = uint8(gg)
-		outPix[offset+2] = uint8(gb)
-		outPix[offset+3] = 255
+	tmp, err := ApplyContext(subProgress(ctx, 0, 0.5), horizontal, img, numRoutines)
+	if err != nil {
+		return nil, err
 	}
+	return ApplyContext(subProgress(ctx, 0.5, 1), vertical, tmp, numRoutines)
+}
 
-	out := &Image{
-		img: image.NewRGBA(image.Rectangle{
-			Min: image.Point{X: 0, Y: 0},
-			Max: image.Point{X: img.Width, Y: img.Height},
-		}),
-		Width:  img.Width,
-		Height: img.Height,
-		Bounds: Rect{
-			X:      img.Bounds.X + kernelOffset,
-			Y:      img.Bounds.Y + kernelOffset,
-			Width:  img.Bounds.Width - 2*kernelOffset,
-			Height: img.Bounds.Height - 2*kernelOffset,
-		},
+// params returns the kernel size and sigma, deriving either of them from the other
+// if they were not specified
+func (g *gaussian) params() (int, float64, error) {
+	kernelSize, sigma := g.kernelSize, g.sigma
+	if kernelSize == 0 && sigma <= 0 {
+		return 0, 0, fmt.Errorf("one of kernel size or sigma must be specified")
 	}
+	if kernelSize == 0 {
+		kernelSize = 2*int(math.Ceil(3*sigma)) + 1
+	}
+	if sigma <= 0 {
+		sigma = 0.3*(float64(kernelSize-1)*0.5-1) + 0.8
+	}
+	if !isOddInt(kernelSize) || kernelSize < 0 {
+		return 0, 0, fmt.Errorf("kernel size must be odd")
+	}
+	return kernelSize, sigma, nil
+}
 
-	runParallel(numRoutines, img, out.Bounds, out, pf, 0)
-	return out, nil
+func (g *gaussian) kernelRadius() int {
+	kernelSize, _, err := g.params()
+	if err != nil {
+		return 0
+	}
+	return (kernelSize - 1) / 2
 }
 
-func gaussianKernel(dimension int, sigma float64) [][]float64 {
-	k := make([][]float64, dimension)
+// gaussianKernel returns a one dimensional, normalized gaussian kernel centered on
+// the middle element
+func gaussianKernel(dimension int, sigma float64) []float64 {
+	k := make([]float64, dimension)
+	center := (dimension - 1) / 2
 	sum := 0.0
-	for x := 0; x < dimension; x++ {
-		k[x] = make([]float64, dimension)
-		for y := 0; y < dimension; y++ {
-			k[x][y] = gaussianXY(x, y, sigma)
-			sum += k[x][y]
-		}
+	for i := 0; i < dimension; i++ {
+		k[i] = gaussianX(i-center, sigma)
+		sum += k[i]
 	}
 
 	scale := 1.0 / sum
-	for y := 0; y < dimension; y++ {
-		for x := 0; x < dimension; x++ {
-			k[x][y] *= scale
-		}
+	for i := range k {
+		k[i] *= scale
 	}
-
 	return k
 }
 
-// expects x,y to be 0 at the center of the kernel
-func gaussianXY(x, y int, sigma float64) float64 {
-	return ((1.0 / (2 * math.Pi * sigma * sigma)) * math.E) - (float64(x*x+y*y) / (2 * sigma * sigma))
+// expects x to be 0 at the center of the kernel. The normalizing constant is left
+// out since the kernel is normalized after it has been computed
+func gaussianX(x int, sigma float64) float64 {
+	return math.Exp(-float64(x*x) / (2 * sigma * sigma))
+}
+
+func (g *gaussian) Spec() EffectSpec {
+	return EffectSpec{Effect: "gaussian", Params: Params{"kernelSize": g.kernelSize, "sigma": g.sigma}}
 }
@@ -1,9 +1,10 @@
 package effects
 
 import (
+	"context"
+	"fmt"
 	"image"
 	"math"
-	"runtime"
 )
 
 // GSAlgo the type of algorithm to use when converting an image to it's grayscale equivalent
@@ -24,33 +25,76 @@ type grayscale struct {
 	algo GSAlgo
 }
 
-func (gs *grayscale) Apply(img *Image, numRoutines int) (*Image, error) {
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
+func init() {
+	Register(EffectInfo{
+		Name:        "grayscale",
+		Description: "Converts the image to grayscale",
+		Params: []ParamInfo{
+			{Name: "algo", Description: "how the gray value is computed", Type: ParamString, Default: GSLUMINOSITY.String(), Values: []string{GSLIGHTNESS.String(), GSAVERAGE.String(), GSLUMINOSITY.String()}},
+		},
+		New: func(p Params) (Effect, error) {
+			algo, err := parseGSAlgo(p.String("algo"))
+			if err != nil {
+				return nil, err
+			}
+			return NewGrayscale(algo), nil
+		},
+	})
+}
+
+// String returns the name of the algorithm as used in pipeline specs
+func (a GSAlgo) String() string {
+	switch a {
+	case GSLIGHTNESS:
+		return "lightness"
+	case GSAVERAGE:
+		return "average"
+	case GSLUMINOSITY:
+		return "luminosity"
+	default:
+		return fmt.Sprintf("GSAlgo(%d)", int(a))
 	}
+}
+
+func parseGSAlgo(s string) (GSAlgo, error) {
+	for _, a := range []GSAlgo{GSLIGHTNESS, GSAVERAGE, GSLUMINOSITY} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown grayscale algorithm: %s", s)
+}
+
+func (gs *grayscale) Apply(img *Image, numRoutines int) (*Image, error) {
+	return gs.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (gs *grayscale) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	numRoutines = routines(numRoutines)
 
 	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
 		var r, g, b uint8 = inPix[offset], inPix[offset+1], inPix[offset+2]
 		switch gs.algo {
 		case GSLIGHTNESS:
 			max := math.Max(math.Max(float64(r), float64(g)), float64(b))
-			min := math.Max(math.Min(float64(r), float64(g)), float64(b))
-			r = uint8(max + min/2)
+			min := math.Min(math.Min(float64(r), float64(g)), float64(b))
+			r = uint8((max + min) / 2)
 			g = r
 			b = r
 		case GSAVERAGE:
-			r = (r + g + b) / 3
+			r = uint8((int(r) + int(g) + int(b)) / 3)
 			g = r
 			b = r
 		case GSLUMINOSITY:
-			r = uint8(0.21*float64(r) + 0.72*float64(g) + 0.07*float64(b))
+			r = uint8(luminosity(r, g, b))
 			g = r
 			b = r
 		}
 		outPix[offset] = r
 		outPix[offset+1] = g
 		outPix[offset+2] = b
-		outPix[offset+3] = 255
+		// Each algorithm is a weighted average, so the premultiplied gray is never larger than alpha
+		outPix[offset+3] = inPix[offset+3]
 	}
 
 	out := &Image{
@@ -68,12 +112,23 @@ func (gs *grayscale) Apply(img *Image, numRoutines int) (*Image, error) {
 		},
 	}
 
-	runParallel(numRoutines, img, out.Bounds, out, pf, 0)
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
+// luminosity returns a weighted average of r,g,b based on how the human eye perceives colors
+func luminosity(r, g, b uint8) float64 {
+	return 0.21*float64(r) + 0.72*float64(g) + 0.07*float64(b)
+}
+
 // NewGrayscale renders the input image as a grayscale image. numRoutines specifies how many
 // goroutines should be used to process the image in parallel, use 0 to let the library decide
 func NewGrayscale(algo GSAlgo) Effect {
 	return &grayscale{algo: algo}
 }
+
+func (gs *grayscale) Spec() EffectSpec {
+	return EffectSpec{Effect: "grayscale", Params: Params{"algo": gs.algo.String()}}
+}
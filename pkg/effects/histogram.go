@@ -0,0 +1,115 @@
+package effects
+
+import (
+	"context"
+)
+
+// HistogramChannel is the number of pixels with each value, from 0 to 255, in one channel
+type HistogramChannel [256]int
+
+// Histogram is the tonal distribution of an image, the number of pixels with each value of red,
+// green, blue and luminance. The values are not premultiplied by alpha and fully transparent
+// pixels are not counted, since they have no color
+type Histogram struct {
+	Red       HistogramChannel
+	Green     HistogramChannel
+	Blue      HistogramChannel
+	Luminance HistogramChannel
+
+	// Count is the number of pixels counted
+	Count int
+}
+
+// NewHistogram returns the histogram of the pixels inside the Bounds of img, counted in parallel
+// by numRoutines goroutines. If numRoutines is 0 the number of CPUs is used
+func NewHistogram(img *Image, numRoutines int) *Histogram {
+	return NewHistogramRect(img, img.Bounds, numRoutines)
+}
+
+// NewHistogramRect returns the histogram of the pixels inside r, which is clipped to the Bounds
+// of img
+func NewHistogramRect(img *Image, r Rect, numRoutines int) *Histogram {
+	h, _ := computeHistogram(context.Background(), img, r, numRoutines)
+	return h
+}
+
+// computeHistogram counts the pixels inside r, each goroutine has its own histogram which are
+// added together at the end, so no locking is needed
+func computeHistogram(ctx context.Context, img *Image, r Rect, numRoutines int) (*Histogram, error) {
+	numRoutines = routines(numRoutines)
+
+	partials := make([]Histogram, numRoutines)
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		a := inPix[offset+3]
+		if a == 0 {
+			return
+		}
+		r, g, b := inPix[offset], inPix[offset+1], inPix[offset+2]
+		if a != 255 {
+			r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+		}
+		h := &partials[ri]
+		h.Red[r]++
+		h.Green[g]++
+		h.Blue[b]++
+		h.Luminance[clampUint8(luminosity(r, g, b))]++
+		h.Count++
+	}
+	if err := runParallel(ctx, numRoutines, img, r.Intersect(img.Bounds), img, pf, 0); err != nil {
+		return nil, err
+	}
+
+	h := &Histogram{}
+	for i := range partials {
+		p := &partials[i]
+		for v := 0; v < 256; v++ {
+			h.Red[v] += p.Red[v]
+			h.Green[v] += p.Green[v]
+			h.Blue[v] += p.Blue[v]
+			h.Luminance[v] += p.Luminance[v]
+		}
+		h.Count += p.Count
+	}
+	return h, nil
+}
+
+// Total returns the number of pixels counted in the channel
+func (c *HistogramChannel) Total() int {
+	total := 0
+	for _, n := range c {
+		total += n
+	}
+	return total
+}
+
+// Mean returns the average value of the channel, 0 if no pixels were counted
+func (c *HistogramChannel) Mean() float64 {
+	total, sum := 0, 0
+	for v, n := range c {
+		total += n
+		sum += v * n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(sum) / float64(total)
+}
+
+// Percentile returns the smallest value that at least p percent of the pixels are less than or
+// equal to, p is between 0 and 100. Percentile(50) is the median and Percentile(100) the largest
+// value in the channel
+func (c *HistogramChannel) Percentile(p float64) int {
+	total := c.Total()
+	if total == 0 {
+		return 0
+	}
+	target := p / 100 * float64(total)
+	cumulative := 0
+	for v, n := range c {
+		cumulative += n
+		if n > 0 && float64(cumulative) >= target {
+			return v
+		}
+	}
+	return 255
+}
@@ -0,0 +1,162 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+type hueSaturation struct {
+	hue        float64
+	saturation float64
+	lightness  float64
+}
+
+type vibrance struct {
+	amount float64
+}
+
+type colorize struct {
+	hue        float64
+	saturation float64
+	amount     float64
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "hueSaturation",
+		Description: "Rotates the hue and scales the saturation and lightness of each pixel",
+		Params: []ParamInfo{
+			{Name: "hue", Description: "degrees the hue is rotated by", Type: ParamFloat, Default: 0.0, Min: -180, Max: 180},
+			{Name: "saturation", Description: "saturation multiplier, 1 leaves the saturation unchanged and 0 makes the image gray", Type: ParamFloat, Default: 1.0, Min: 0, Max: 10},
+			{Name: "lightness", Description: "positive values lighten towards white, negative darken towards black", Type: ParamFloat, Default: 0.0, Min: -1, Max: 1},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewHueSaturation(p.Float("hue"), p.Float("saturation"), p.Float("lightness")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "vibrance",
+		Description: "Boosts the saturation of muted colors more than colors that are already saturated",
+		Params: []ParamInfo{
+			{Name: "amount", Description: "how much to boost the saturation, negative values mute the colors", Type: ParamFloat, Default: 0.5, Min: -1, Max: 1},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewVibrance(p.Float("amount")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "colorize",
+		Description: "Tints the image with a single hue, keeping the lightness of each pixel",
+		Params: []ParamInfo{
+			{Name: "hue", Description: "hue of the tint in degrees", Type: ParamFloat, Default: 30.0, Min: 0, Max: 360},
+			{Name: "saturation", Description: "saturation of the tint", Type: ParamFloat, Default: 0.5, Min: 0, Max: 1},
+			{Name: "amount", Description: "how much of the tint is blended with the original colors", Type: ParamFloat, Default: 1.0, Min: 0, Max: 1},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewColorize(p.Float("hue"), p.Float("saturation"), p.Float("amount")), nil
+		},
+	})
+}
+
+// NewHueSaturation returns an effect that adjusts the color of each pixel in the HSL color space.
+// The hue is rotated by hue degrees and the saturation is multiplied by saturation, so 1 leaves it
+// unchanged and 0 removes all color. lightness is between -1 and 1, positive values blend each
+// pixel towards white and negative values towards black
+func NewHueSaturation(hue, saturation, lightness float64) Effect {
+	return &hueSaturation{hue: hue, saturation: saturation, lightness: lightness}
+}
+
+func (hs *hueSaturation) Apply(img *Image, numRoutines int) (*Image, error) {
+	return hs.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (hs *hueSaturation) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if hs.saturation < 0 {
+		return nil, fmt.Errorf("saturation must not be negative, got: %v", hs.saturation)
+	}
+	if hs.lightness < -1 || hs.lightness > 1 {
+		return nil, fmt.Errorf("lightness must be between -1 and 1, got: %v", hs.lightness)
+	}
+
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		h, s, l := RGBToHSL(r, g, b)
+		if hs.lightness < 0 {
+			l *= 1 + hs.lightness
+		} else {
+			l += (1 - l) * hs.lightness
+		}
+		return HSLToRGB(h+hs.hue, s*hs.saturation, l)
+	})
+}
+
+func (hs *hueSaturation) Spec() EffectSpec {
+	return EffectSpec{Effect: "hueSaturation", Params: Params{
+		"hue":        hs.hue,
+		"saturation": hs.saturation,
+		"lightness":  hs.lightness,
+	}}
+}
+
+// NewVibrance returns an effect that increases the saturation of muted colors more than colors
+// that are already saturated, and leaves grays unchanged, so it brings out the color in an image
+// without making skin tones and bright colors look unnatural. amount is between -1 and 1,
+// negative values reduce the saturation
+func NewVibrance(amount float64) Effect {
+	return &vibrance{amount: amount}
+}
+
+func (v *vibrance) Apply(img *Image, numRoutines int) (*Image, error) {
+	return v.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (v *vibrance) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if v.amount < -1 || v.amount > 1 {
+		return nil, fmt.Errorf("vibrance amount must be between -1 and 1, got: %v", v.amount)
+	}
+
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		h, s, l := RGBToHSL(r, g, b)
+		return HSLToRGB(h, s+v.amount*s*(1-s), l)
+	})
+}
+
+func (v *vibrance) Spec() EffectSpec {
+	return EffectSpec{Effect: "vibrance", Params: Params{"amount": v.amount}}
+}
+
+// NewColorize returns an effect that gives every pixel the same hue, in degrees, and saturation,
+// between 0 and 1, keeping its lightness, like a photo printed with a single colored ink. amount
+// between 0 and 1 blends the colorized pixel with the original, 1 is fully colorized
+func NewColorize(hue, saturation, amount float64) Effect {
+	return &colorize{hue: hue, saturation: saturation, amount: amount}
+}
+
+func (c *colorize) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *colorize) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if c.amount < 0 || c.amount > 1 {
+		return nil, fmt.Errorf("colorize amount must be between 0 and 1, got: %v", c.amount)
+	}
+
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		_, _, l := RGBToHSL(r, g, b)
+		cr, cg, cb := HSLToRGB(c.hue, c.saturation, l)
+		return blend(r, cr, c.amount), blend(g, cg, c.amount), blend(b, cb, c.amount)
+	})
+}
+
+func (c *colorize) Spec() EffectSpec {
+	return EffectSpec{Effect: "colorize", Params: Params{
+		"hue":        c.hue,
+		"saturation": c.saturation,
+		"amount":     c.amount,
+	}}
+}
+
+// blend returns the value amount of the way from a to b
+func blend(a, b uint8, amount float64) uint8 {
+	return uint8(math.Round(float64(a) + (float64(b)-float64(a))*amount))
+}
@@ -1,17 +1,28 @@
 package effects
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"os"
 	"path"
 	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+
+	// Registers the webp decoder, webp images can be loaded but not saved
+	_ "golang.org/x/image/webp"
 )
 
-// Image wrapper around internal pixels
+// Image wrapper around internal pixels. Use FromImage and ToRGBA to convert to and
+// from the standard library image types
 type Image struct {
 	img    *image.RGBA
 	Bounds Rect
@@ -19,114 +30,325 @@ type Image struct {
 	Height int
 }
 
+// Format is an image file format that an Image can be encoded as
+type Format string
+
+const (
+	// FormatJPEG encodes the image as a JPEG
+	FormatJPEG Format = "jpeg"
+
+	// FormatPNG encodes the image as a PNG
+	FormatPNG Format = "png"
+
+	// FormatGIF encodes the image as a GIF, reducing it to at most 256 colors
+	FormatGIF Format = "gif"
+
+	// FormatBMP encodes the image as a BMP
+	FormatBMP Format = "bmp"
+
+	// FormatTIFF encodes the image as a TIFF
+	FormatTIFF Format = "tiff"
+
+	// FormatWebP is a WebP image, WebP images can be decoded but not encoded
+	FormatWebP Format = "webp"
+)
+
+// newImage returns a new, empty image of the specified size whose Bounds cover the entire image
+func newImage(width, height int) *Image {
+	return &Image{
+		img:    image.NewRGBA(image.Rect(0, 0, width, height)),
+		Width:  width,
+		Height: height,
+		Bounds: Rect{X: 0, Y: 0, Width: width, Height: height},
+	}
+}
+
+// FormatFromPath returns the format matching the extension of the path e.g. .jpg or .png
+func FormatFromPath(p string) (Format, error) {
+	ext := path.Ext(p)
+	format, err := ParseFormat(strings.TrimPrefix(ext, "."))
+	if err != nil {
+		return "", fmt.Errorf("unsupported file type: %s", ext)
+	}
+	return format, nil
+}
+
+// ParseFormat returns the format with the specified name or file extension, e.g. jpeg, jpg or png
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jpg", "jpeg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "gif":
+		return FormatGIF, nil
+	case "bmp":
+		return FormatBMP, nil
+	case "tif", "tiff":
+		return FormatTIFF, nil
+	case "webp":
+		return FormatWebP, nil
+	default:
+		return "", fmt.Errorf("unsupported format: %s", name)
+	}
+}
+
+// CanEncode returns true if images can be encoded in the format, every format that can be
+// decoded can be encoded except webp
+func (f Format) CanEncode() bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatBMP, FormatTIFF:
+		return true
+	default:
+		return false
+	}
+}
+
 // SaveOpts specifies some save parameters that can be specified when saving
 // an image
 type SaveOpts struct {
+	// Format if specified is used by Save instead of the format matching the file extension
+	Format Format
+
 	// JPEGCompression a value between 1 and 100, if 0 specified, defaults to 95.
 	// Higher values are better quality. Only applicable if the file ends with a
 	// .jpg or .jpeg extension
 	JPEGCompression int
 
+	// PNGCompression is the compression level used for PNG images, the zero value is
+	// png.DefaultCompression
+	PNGCompression png.CompressionLevel
+
+	// GIFNumColors is the maximum number of colors in a GIF image, between 1 and 256. If 0
+	// specified, defaults to 256. If the image has transparent pixels one of the colors is
+	// used for transparency
+	GIFNumColors int
+
+	// GIFQuantizer builds the palette of a GIF image, if nil the palette.Plan9 palette is used.
+	// Use a Quantizer for a palette built from the colors of the image
+	GIFQuantizer draw.Quantizer
+
+	// GIFDrawer converts the image to the GIF palette, if nil draw.FloydSteinberg is used
+	GIFDrawer draw.Drawer
+
+	// TIFFCompression is the compression used for TIFF images, the zero value is uncompressed
+	TIFFCompression tiff.CompressionType
+
+	// Metadata if not nil is written to JPEG images, it is usually returned from
+	// LoadImageWithMetadata. Other formats ignore it
+	Metadata *Metadata
+
 	// ClipToBounds if true only the image inside the region specified by the bounds is
 	// saved. Sometimes aftere running an image effect you may have outer bands that are
 	// dead pixels, setting this to true crops them out.
 	ClipToBounds bool
 }
 
-// Save saves the image as the file type defined by the extension in the path e.g. ,jpg or .png
+// Save saves the image as the file type defined by the extension in the path e.g. .jpg or .png,
+// or as opts.Format if it is set
 func (i *Image) Save(outPath string, opts SaveOpts) error {
-	ext := strings.ToLower(path.Ext(outPath))
-
-	final := i
-	if opts.ClipToBounds {
-		final = &Image{
-			img: image.NewRGBA(image.Rectangle{
-				Min: image.Point{X: 0, Y: 0},
-				Max: image.Point{X: i.Bounds.Width, Y: i.Bounds.Height},
-			}),
-			Width:  i.Bounds.Width,
-			Height: i.Bounds.Height,
-			Bounds: Rect{X: 0, Y: 0, Width: i.Bounds.Width, Height: i.Bounds.Height},
+	format := opts.Format
+	if format == "" {
+		var err error
+		format, err = FormatFromPath(outPath)
+		if err != nil {
+			return err
 		}
+	}
+
+	toImg, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %s, %s", outPath, err)
+	}
+	err = i.Encode(toImg, format, opts)
+	if err != nil {
+		toImg.Close()
+		return fmt.Errorf("%s, %s", err, outPath)
+	}
+	err = toImg.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close image: %s, %s", outPath, err)
+	}
+	return nil
+}
 
-		draw.Draw(final.img, final.Bounds.ToImageRect(), i.img, i.Bounds.ToImageRect().Min, draw.Src)
+// Encode writes the image to w in the specified format
+func (i *Image) Encode(w io.Writer, format Format, opts SaveOpts) error {
+	final := i.img
+	if opts.ClipToBounds {
+		final = i.ToRGBA()
 	}
 
-	switch path.Ext(outPath) {
-	case ".jpg", ".jpeg":
+	var err error
+	switch format {
+	case FormatJPEG:
 		cmpLvl := opts.JPEGCompression
 		if cmpLvl == 0 {
 			cmpLvl = 95
 		}
-		return final.saveAsJPG(outPath, cmpLvl)
-	case ".png":
-		return final.saveAsPNG(outPath)
+		if opts.Metadata == nil {
+			err = jpeg.Encode(w, final, &jpeg.Options{Quality: cmpLvl})
+			break
+		}
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, final, &jpeg.Options{Quality: cmpLvl}); err == nil {
+			err = writeMetadata(w, buf.Bytes(), opts.Metadata)
+		}
+	case FormatPNG:
+		encoder := png.Encoder{CompressionLevel: opts.PNGCompression}
+		err = encoder.Encode(w, final)
+	case FormatGIF:
+		err = encodeGIF(w, final, opts)
+	case FormatBMP:
+		err = bmp.Encode(w, final)
+	case FormatTIFF:
+		err = tiff.Encode(w, final, &tiff.Options{Compression: opts.TIFFCompression})
+	case FormatWebP:
+		return fmt.Errorf("encoding webp images is not supported")
 	default:
-		return fmt.Errorf("unsupported file type: %s", ext)
+		return fmt.Errorf("unsupported format: %s", format)
 	}
+	if err != nil {
+		return fmt.Errorf("failed to encode image: %s", err)
+	}
+	return nil
 }
 
-// saveAsJPG saves the image as a JPG. quality is between 1 and 100, 100 being best
-func (i *Image) saveAsJPG(path string, quality int) error {
-	toImg, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create image: %s, %s", path, err)
+// encodeGIF writes img to w as a GIF. Pixels that are more than half transparent are saved as
+// transparent, using the same palettes as the frames of an Animation
+func encodeGIF(w io.Writer, img *image.RGBA, opts SaveOpts) error {
+	numColors := opts.GIFNumColors
+	if numColors == 0 {
+		numColors = 256
 	}
-	err = jpeg.Encode(toImg, i.img, &jpeg.Options{Quality: quality})
-	if err != nil {
-		return fmt.Errorf("failed to encode image: %s, %s", path, err)
+	if numColors < 1 || numColors > 256 {
+		return fmt.Errorf("GIFNumColors must be between 1 and 256, got: %d", numColors)
 	}
-	err = toImg.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close image: %s, %s", path, err)
+	drawer := opts.GIFDrawer
+	if drawer == nil {
+		drawer = draw.FloydSteinberg
 	}
 
-	return nil
+	pal := gifPalette(img, hasTransparency(img), numColors, opts.GIFQuantizer)
+	return gif.Encode(w, toPaletted(img, pal, drawer), nil)
+}
+
+// LoadImage loads the specified image from disk. Supported file types are jpg, png, gif, bmp,
+// tiff and webp. Only the first frame of an animated gif is loaded. JPEG images are turned
+// upright to match their EXIF orientation
+func LoadImage(path string) (*Image, error) {
+	img, _, err := LoadImageWithMetadata(path, LoadOpts{})
+	return img, err
 }
 
-// saveAsPNG saves the image as a PNG
-func (i *Image) saveAsPNG(path string) error {
-	toImg, err := os.Create(path)
+// LoadImageWithMetadata is the same as LoadImage but also returns the metadata of the image, which
+// can be passed to Save in SaveOpts.Metadata to keep it
+func LoadImageWithMetadata(path string, opts LoadOpts) (*Image, *Metadata, error) {
+	srcReader, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to create image: %s, %s", path, err)
+		return nil, nil, fmt.Errorf("failed to read input image: %s, %s", path, err)
 	}
 
-	err = png.Encode(toImg, i.img)
+	img, md, err := DecodeWithMetadata(srcReader, opts)
 	if err != nil {
-		return fmt.Errorf("failed to encode image: %s, %s", path, err)
+		srcReader.Close()
+		return nil, nil, fmt.Errorf("%s, %s", err, path)
 	}
-	err = toImg.Close()
+	err = srcReader.Close()
 	if err != nil {
-		return fmt.Errorf("failed to close image: %s, %s", path, err)
+		return nil, nil, fmt.Errorf("failed to close image on load: %s, %s", path, err)
 	}
-	return nil
+	return img, md, nil
 }
 
-// LoadImage loads the specified image from disk. Supported file types are png and jpg
-func LoadImage(path string) (*Image, error) {
-	srcReader, err := os.Open(path)
+// Decode reads an image from r. Supported formats are jpg, png, gif, bmp, tiff and webp. JPEG
+// images are turned upright to match their EXIF orientation
+func Decode(r io.Reader) (*Image, error) {
+	img, _, err := DecodeWithMetadata(r, LoadOpts{})
+	return img, err
+}
+
+// DecodeWithMetadata is the same as Decode but also returns the metadata of the image
+func DecodeWithMetadata(r io.Reader, opts LoadOpts) (*Image, *Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read image on load: %s", err)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read input image: %s, %s", path, err)
+		return nil, nil, fmt.Errorf("failed to decode image on load: %s", err)
+	}
+
+	img := FromImage(src)
+	md := readMetadata(data)
+	if opts.IgnoreOrientation {
+		return img, md, nil
 	}
 
-	img, _, err := image.Decode(srcReader)
+	if e := orientationEffect(md.Orientation); e != nil {
+		if img, err = e.Apply(img, 0); err != nil {
+			return nil, nil, fmt.Errorf("failed to apply orientation on load: %s", err)
+		}
+		resetOrientation(md.EXIF)
+	}
+	return img, md, nil
+}
+
+// DecodeConfig returns the dimensions and format name of the image in r without decoding all of
+// its pixels. The dimensions are those of the image returned by Decode, so they are swapped for
+// JPEG images whose EXIF orientation turns them on their side
+func DecodeConfig(r io.Reader) (image.Config, string, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image on load: %s, %s", path, err)
+		return image.Config{}, "", fmt.Errorf("failed to read image on load: %s", err)
 	}
-	err = srcReader.Close()
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("failed to close image on load: %s, %s", path, err)
+		return image.Config{}, "", fmt.Errorf("failed to decode image on load: %s", err)
 	}
+	if o := readMetadata(data).Orientation; o >= 5 && o <= 8 {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	return cfg, format, nil
+}
 
-	outImg := image.NewRGBA(img.Bounds())
-	draw.Draw(outImg, img.Bounds(), img, image.Point{}, draw.Over)
+// FromImage returns a new Image containing a copy of the pixels in img. The returned
+// image has its origin at 0,0 and its Bounds cover the entire image
+func FromImage(img image.Image) *Image {
+	b := img.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+	outImg := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(outImg, outImg.Bounds(), img, b.Min, draw.Src)
 
-	w := img.Bounds().Max.X
-	h := img.Bounds().Max.Y
 	return &Image{
 		img:    outImg,
 		Width:  w,
 		Height: h,
 		Bounds: Rect{X: 0, Y: 0, Width: w, Height: h},
-	}, nil
+	}
+}
+
+// ToRGBA returns a copy of the pixels inside the image Bounds as an *image.RGBA, whose
+// origin is at 0,0. The result can be passed to any code that accepts an image.Image
+func (i *Image) ToRGBA() *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, i.Bounds.Width, i.Bounds.Height))
+	draw.Draw(out, out.Bounds(), i.img, i.Bounds.ToImageRect().Min, draw.Src)
+	return out
+}
+
+// SubImage returns a new Image containing a copy of the pixels inside r. r is
+// clipped to the image Bounds, the returned image has its origin at 0,0
+func (i *Image) SubImage(r Rect) *Image {
+	return FromImage(i.img.SubImage(r.Intersect(i.Bounds).ToImageRect()))
+}
+
+// RGBAAt returns the color of the pixel at x,y
+func (i *Image) RGBAAt(x, y int) color.RGBA {
+	return i.img.RGBAAt(x, y)
+}
+
+// SetRGBA sets the color of the pixel at x,y
+func (i *Image) SetRGBA(x, y int, c color.RGBA) {
+	i.img.SetRGBA(x, y, c)
 }
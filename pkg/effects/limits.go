@@ -0,0 +1,46 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+)
+
+type maxSizeKey struct{}
+
+// maxSize is the largest image effects are allowed to create
+type maxSize struct {
+	width  int
+	height int
+}
+
+// SizeError is returned by effects that would create an image larger than the maximum size set
+// with WithMaxSize
+type SizeError struct {
+	Width     int
+	Height    int
+	MaxWidth  int
+	MaxHeight int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("output image would be %dx%d, the maximum is %dx%d", e.Width, e.Height, e.MaxWidth, e.MaxHeight)
+}
+
+// WithMaxSize returns a copy of ctx that limits the size of the images created by effects run
+// with it via ApplyContext or RunContext. Effects that change the size of the image, such as
+// resize and rotate, return a *SizeError instead of allocating an image wider than width or
+// taller than height. Use it to bound the memory used when the effects or their params come from
+// untrusted input, since a few bytes of params can ask for a very large image
+func WithMaxSize(ctx context.Context, width, height int) context.Context {
+	return context.WithValue(ctx, maxSizeKey{}, maxSize{width: width, height: height})
+}
+
+// checkSize returns a *SizeError if a width x height image is larger than the maximum size in
+// ctx, it is called before allocating an image whose size comes from an effect's params
+func checkSize(ctx context.Context, width, height int) error {
+	m, ok := ctx.Value(maxSizeKey{}).(maxSize)
+	if !ok || (width <= m.width && height <= m.height) {
+		return nil
+	}
+	return &SizeError{Width: width, Height: height, MaxWidth: m.width, MaxHeight: m.height}
+}
@@ -0,0 +1,250 @@
+package effects
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Metadata is the basic metadata read from a JPEG file, it can be written back out when saving
+// by setting SaveOpts.Metadata
+type Metadata struct {
+	// Orientation is the EXIF orientation of the file as it was loaded, a value between 1 and 8.
+	// 1 means the pixels are stored upright, it is also used when the file has no orientation
+	Orientation int
+
+	// EXIF is the raw EXIF data, starting with the TIFF header. If the orientation was applied
+	// to the pixels when loading, the orientation stored in EXIF has been reset to 1
+	EXIF []byte
+
+	// ICCProfile is the embedded ICC color profile, nil if the file does not have one
+	ICCProfile []byte
+}
+
+// LoadOpts specifies options used when loading an image
+type LoadOpts struct {
+	// IgnoreOrientation if true the pixels are returned as they are stored in the file. By
+	// default images are rotated and flipped to match their EXIF orientation, so that photos
+	// taken with a phone on its side are upright
+	IgnoreOrientation bool
+}
+
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+
+	tagOrientation = 0x0112
+
+	// maxSegmentData is the largest payload a JPEG marker segment can hold, the 2 byte length
+	// field includes itself
+	maxSegmentData = 0xffff - 2
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// readMetadata reads the EXIF and ICC profile from the marker segments at the start of a JPEG.
+// Files that are not JPEGs, or are malformed, return empty metadata rather than an error, so
+// they can still be decoded by the image decoders
+func readMetadata(data []byte) *Metadata {
+	md := &Metadata{Orientation: 1}
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return md
+	}
+
+	var iccChunks [][]byte
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// Markers without a length
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifHeader) && md.EXIF == nil:
+			md.EXIF = append([]byte{}, payload[len(exifHeader):]...)
+		case marker == markerAPP2 && bytes.HasPrefix(payload, iccHeader) && len(payload) > len(iccHeader)+2:
+			// Profiles larger than a segment are split in to chunks, numbered from 1
+			seq := int(payload[len(iccHeader)])
+			count := int(payload[len(iccHeader)+1])
+			if len(iccChunks) == 0 && count > 0 {
+				iccChunks = make([][]byte, count)
+			}
+			if seq >= 1 && seq <= len(iccChunks) {
+				iccChunks[seq-1] = payload[len(iccHeader)+2:]
+			}
+		}
+		pos += 2 + length
+	}
+
+	for _, chunk := range iccChunks {
+		if chunk == nil {
+			// Missing chunks make the profile unusable
+			md.ICCProfile = nil
+			break
+		}
+		md.ICCProfile = append(md.ICCProfile, chunk...)
+	}
+
+	if md.EXIF != nil {
+		if o, ok := exifOrientation(md.EXIF); ok && o >= 1 && o <= 8 {
+			md.Orientation = o
+		}
+	}
+	return md
+}
+
+// exifOrientationOffset returns the byte order of the EXIF data and the offset of the value of
+// the orientation tag in IFD0
+func exifOrientationOffset(exif []byte) (binary.ByteOrder, int, bool) {
+	if len(exif) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	if order.Uint16(exif[2:]) != 42 {
+		return nil, 0, false
+	}
+
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return nil, 0, false
+	}
+	entries := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[entry:]) != tagOrientation {
+			continue
+		}
+		// Orientation is a single SHORT, stored in the first 2 bytes of the value field
+		if order.Uint16(exif[entry+2:]) != 3 {
+			return nil, 0, false
+		}
+		return order, entry + 8, true
+	}
+	return nil, 0, false
+}
+
+func exifOrientation(exif []byte) (int, bool) {
+	order, offset, ok := exifOrientationOffset(exif)
+	if !ok {
+		return 0, false
+	}
+	return int(order.Uint16(exif[offset:])), true
+}
+
+// resetOrientation sets the orientation in the EXIF data to 1, if it has an orientation
+func resetOrientation(exif []byte) {
+	if order, offset, ok := exifOrientationOffset(exif); ok {
+		order.PutUint16(exif[offset:], 1)
+	}
+}
+
+// orientationEffect returns the effect that turns an image with the EXIF orientation upright,
+// nil if the image is already upright
+func orientationEffect(orientation int) Effect {
+	p := &Pipeline{}
+	switch orientation {
+	case 2:
+		p.Add(NewFlipH(), nil)
+	case 3:
+		p.Add(NewRotate180(), nil)
+	case 4:
+		p.Add(NewFlipV(), nil)
+	case 5:
+		// Transpose, mirrored along the top left to bottom right diagonal
+		p.Add(NewRotate90(), nil)
+		p.Add(NewFlipH(), nil)
+	case 6:
+		p.Add(NewRotate90(), nil)
+	case 7:
+		// Transverse, mirrored along the top right to bottom left diagonal
+		p.Add(NewRotate90(), nil)
+		p.Add(NewFlipV(), nil)
+	case 8:
+		p.Add(NewRotate270(), nil)
+	default:
+		return nil
+	}
+	return p
+}
+
+// writeMetadata writes the JPEG in data to w, with the EXIF and ICC profile in md inserted
+// after the start of image marker
+func writeMetadata(w io.Writer, data []byte, md *Metadata) error {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return fmt.Errorf("failed to write metadata: not a jpeg")
+	}
+
+	var segments bytes.Buffer
+	if len(md.EXIF) > 0 && len(exifHeader)+len(md.EXIF) <= maxSegmentData {
+		exif := append(append([]byte{}, exifHeader...), md.EXIF...)
+		writeSegment(&segments, markerAPP1, exif)
+	}
+	if len(md.ICCProfile) > 0 {
+		chunkSize := maxSegmentData - len(iccHeader) - 2
+		count := (len(md.ICCProfile) + chunkSize - 1) / chunkSize
+		if count <= 255 {
+			for i := 0; i < count; i++ {
+				end := (i + 1) * chunkSize
+				if end > len(md.ICCProfile) {
+					end = len(md.ICCProfile)
+				}
+				chunk := append(append([]byte{}, iccHeader...), byte(i+1), byte(count))
+				chunk = append(chunk, md.ICCProfile[i*chunkSize:end]...)
+				writeSegment(&segments, markerAPP2, chunk)
+			}
+		}
+	}
+
+	if _, err := w.Write(data[:2]); err != nil {
+		return err
+	}
+	if _, err := segments.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := w.Write(data[2:])
+	return err
+}
+
+func writeSegment(buf *bytes.Buffer, marker byte, payload []byte) {
+	buf.Write([]byte{0xff, marker})
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(payload)+2))
+	buf.Write(length[:])
+	buf.Write(payload)
+}
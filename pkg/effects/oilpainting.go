@@ -1,8 +1,8 @@
 package effects
 
 import (
+	"context"
 	"image"
-	"runtime"
 )
 
 type oilPainting struct {
@@ -10,24 +10,42 @@ type oilPainting struct {
 	levels     int
 }
 
+func init() {
+	Register(EffectInfo{
+		Name:        "oil",
+		Description: "Makes the image look like an oil painting",
+		Params: []ParamInfo{
+			{Name: "filterSize", Description: "size of the neighbourhood each pixel is painted from", Type: ParamInt, Default: 5, Min: 3, Max: 101},
+			{Name: "levels", Description: "number of intensity levels", Type: ParamInt, Default: 30, Min: 1, Max: 256},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewOilPainting(p.Int("filterSize"), p.Int("levels")), nil
+		},
+	})
+}
+
 func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
+	return op.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (op *oilPainting) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
 	levels := op.levels - 1
 	filterOffset := (op.filterSize - 1) / 2
 
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	numRoutines = routines(numRoutines)
 
-	var iBin, rBin, gBin, bBin [][]int
+	var iBin, rBin, gBin, bBin, aBin [][]int
 	iBin = make([][]int, numRoutines)
 	rBin = make([][]int, numRoutines)
 	gBin = make([][]int, numRoutines)
 	bBin = make([][]int, numRoutines)
+	aBin = make([][]int, numRoutines)
 	for ri := 0; ri < numRoutines; ri++ {
 		iBin[ri] = make([]int, levels+1)
 		rBin[ri] = make([]int, levels+1)
 		gBin[ri] = make([]int, levels+1)
 		bBin[ri] = make([]int, levels+1)
+		aBin[ri] = make([]int, levels+1)
 	}
 
 	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
@@ -35,6 +53,7 @@ func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
 		reset(rBin[ri])
 		reset(gBin[ri])
 		reset(bBin[ri])
+		reset(aBin[ri])
 
 		var maxIntensity int
 		var maxIndex int
@@ -45,11 +64,13 @@ func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
 				r := inPix[fOffset]
 				g := inPix[fOffset+1]
 				b := inPix[fOffset+2]
-				ci := int(roundToInt32((float64(r+g+b) / 3.0 * float64(levels)) / 255.0))
+				a := inPix[fOffset+3]
+				ci := int(roundToInt32(((float64(r) + float64(g) + float64(b)) / 3.0 * float64(levels)) / 255.0))
 				iBin[ri][ci]++
 				rBin[ri][ci] += int(r)
 				gBin[ri][ci] += int(g)
 				bBin[ri][ci] += int(b)
+				aBin[ri][ci] += int(a)
 
 				if iBin[ri][ci] > maxIntensity {
 					maxIntensity = iBin[ri][ci]
@@ -61,7 +82,8 @@ func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
 		outPix[offset] = uint8(rBin[ri][maxIndex] / maxIntensity)
 		outPix[offset+1] = uint8(gBin[ri][maxIndex] / maxIntensity)
 		outPix[offset+2] = uint8(bBin[ri][maxIndex] / maxIntensity)
-		outPix[offset+3] = 255
+		// Averaging the premultiplied colors with their alpha keeps transparent areas transparent
+		outPix[offset+3] = uint8(aBin[ri][maxIndex] / maxIntensity)
 	}
 
 	out := &Image{
@@ -78,10 +100,16 @@ func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
 			Height: img.Bounds.Height - 2*filterOffset,
 		},
 	}
-	runParallel(numRoutines, img, out.Bounds, out, pf, 0)
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
+func (op *oilPainting) kernelRadius() int {
+	return (op.filterSize - 1) / 2
+}
+
 // NewOilPainting renders the input image as if it was painted like an oil painting. numRoutines specifies how many
 // goroutines should be used to process the image in parallel, use 0 to let the library decide. filterSize specifies
 // how bold the image should look, larger numbers equate to larger strokes, levels specifies how many buckets colors
@@ -89,3 +117,7 @@ func (op *oilPainting) Apply(img *Image, numRoutines int) (*Image, error) {
 func NewOilPainting(filterSize, levels int) Effect {
 	return &oilPainting{filterSize: filterSize, levels: levels}
 }
+
+func (op *oilPainting) Spec() EffectSpec {
+	return EffectSpec{Effect: "oil", Params: Params{"filterSize": op.filterSize, "levels": op.levels}}
+}
@@ -1,37 +1,56 @@
 package effects
 
 import (
+	"context"
 	"fmt"
-	"runtime"
 )
 
 type pencil struct {
 	blurFactor int
 }
 
+func init() {
+	Register(EffectInfo{
+		Name:        "pencil",
+		Description: "Makes the image look like a pencil sketch",
+		Params: []ParamInfo{
+			{Name: "blurFactor", Description: "size of the blur applied to the inverted image", Type: ParamInt, Default: 5, Min: 1, Max: 255, Odd: true},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewPencil(p.Int("blurFactor")), nil
+		},
+	})
+}
+
 func (p *pencil) Apply(img *Image, numRoutines int) (*Image, error) {
+	return p.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (p *pencil) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
 	if !isOddInt(p.blurFactor) {
 		return nil, fmt.Errorf("blurFactor must be odd")
 	}
 
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	numRoutines = routines(numRoutines)
 
 	inImg := img
 	if p.blurFactor != 0 {
 		var err error
 		gaussian := NewGaussian(p.blurFactor, 1)
-		inImg, err = gaussian.Apply(img, numRoutines)
+		inImg, err = ApplyContext(subProgress(ctx, 0, 0.5), gaussian, img, numRoutines)
 		if err != nil {
 			return nil, err
 		}
 	}
 	sobel := NewSobel(-1, true)
-	out, err := sobel.Apply(inImg, numRoutines)
+	out, err := ApplyContext(subProgress(ctx, 0.5, 1), sobel, inImg, numRoutines)
 	return out, err
 }
 
+func (p *pencil) kernelRadius() int {
+	return NewGaussian(p.blurFactor, 1).(kernelEffect).kernelRadius() + 1
+}
+
 // NewPencil renders the input image as if it was drawn in pencil. It is simply
 // an inverted Sobel image. You can specify the blurFactor, a value that must
 // be odd, to blur the input image to get rid of the noise. This is the gaussian
@@ -39,3 +58,7 @@ func (p *pencil) Apply(img *Image, numRoutines int) (*Image, error) {
 func NewPencil(blurFactor int) Effect {
 	return &pencil{blurFactor: blurFactor}
 }
+
+func (p *pencil) Spec() EffectSpec {
+	return EffectSpec{Effect: "pencil", Params: Params{"blurFactor": p.blurFactor}}
+}
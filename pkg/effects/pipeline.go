@@ -1,5 +1,7 @@
 package effects
 
+import "context"
+
 // Pipeline allows multiple effects to be composed together easily
 type Pipeline struct {
 	effects []item
@@ -18,12 +20,24 @@ func (p *Pipeline) Add(e Effect, callback func(*Image)) {
 // Run executes all of the effects in the order they were passed to the Add function
 // on the input image and returns the results.
 func (p *Pipeline) Run(img *Image, numRoutines int) (*Image, error) {
+	return p.RunContext(context.Background(), img, numRoutines)
+}
+
+// RunContext is the same as Run but stops and returns ctx.Err() if ctx is cancelled, either
+// while an effect is running or between effects. If ctx was created with WithProgress, the
+// progress of each stage is reported along with the stage name and index
+func (p *Pipeline) RunContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
 	currentImg := img
-	for _, item := range p.effects {
-		outImg, err := item.effect.Apply(currentImg, numRoutines)
+	for i, item := range p.effects {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stageCtx := stageProgress(ctx, stageName(item.effect), i, len(p.effects))
+		outImg, err := ApplyContext(stageCtx, item.effect, currentImg, numRoutines)
 		if err != nil {
 			return nil, err
 		}
+		progressFromContext(stageCtx).report(1)
 		if item.callback != nil {
 			item.callback(outImg)
 		}
@@ -31,3 +45,13 @@ func (p *Pipeline) Run(img *Image, numRoutines int) (*Image, error) {
 	}
 	return currentImg, nil
 }
+
+// Apply runs the pipeline, so that a Pipeline can be used anywhere an Effect can
+func (p *Pipeline) Apply(img *Image, numRoutines int) (*Image, error) {
+	return p.Run(img, numRoutines)
+}
+
+// ApplyContext runs the pipeline with RunContext
+func (p *Pipeline) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	return p.RunContext(ctx, img, numRoutines)
+}
@@ -1,19 +1,34 @@
 package effects
 
 import (
+	"context"
 	"fmt"
 	"image"
-	"runtime"
 )
 
 type pixelate struct {
 	blockSize int
 }
 
+func init() {
+	Register(EffectInfo{
+		Name:        "pixelate",
+		Description: "Replaces blocks of pixels with their average color",
+		Params: []ParamInfo{
+			{Name: "blockSize", Description: "width and height of each block", Type: ParamInt, Default: 10, Min: 1, Max: 4096},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewPixelate(p.Int("blockSize")), nil
+		},
+	})
+}
+
 func (p *pixelate) Apply(img *Image, numRoutines int) (*Image, error) {
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	return p.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (p *pixelate) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	numRoutines = routines(numRoutines)
 
 	if img.Bounds.Width%p.blockSize != 0 ||
 		img.Bounds.Height%p.blockSize != 0 {
@@ -27,30 +42,33 @@ func (p *pixelate) Apply(img *Image, numRoutines int) (*Image, error) {
 	blocksR := make([]int, nBlocks)
 	blocksG := make([]int, nBlocks)
 	blocksB := make([]int, nBlocks)
+	blocksA := make([]int, nBlocks)
 	pixelsPerBlock := p.blockSize * p.blockSize
 
+	// The pixels are premultiplied, so averaging each channel weights the colors by their alpha
+	// and fully transparent pixels don't darken the block
 	pfCalc := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
 		r := inPix[offset]
 		g := inPix[offset+1]
 		b := inPix[offset+2]
+		a := inPix[offset+3]
 
-		blockIndex := (y/p.blockSize)*nBlocksX + (x / p.blockSize)
+		blockIndex := ((y-img.Bounds.Y)/p.blockSize)*nBlocksX + ((x - img.Bounds.X) / p.blockSize)
 		blocksR[blockIndex] += int(r)
 		blocksG[blockIndex] += int(g)
 		blocksB[blockIndex] += int(b)
+		blocksA[blockIndex] += int(a)
 	}
 
 	pfSet := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
-		blockIndex := (y/p.blockSize)*nBlocksX + (x / p.blockSize)
+		blockIndex := ((y-img.Bounds.Y)/p.blockSize)*nBlocksX + ((x - img.Bounds.X) / p.blockSize)
 
 		outPix[offset] = uint8(blocksR[blockIndex])
 		outPix[offset+1] = uint8(blocksG[blockIndex])
 		outPix[offset+2] = uint8(blocksB[blockIndex])
-		outPix[offset+3] = 255
+		outPix[offset+3] = uint8(blocksA[blockIndex])
 	}
 
-	var pixelsPerRoutine int
-
 	out := &Image{
 		img: image.NewRGBA(image.Rectangle{
 			Min: image.Point{X: 0, Y: 0},
@@ -66,18 +84,23 @@ func (p *pixelate) Apply(img *Image, numRoutines int) (*Image, error) {
 		},
 	}
 
-	// Make sure the goroutines process on a block boundary
-	pixelsPerRoutine = ((img.Bounds.Width / numRoutines) / p.blockSize) * p.blockSize
-	runParallel(numRoutines, img, out.Bounds, out, pfCalc, pixelsPerRoutine)
+	// Make sure the tiles contain whole blocks, so a block is only ever summed by a single goroutine
+	tileSize := ((defaultTileSize + p.blockSize - 1) / p.blockSize) * p.blockSize
+	if err := runParallel(subProgress(ctx, 0, 0.5), numRoutines, img, out.Bounds, out, pfCalc, tileSize); err != nil {
+		return nil, err
+	}
 
 	// Divide by number of pixels
 	for i := 0; i < nBlocks; i++ {
 		blocksR[i] /= pixelsPerBlock
 		blocksG[i] /= pixelsPerBlock
 		blocksB[i] /= pixelsPerBlock
+		blocksA[i] /= pixelsPerBlock
 	}
 
-	runParallel(numRoutines, img, out.Bounds, out, pfSet, pixelsPerRoutine)
+	if err := runParallel(subProgress(ctx, 0.5, 1), numRoutines, img, out.Bounds, out, pfSet, tileSize); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
@@ -85,3 +108,7 @@ func (p *pixelate) Apply(img *Image, numRoutines int) (*Image, error) {
 func NewPixelate(blockSize int) Effect {
 	return &pixelate{blockSize: blockSize}
 }
+
+func (p *pixelate) Spec() EffectSpec {
+	return EffectSpec{Effect: "pixelate", Params: Params{"blockSize": p.blockSize}}
+}
@@ -0,0 +1,144 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Progress describes how much of an effect or pipeline has been completed
+type Progress struct {
+	// Fraction is a value between 0 and 1 indicating how much of the work is complete
+	Fraction float64
+
+	// Stage is the name of the pipeline stage that is currently running, empty if the
+	// effect is not being run as part of a Pipeline
+	Stage string
+
+	// StageIndex is the zero based index of the pipeline stage currently running
+	StageIndex int
+
+	// StageCount is the total number of stages in the pipeline, 0 if the effect is not
+	// being run as part of a Pipeline
+	StageCount int
+}
+
+// ProgressFunc is called with progress updates while an effect is running. Calls are
+// serialized, so the function does not need to be safe for concurrent use, but it
+// should return quickly since it blocks the goroutines processing the image
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// progressSink is shared by all of the reporters created from a single WithProgress call,
+// it serializes calls to fn and makes sure reported values never go backwards
+type progressSink struct {
+	mu   sync.Mutex
+	fn   ProgressFunc
+	last float64
+}
+
+// progressReporter maps the 0..1 progress of a single piece of work in to the
+// [start, start+scale] range of the overall progress
+type progressReporter struct {
+	sink  *progressSink
+	stage Progress
+	start float64
+	scale float64
+}
+
+// WithProgress returns a copy of ctx that carries fn. Effects and pipelines run with the
+// returned context via ApplyContext or RunContext report their progress to fn. Progress
+// never goes backwards, so create a new context for each image that is processed
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, &progressReporter{
+		sink:  &progressSink{fn: fn, last: -1},
+		scale: 1,
+	})
+}
+
+func progressFromContext(ctx context.Context) *progressReporter {
+	pr, _ := ctx.Value(progressKey{}).(*progressReporter)
+	return pr
+}
+
+// withoutProgress returns a copy of ctx that does not report progress, used when the caller
+// reports progress itself
+func withoutProgress(ctx context.Context) context.Context {
+	if progressFromContext(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, (*progressReporter)(nil))
+}
+
+// subProgress returns a context whose progress reports are mapped to the start to end
+// range of the progress reporter in ctx. It is used by effects made up of several
+// passes so that the overall progress increases steadily
+func subProgress(ctx context.Context, start, end float64) context.Context {
+	pr := progressFromContext(ctx)
+	if pr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, &progressReporter{
+		sink:  pr.sink,
+		stage: pr.stage,
+		start: pr.start + start*pr.scale,
+		scale: (end - start) * pr.scale,
+	})
+}
+
+// stageProgress returns a context used to run the stage at index of a pipeline
+// containing count stages
+func stageProgress(ctx context.Context, name string, index, count int) context.Context {
+	pr := progressFromContext(ctx)
+	if pr == nil {
+		return ctx
+	}
+
+	stage := pr.stage
+	if stage.StageCount == 0 {
+		// Only the outermost pipeline names stages, nested pipelines are an
+		// implementation detail of the effect being run
+		stage = Progress{Stage: name, StageIndex: index, StageCount: count}
+	}
+	return context.WithValue(ctx, progressKey{}, &progressReporter{
+		sink:  pr.sink,
+		stage: stage,
+		start: pr.start + pr.scale*float64(index)/float64(count),
+		scale: pr.scale / float64(count),
+	})
+}
+
+// report reports that fraction, a value between 0 and 1, of the work is complete
+func (pr *progressReporter) report(fraction float64) {
+	if pr == nil {
+		return
+	}
+
+	p := pr.stage
+	p.Fraction = pr.start + fraction*pr.scale
+
+	s := pr.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Avoid flooding the callback, only report when at least 0.1% more work is done
+	if p.Fraction < s.last+0.001 && fraction < 1 {
+		return
+	}
+	if p.Fraction <= s.last {
+		return
+	}
+	s.last = p.Fraction
+	s.fn(p)
+}
+
+// stageName returns a name for the effect that is used to describe a pipeline stage
+func stageName(e Effect) string {
+	if s, ok := e.(Serializable); ok {
+		return s.Spec().Effect
+	}
+	name := fmt.Sprintf("%T", e)
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,669 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+)
+
+// QuantizeAlgo the algorithm used to choose the colors of a palette
+type QuantizeAlgo int
+
+const (
+	// QuantizeMedianCut repeatedly splits the box of colors with the largest spread in half, it
+	// is fast and gives good results for most images
+	QuantizeMedianCut QuantizeAlgo = iota
+
+	// QuantizeKMeans refines the median cut palette with k-means clustering, so each color is
+	// the average of the pixels closest to it. It is slower but the colors are more accurate
+	QuantizeKMeans
+)
+
+// DitherMode how the error between a pixel and the nearest palette color is spread to
+// neighbouring pixels, which hides banding in smooth gradients
+type DitherMode int
+
+const (
+	// DitherNone replaces each pixel with the nearest palette color
+	DitherNone DitherMode = iota
+
+	// DitherFloydSteinberg spreads the error of each pixel to the pixels to its right and below.
+	// It gives the most accurate colors but each pixel depends on the ones before it, so the
+	// pixels are processed by a single goroutine
+	DitherFloydSteinberg
+
+	// DitherOrdered offsets each pixel by a value from an 8x8 Bayer matrix before finding the
+	// nearest color, which gives a regular cross hatched pattern
+	DitherOrdered
+)
+
+// kMeansIterations is the maximum number of times the k-means clusters are refined, the
+// palette rarely changes noticeably after this many
+const kMeansIterations = 16
+
+// bayer8 is the 8x8 ordered dithering matrix, each value is used once
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// QuantizeOpts options to pass to the quantize effect
+type QuantizeOpts struct {
+	// NumColors is the number of colors in the palette built from the image, between 2 and
+	// 256. If 0 specified, defaults to 16. Ignored if Palette is set
+	NumColors int
+
+	// Algo is the algorithm used to build the palette. Ignored if Palette is set
+	Algo QuantizeAlgo
+
+	// Palette if not empty is used instead of building a palette from the image. The alpha
+	// of the palette colors is ignored, each pixel keeps its own alpha
+	Palette color.Palette
+
+	// Dither is how the error between each pixel and its palette color is spread
+	Dither DitherMode
+}
+
+type quantize struct {
+	opts QuantizeOpts
+}
+
+type posterize struct {
+	levels int
+}
+
+// Quantizer builds palettes using median cut or k-means. It implements draw.Quantizer, so it
+// can be used as the SaveOpts.GIFQuantizer or AnimationOpts.Quantizer to give GIF images a
+// palette made from their own colors instead of the fixed palette.Plan9
+type Quantizer struct {
+	// Algo is the algorithm used to build the palette
+	Algo QuantizeAlgo
+
+	// NumRoutines is the number of goroutines used, if 0 the number of CPUs is used
+	NumRoutines int
+}
+
+// colorPoint is the average color of a group of similar pixels and the number of pixels
+type colorPoint struct {
+	c [3]float64
+	n int
+}
+
+// colorBin accumulates the pixels whose colors have the same top 5 bits in each channel
+type colorBin struct {
+	n   int
+	sum [3]int
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "quantize",
+		Description: "Reduces the image to a palette of colors, built from the image or supplied",
+		Params: []ParamInfo{
+			{Name: "colors", Description: "number of colors in the palette built from the image", Type: ParamInt, Default: 16, Min: 2, Max: 256},
+			{Name: "algo", Description: "how the palette is built", Type: ParamString, Default: QuantizeMedianCut.String(), Values: []string{QuantizeMedianCut.String(), QuantizeKMeans.String()}},
+			{Name: "palette", Description: "fixed palette as r,g,b rows e.g. 0,0,0;255,255,255, used instead of building one", Type: ParamKernel, Default: [][]float64{}},
+			{Name: "dither", Description: "how the difference from the palette colors is spread to neighbouring pixels", Type: ParamString, Default: DitherNone.String(), Values: []string{DitherNone.String(), DitherFloydSteinberg.String(), DitherOrdered.String()}},
+		},
+		New: func(p Params) (Effect, error) {
+			algo, err := parseQuantizeAlgo(p.String("algo"))
+			if err != nil {
+				return nil, err
+			}
+			dither, err := parseDitherMode(p.String("dither"))
+			if err != nil {
+				return nil, err
+			}
+			palette, err := rowsToPalette(p.Kernel("palette"))
+			if err != nil {
+				return nil, err
+			}
+			opts := QuantizeOpts{NumColors: p.Int("colors"), Algo: algo, Palette: palette, Dither: dither}
+			if err := opts.validate(); err != nil {
+				return nil, err
+			}
+			return NewQuantize(opts), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "posterize",
+		Description: "Reduces each channel to a number of evenly spaced levels",
+		Params: []ParamInfo{
+			{Name: "levels", Description: "number of values each channel is reduced to", Type: ParamInt, Default: 4, Min: 2, Max: 256},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewPosterize(p.Int("levels")), nil
+		},
+	})
+}
+
+// String returns the name of the algorithm as used in pipeline specs
+func (a QuantizeAlgo) String() string {
+	switch a {
+	case QuantizeMedianCut:
+		return "medianCut"
+	case QuantizeKMeans:
+		return "kMeans"
+	default:
+		return fmt.Sprintf("QuantizeAlgo(%d)", int(a))
+	}
+}
+
+func parseQuantizeAlgo(s string) (QuantizeAlgo, error) {
+	for _, a := range []QuantizeAlgo{QuantizeMedianCut, QuantizeKMeans} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quantize algorithm: %s", s)
+}
+
+// String returns the name of the dither mode as used in pipeline specs
+func (d DitherMode) String() string {
+	switch d {
+	case DitherNone:
+		return "none"
+	case DitherFloydSteinberg:
+		return "floydSteinberg"
+	case DitherOrdered:
+		return "ordered"
+	default:
+		return fmt.Sprintf("DitherMode(%d)", int(d))
+	}
+}
+
+func parseDitherMode(s string) (DitherMode, error) {
+	for _, d := range []DitherMode{DitherNone, DitherFloydSteinberg, DitherOrdered} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dither mode: %s", s)
+}
+
+// NewQuantize returns an effect that reduces the image to a palette of colors. Unless a fixed
+// palette is passed in the opts, the palette is built from the colors of the pixels inside the
+// image Bounds, use NewPalette to get the same palette
+func NewQuantize(opts QuantizeOpts) Effect {
+	if opts.NumColors == 0 {
+		opts.NumColors = 16
+	}
+	return &quantize{opts: opts}
+}
+
+func (q *quantize) Apply(img *Image, numRoutines int) (*Image, error) {
+	return q.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (q *quantize) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := q.opts.validate(); err != nil {
+		return nil, err
+	}
+	numRoutines = routines(numRoutines)
+
+	palette := q.opts.Palette
+	mapCtx := ctx
+	if len(palette) == 0 {
+		var err error
+		if palette, err = buildPalette(subProgress(ctx, 0, 0.3), img, q.opts.NumColors, q.opts.Algo, numRoutines); err != nil {
+			return nil, err
+		}
+		mapCtx = subProgress(ctx, 0.3, 1)
+	}
+	if len(palette) == 0 {
+		// Every pixel inside Bounds is transparent, any pixels outside are mapped to black
+		palette = color.Palette{color.Black}
+	}
+	colors := paletteColors(palette)
+
+	switch q.opts.Dither {
+	case DitherFloydSteinberg:
+		return floydSteinberg(mapCtx, img, colors)
+	case DitherOrdered:
+		// Offset by up to half the typical distance between the palette colors
+		spread := 255 / math.Cbrt(float64(len(colors)))
+		return mapColorsAt(mapCtx, img, numRoutines, func(x, y int, r, g, b uint8) (uint8, uint8, uint8) {
+			d := ((bayer8[y%8][x%8]+0.5)/64 - 0.5) * spread
+			c := colors[nearestColor(colors, float64(r)+d, float64(g)+d, float64(b)+d)]
+			return uint8(c[0]), uint8(c[1]), uint8(c[2])
+		})
+	default:
+		return mapColors(mapCtx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+			c := colors[nearestColor(colors, float64(r), float64(g), float64(b))]
+			return uint8(c[0]), uint8(c[1]), uint8(c[2])
+		})
+	}
+}
+
+func (q *quantize) Spec() EffectSpec {
+	return EffectSpec{Effect: "quantize", Params: Params{
+		"colors":  q.opts.NumColors,
+		"algo":    q.opts.Algo.String(),
+		"palette": paletteToRows(q.opts.Palette),
+		"dither":  q.opts.Dither.String(),
+	}}
+}
+
+func (opts QuantizeOpts) validate() error {
+	if len(opts.Palette) == 0 && (opts.NumColors < 2 || opts.NumColors > 256) {
+		return fmt.Errorf("number of colors must be between 2 and 256, got: %d", opts.NumColors)
+	}
+	if opts.Algo != QuantizeMedianCut && opts.Algo != QuantizeKMeans {
+		return fmt.Errorf("unknown quantize algorithm: %s", opts.Algo)
+	}
+	if opts.Dither != DitherNone && opts.Dither != DitherFloydSteinberg && opts.Dither != DitherOrdered {
+		return fmt.Errorf("unknown dither mode: %s", opts.Dither)
+	}
+	return nil
+}
+
+// NewPalette returns a palette of at most numColors colors for the pixels inside the Bounds of
+// img, built in parallel by numRoutines goroutines. If numRoutines is 0 the number of CPUs is
+// used. The palette has fewer colors if the image doesn't have enough distinct colors, fully
+// transparent pixels are ignored and every color in the palette is opaque
+func NewPalette(img *Image, numColors int, algo QuantizeAlgo, numRoutines int) (color.Palette, error) {
+	opts := QuantizeOpts{NumColors: numColors, Algo: algo}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return buildPalette(context.Background(), img, numColors, algo, numRoutines)
+}
+
+// Quantize appends a palette for m to p, with at most cap(p)-len(p) colors, it implements
+// draw.Quantizer. If m is fully transparent and p is empty a single transparent color is added
+func (q Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p
+	}
+	palette, err := buildPalette(context.Background(), FromImage(m), n, q.Algo, q.NumRoutines)
+	if err == nil {
+		p = append(p, palette...)
+	}
+	if len(p) == 0 {
+		// m has no opaque pixels to build a palette from, but the image still has to be drawn
+		// with at least one color
+		p = append(p, color.RGBA{})
+	}
+	return p
+}
+
+// buildPalette returns a palette of at most numColors colors for the pixels inside the Bounds
+// of img
+func buildPalette(ctx context.Context, img *Image, numColors int, algo QuantizeAlgo, numRoutines int) (color.Palette, error) {
+	numRoutines = routines(numRoutines)
+	points, err := colorPoints(ctx, img, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+	centers := medianCut(points, numColors)
+	if algo == QuantizeKMeans {
+		if centers, err = kMeans(ctx, points, centers, numRoutines); err != nil {
+			return nil, err
+		}
+	}
+
+	palette := make(color.Palette, len(centers))
+	for i, c := range centers {
+		palette[i] = color.RGBA{R: clampUint8(c[0]), G: clampUint8(c[1]), B: clampUint8(c[2]), A: 255}
+	}
+	return palette, nil
+}
+
+// colorPoints groups the pixels inside the Bounds of img in to bins of similar colors, so the
+// palette algorithms work on at most 32768 points however large the image is. Each goroutine
+// fills its own bins, which are added together at the end
+func colorPoints(ctx context.Context, img *Image, numRoutines int) ([]colorPoint, error) {
+	partials := make([][]colorBin, numRoutines)
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		a := inPix[offset+3]
+		if a == 0 {
+			return
+		}
+		r, g, b := inPix[offset], inPix[offset+1], inPix[offset+2]
+		if a != 255 {
+			r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+		}
+		if partials[ri] == nil {
+			partials[ri] = make([]colorBin, 1<<15)
+		}
+		bin := &partials[ri][int(r>>3)<<10|int(g>>3)<<5|int(b>>3)]
+		bin.n++
+		bin.sum[0] += int(r)
+		bin.sum[1] += int(g)
+		bin.sum[2] += int(b)
+	}
+	if err := runParallel(ctx, numRoutines, img, img.Bounds, img, pf, 0); err != nil {
+		return nil, err
+	}
+
+	var points []colorPoint
+	for i := 0; i < 1<<15; i++ {
+		var bin colorBin
+		for _, p := range partials {
+			if p == nil {
+				continue
+			}
+			bin.n += p[i].n
+			for c := 0; c < 3; c++ {
+				bin.sum[c] += p[i].sum[c]
+			}
+		}
+		if bin.n == 0 {
+			continue
+		}
+		n := float64(bin.n)
+		points = append(points, colorPoint{
+			c: [3]float64{float64(bin.sum[0]) / n, float64(bin.sum[1]) / n, float64(bin.sum[2]) / n},
+			n: bin.n,
+		})
+	}
+	return points, nil
+}
+
+// medianCut starts with a box containing every point and repeatedly splits the box with the
+// largest spread, weighted by the number of pixels in it, at the median of its widest channel.
+// It returns the average color of each box
+func medianCut(points []colorPoint, numColors int) [][3]float64 {
+	if len(points) == 0 {
+		return nil
+	}
+
+	boxes := [][]colorPoint{append([]colorPoint{}, points...)}
+	for len(boxes) < numColors {
+		best, bestChannel, bestScore := -1, 0, 0.0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			channel, spread, n := 0, 0.0, 0
+			for c := 0; c < 3; c++ {
+				lo, hi := box[0].c[c], box[0].c[c]
+				for _, p := range box {
+					lo = math.Min(lo, p.c[c])
+					hi = math.Max(hi, p.c[c])
+				}
+				if hi-lo > spread {
+					channel, spread = c, hi-lo
+				}
+			}
+			for _, p := range box {
+				n += p.n
+			}
+			if score := spread * float64(n); score > bestScore {
+				best, bestChannel, bestScore = i, channel, score
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool {
+			return box[i].c[bestChannel] < box[j].c[bestChannel]
+		})
+		total := 0
+		for _, p := range box {
+			total += p.n
+		}
+		split, cumulative := 1, box[0].n
+		for split < len(box)-1 && cumulative*2 < total {
+			cumulative += box[split].n
+			split++
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	centers := make([][3]float64, len(boxes))
+	for i, box := range boxes {
+		var sum [3]float64
+		n := 0
+		for _, p := range box {
+			for c := 0; c < 3; c++ {
+				sum[c] += p.c[c] * float64(p.n)
+			}
+			n += p.n
+		}
+		for c := 0; c < 3; c++ {
+			centers[i][c] = sum[c] / float64(n)
+		}
+	}
+	return centers
+}
+
+// kMeans refines the centers by assigning each point to its nearest center and moving each
+// center to the average of its points, until no point changes center. The points are split
+// between numRoutines goroutines, each summing its own points
+func kMeans(ctx context.Context, points []colorPoint, centers [][3]float64, numRoutines int) ([][3]float64, error) {
+	type partial struct {
+		sum     [][3]float64
+		n       []int
+		changed bool
+	}
+
+	k := len(centers)
+	assigned := make([]int, len(points))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	chunk := (len(points) + numRoutines - 1) / numRoutines
+
+	for iter := 0; iter < kMeansIterations; iter++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		partials := make([]partial, numRoutines)
+		wg := sync.WaitGroup{}
+		for ri := 0; ri < numRoutines; ri++ {
+			start, end := ri*chunk, (ri+1)*chunk
+			if end > len(points) {
+				end = len(points)
+			}
+			if start >= end {
+				break
+			}
+			wg.Add(1)
+			go func(p *partial, start, end int) {
+				defer wg.Done()
+				p.sum = make([][3]float64, k)
+				p.n = make([]int, k)
+				for i := start; i < end; i++ {
+					pt := points[i]
+					c := nearestColor(centers, pt.c[0], pt.c[1], pt.c[2])
+					if c != assigned[i] {
+						assigned[i] = c
+						p.changed = true
+					}
+					for ch := 0; ch < 3; ch++ {
+						p.sum[c][ch] += pt.c[ch] * float64(pt.n)
+					}
+					p.n[c] += pt.n
+				}
+			}(&partials[ri], start, end)
+		}
+		wg.Wait()
+
+		changed := false
+		sum := make([][3]float64, k)
+		n := make([]int, k)
+		for _, p := range partials {
+			changed = changed || p.changed
+			for c := 0; c < len(p.n); c++ {
+				for ch := 0; ch < 3; ch++ {
+					sum[c][ch] += p.sum[c][ch]
+				}
+				n[c] += p.n[c]
+			}
+		}
+		if !changed {
+			break
+		}
+
+		next := make([][3]float64, k)
+		for c := range next {
+			if n[c] == 0 {
+				// No points are closest to this center, leave it where it is
+				next[c] = centers[c]
+				continue
+			}
+			for ch := 0; ch < 3; ch++ {
+				next[c][ch] = sum[c][ch] / float64(n[c])
+			}
+		}
+		centers = next
+	}
+	return centers, nil
+}
+
+// floydSteinberg maps every pixel inside the Bounds of img to its nearest color, adding 7/16 of
+// the error to the pixel on its right and 3/16, 5/16 and 1/16 to the pixels below
+func floydSteinberg(ctx context.Context, img *Image, colors [][3]float64) (*Image, error) {
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: img.Bounds,
+	}
+
+	b := img.Bounds
+	stride := img.img.Stride
+	inPix, outPix := img.img.Pix, out.img.Pix
+	pr := progressFromContext(ctx)
+
+	// The error for the current and next row, with an extra pixel at each end so the
+	// neighbours never have to be bounds checked
+	errs := make([][3]float64, b.Width+2)
+	nextErrs := make([][3]float64, b.Width+2)
+	for y := b.Y; y < b.Y+b.Height; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for i := range nextErrs {
+			nextErrs[i] = [3]float64{}
+		}
+
+		offset := y*stride + b.X*4
+		for i := 1; i <= b.Width; i++ {
+			a := inPix[offset+3]
+			outPix[offset+3] = a
+			if a == 0 {
+				offset += 4
+				continue
+			}
+
+			var v [3]float64
+			for c := 0; c < 3; c++ {
+				p := inPix[offset+c]
+				if a != 255 {
+					p = unpremultiply(p, a)
+				}
+				v[c] = math.Min(math.Max(float64(p)+errs[i][c], 0), 255)
+			}
+			nc := colors[nearestColor(colors, v[0], v[1], v[2])]
+			for c := 0; c < 3; c++ {
+				e := v[c] - nc[c]
+				errs[i+1][c] += e * 7 / 16
+				nextErrs[i-1][c] += e * 3 / 16
+				nextErrs[i][c] += e * 5 / 16
+				nextErrs[i+1][c] += e * 1 / 16
+				outPix[offset+c] = premultiply(uint8(nc[c]), a)
+			}
+			offset += 4
+		}
+		errs, nextErrs = nextErrs, errs
+
+		if pr != nil {
+			pr.report(float64(y-b.Y+1) / float64(b.Height))
+		}
+	}
+	return out, nil
+}
+
+// nearestColor returns the index of the color in colors closest to r,g,b
+func nearestColor(colors [][3]float64, r, g, b float64) int {
+	best, bestDist := 0, math.MaxFloat64
+	for i, c := range colors {
+		dr, dg, db := r-c[0], g-c[1], b-c[2]
+		if d := dr*dr + dg*dg + db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// paletteColors returns the colors of the palette without alpha premultiplied in to them
+func paletteColors(palette color.Palette) [][3]float64 {
+	colors := make([][3]float64, len(palette))
+	for i, c := range palette {
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		colors[i] = [3]float64{float64(nc.R), float64(nc.G), float64(nc.B)}
+	}
+	return colors
+}
+
+// rowsToPalette converts rows of r,g,b values, as used in pipeline specs, to a palette of
+// opaque colors
+func rowsToPalette(rows [][]float64) (color.Palette, error) {
+	palette := make(color.Palette, len(rows))
+	for i, row := range rows {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("each palette color must be r,g,b, got: %v", row)
+		}
+		for _, v := range row {
+			if v < 0 || v > 255 || v != math.Trunc(v) {
+				return nil, fmt.Errorf("palette colors must be whole numbers between 0 and 255, got: %v", row)
+			}
+		}
+		palette[i] = color.RGBA{R: uint8(row[0]), G: uint8(row[1]), B: uint8(row[2]), A: 255}
+	}
+	return palette, nil
+}
+
+func paletteToRows(palette color.Palette) [][]float64 {
+	colors := paletteColors(palette)
+	rows := make([][]float64, len(colors))
+	for i, c := range colors {
+		rows[i] = []float64{c[0], c[1], c[2]}
+	}
+	return rows
+}
+
+// NewPosterize returns an effect that reduces each channel to levels evenly spaced values, which
+// gives flat areas of color like a screen printed poster. levels is between 2 and 256
+func NewPosterize(levels int) Effect {
+	return &posterize{levels: levels}
+}
+
+func (p *posterize) Apply(img *Image, numRoutines int) (*Image, error) {
+	return p.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (p *posterize) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if p.levels < 2 || p.levels > 256 {
+		return nil, fmt.Errorf("posterize levels must be between 2 and 256, got: %d", p.levels)
+	}
+
+	step := 255 / float64(p.levels-1)
+	return applyToneLUT(ctx, img, numRoutines, newToneLUT(func(v float64) float64 {
+		return math.Round(v/step) * step
+	}))
+}
+
+func (p *posterize) Spec() EffectSpec {
+	return EffectSpec{Effect: "posterize", Params: Params{"levels": p.levels}}
+}
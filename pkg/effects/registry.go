@@ -0,0 +1,457 @@
+package effects
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParamType is the type of an effect parameter
+type ParamType int
+
+const (
+	// ParamInt is a whole number, stored as an int
+	ParamInt ParamType = iota
+
+	// ParamFloat is a number, stored as a float64
+	ParamFloat
+
+	// ParamBool is true or false, stored as a bool
+	ParamBool
+
+	// ParamString is a string, used for enumerated values such as the grayscale algorithm
+	ParamString
+
+	// ParamColor is a color, written as a hex string e.g. #ff0000 or #80000080 and stored as a color.RGBA.
+	// Like color.RGBA the values are premultiplied by alpha, so #80000080 is half transparent red
+	ParamColor
+
+	// ParamKernel is an array of rows of numbers, stored as a [][]float64. It is used for
+	// convolution kernels and for lists of points, such as the control points of a curve
+	ParamKernel
+)
+
+// String returns the name of the type
+func (t ParamType) String() string {
+	switch t {
+	case ParamInt:
+		return "int"
+	case ParamFloat:
+		return "float"
+	case ParamBool:
+		return "bool"
+	case ParamString:
+		return "string"
+	case ParamColor:
+		return "color"
+	case ParamKernel:
+		return "kernel"
+	default:
+		return fmt.Sprintf("ParamType(%d)", int(t))
+	}
+}
+
+// ParamInfo describes a single parameter of an effect
+type ParamInfo struct {
+	// Name is the name of the parameter in a spec, e.g. filterSize
+	Name string
+
+	// Description is a short, human readable description of the parameter
+	Description string
+
+	// Type is the type of the parameter
+	Type ParamType
+
+	// Default is the value used when the parameter is not specified, it must be of the
+	// stored type for Type. If nil the parameter is required
+	Default interface{}
+
+	// Min and Max are the inclusive range of valid values for ParamInt and ParamFloat
+	// parameters. The range is only checked if Max is greater than Min
+	Min float64
+	Max float64
+
+	// Odd requires ParamInt values to be odd, such as kernel sizes. If 0 is inside the
+	// range it is also accepted, which effects use to mean the value is not set
+	Odd bool
+
+	// Values lists the valid values of a ParamString parameter, if empty any string is valid
+	Values []string
+}
+
+// EffectInfo describes an effect that can be created by name, for example from a pipeline spec
+type EffectInfo struct {
+	// Name is the unique name of the effect, e.g. oil
+	Name string
+
+	// Description is a short, human readable description of the effect
+	Description string
+
+	// Params describes each of the parameters the effect accepts, in the order they
+	// should be presented to a user
+	Params []ParamInfo
+
+	// New creates the effect. The params have already been validated against Params, so
+	// every parameter is present and of the correct type
+	New func(p Params) (Effect, error)
+}
+
+// Params are the named parameters of an effect. After validation each value is stored
+// as the type described by the matching ParamInfo
+type Params map[string]interface{}
+
+// Int returns the named parameter as an int
+func (p Params) Int(name string) int {
+	v, _ := p[name].(int)
+	return v
+}
+
+// Float returns the named parameter as a float64
+func (p Params) Float(name string) float64 {
+	v, _ := p[name].(float64)
+	return v
+}
+
+// Bool returns the named parameter as a bool
+func (p Params) Bool(name string) bool {
+	v, _ := p[name].(bool)
+	return v
+}
+
+// String returns the named parameter as a string
+func (p Params) String(name string) string {
+	v, _ := p[name].(string)
+	return v
+}
+
+// Color returns the named parameter as a color
+func (p Params) Color(name string) color.RGBA {
+	v, _ := p[name].(color.RGBA)
+	return v
+}
+
+// Kernel returns the named parameter as a convolution kernel
+func (p Params) Kernel(name string) [][]float64 {
+	v, _ := p[name].([][]float64)
+	return v
+}
+
+// Border parameters can be specified for any effect, if present the effect is wrapped with WithBorder
+const (
+	borderParam      = "border"
+	borderColorParam = "borderColor"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]EffectInfo{}
+)
+
+// Register makes an effect available by name, so it can be created with NewEffect and used in
+// pipeline specs. It panics if the name is already registered or the info is invalid, since
+// it is intended to be called from init functions
+func Register(info EffectInfo) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if info.Name == "" || info.New == nil {
+		panic("effects: Register requires a name and New function")
+	}
+	if _, ok := registry[info.Name]; ok {
+		panic("effects: Register called twice for effect " + info.Name)
+	}
+	for _, pi := range info.Params {
+		if pi.Default == nil {
+			continue
+		}
+		if _, err := pi.Validate(pi.Default); err != nil {
+			panic(fmt.Sprintf("effects: invalid default for %s.%s: %s", info.Name, pi.Name, err))
+		}
+	}
+	registry[info.Name] = info
+}
+
+// LookupEffect returns the registered information for the named effect
+func LookupEffect(name string) (EffectInfo, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	info, ok := registry[name]
+	return info, ok
+}
+
+// Effects returns information about every registered effect, sorted by name
+func Effects() []EffectInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	infos := make([]EffectInfo, 0, len(registry))
+	for _, info := range registry {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Param returns the information for the named parameter
+func (info EffectInfo) Param(name string) (ParamInfo, bool) {
+	for _, pi := range info.Params {
+		if pi.Name == name {
+			return pi, true
+		}
+	}
+	return ParamInfo{}, false
+}
+
+// NewEffect creates the effect described by spec. The parameters in the spec are validated
+// against the registered ParamInfo, unknown parameters are an error and missing parameters
+// are set to their default value
+func NewEffect(spec EffectSpec) (Effect, error) {
+	registryMu.RLock()
+	info, ok := registry[spec.Effect]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown effect: %s", spec.Effect)
+	}
+
+	params, border, err := validateParams(info, spec.Params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", info.Name, err)
+	}
+	e, err := info.New(params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", info.Name, err)
+	}
+	if border.Mode != BorderShrink {
+		e = WithBorder(e, border)
+	}
+	return e, nil
+}
+
+// validateParams returns a copy of params converted to the types in info, with defaults filled in
+func validateParams(info EffectInfo, params Params) (Params, Border, error) {
+	out := Params{}
+	known := map[string]bool{}
+	for _, pi := range info.Params {
+		known[pi.Name] = true
+		v, ok := params[pi.Name]
+		if !ok || v == nil {
+			if pi.Default == nil {
+				return nil, Border{}, fmt.Errorf("missing required parameter: %s", pi.Name)
+			}
+			v = pi.Default
+		}
+		converted, err := pi.Validate(v)
+		if err != nil {
+			return nil, Border{}, err
+		}
+		out[pi.Name] = converted
+	}
+
+	var border Border
+	for name, v := range params {
+		switch {
+		case known[name]:
+		case name == borderParam:
+			s, _ := v.(string)
+			mode, err := parseBorderMode(s)
+			if err != nil {
+				return nil, Border{}, err
+			}
+			border.Mode = mode
+		case name == borderColorParam:
+			c, err := convertParam(ParamInfo{Name: name, Type: ParamColor}, v)
+			if err != nil {
+				return nil, Border{}, err
+			}
+			border.Color = c.(color.RGBA)
+		default:
+			return nil, Border{}, fmt.Errorf("unknown parameter: %s", name)
+		}
+	}
+	return out, border, nil
+}
+
+// Validate checks v is a valid value for the parameter, returning it converted to the stored
+// type for the parameter. v can be a value decoded from JSON or YAML, or the stored type
+func (pi ParamInfo) Validate(v interface{}) (interface{}, error) {
+	converted, err := convertParam(pi, v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pi.Type {
+	case ParamInt, ParamFloat:
+		f, _ := toFloat(converted)
+		if pi.Max > pi.Min && (f < pi.Min || f > pi.Max) {
+			return nil, fmt.Errorf("parameter %s must be between %v and %v, got: %v", pi.Name, pi.Min, pi.Max, v)
+		}
+		if pi.Type == ParamInt && pi.Odd && !isOddInt(int(f)) && !(f == 0 && pi.Min <= 0) {
+			return nil, fmt.Errorf("parameter %s must be odd, got: %v", pi.Name, v)
+		}
+	case ParamString:
+		if len(pi.Values) == 0 {
+			break
+		}
+		for _, value := range pi.Values {
+			if value == converted {
+				return converted, nil
+			}
+		}
+		return nil, fmt.Errorf("parameter %s must be one of %s, got: %v", pi.Name, strings.Join(pi.Values, ", "), v)
+	}
+	return converted, nil
+}
+
+// Parse converts a string, such as a command line flag or URL query value, to a valid value for
+// the parameter. Kernels are written as rows separated by ; with values separated by , e.g. 0,1,0;1,-4,1;0,1,0
+func (pi ParamInfo) Parse(s string) (interface{}, error) {
+	var v interface{}
+	var err error
+	switch pi.Type {
+	case ParamInt:
+		v, err = strconv.Atoi(s)
+	case ParamFloat:
+		v, err = strconv.ParseFloat(s, 64)
+	case ParamBool:
+		v, err = strconv.ParseBool(s)
+	case ParamKernel:
+		var kernel [][]float64
+		for _, row := range strings.Split(s, ";") {
+			var values []float64
+			for _, value := range strings.Split(row, ",") {
+				f, ferr := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if ferr != nil {
+					err = ferr
+				}
+				values = append(values, f)
+			}
+			kernel = append(kernel, values)
+		}
+		v = kernel
+	default:
+		v = s
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s must be of type %s, got: %s", pi.Name, pi.Type, s)
+	}
+	return pi.Validate(v)
+}
+
+// convertParam converts a value decoded from JSON or YAML, or passed in from Go code, to the
+// stored type for the parameter
+func convertParam(pi ParamInfo, v interface{}) (interface{}, error) {
+	invalid := func() error {
+		return fmt.Errorf("parameter %s must be of type %s, got: %v", pi.Name, pi.Type, v)
+	}
+
+	switch pi.Type {
+	case ParamInt:
+		f, ok := toFloat(v)
+		if !ok || f != math.Trunc(f) {
+			return nil, invalid()
+		}
+		return int(f), nil
+	case ParamFloat:
+		f, ok := toFloat(v)
+		if !ok {
+			return nil, invalid()
+		}
+		return f, nil
+	case ParamBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, invalid()
+		}
+		return b, nil
+	case ParamString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, invalid()
+		}
+		return s, nil
+	case ParamColor:
+		switch c := v.(type) {
+		case color.RGBA:
+			return c, nil
+		case string:
+			rgba, err := parseColor(c)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %s", pi.Name, err)
+			}
+			return rgba, nil
+		}
+		return nil, invalid()
+	case ParamKernel:
+		switch k := v.(type) {
+		case [][]float64:
+			return k, nil
+		case []interface{}:
+			kernel := make([][]float64, len(k))
+			for i, row := range k {
+				values, ok := row.([]interface{})
+				if !ok {
+					return nil, invalid()
+				}
+				kernel[i] = make([]float64, len(values))
+				for j, value := range values {
+					f, ok := toFloat(value)
+					if !ok {
+						return nil, invalid()
+					}
+					kernel[i][j] = f
+				}
+			}
+			return kernel, nil
+		}
+		return nil, invalid()
+	default:
+		return nil, fmt.Errorf("parameter %s has unknown type: %s", pi.Name, pi.Type)
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// parseColor parses a color in the form #rrggbb or #rrggbbaa
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color, expected #rrggbb or #rrggbbaa: %s", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color, expected #rrggbb or #rrggbbaa: %s", s)
+	}
+	c := color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+	if c.R > c.A || c.G > c.A || c.B > c.A {
+		return color.RGBA{}, fmt.Errorf("invalid color, it is premultiplied so red, green and blue can't be larger than alpha: %s", s)
+	}
+	return c, nil
+}
+
+// FormatColor returns the color in the form #rrggbbaa, the form color params are written in
+func FormatColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
@@ -0,0 +1,120 @@
+package effects
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultTileSize is the width and height of the tiles the image is split in to when
+// the caller does not need the tiles aligned to some other size
+const defaultTileSize = 64
+
+// pixelFunc is called once for every pixel being processed. ri is the index of the worker
+// goroutine calling the function, in the range [0, numRoutines), so it can be used to index
+// per goroutine scratch space. offset is the index of the pixel in both inPix and outPix
+type pixelFunc func(ri, x, y, offset, inStride int, inPix, outPix []uint8)
+
+// tile is a rectangular region of the image processed by a single worker
+type tile struct {
+	x, y          int
+	width, height int
+}
+
+// routines returns the number of goroutines an effect should use when it is asked for
+// numRoutines, 0 uses the number of CPUs and a negative number is treated as 1. Every entry
+// point that takes numRoutines normalizes it with routines before sizing per goroutine scratch
+// space
+func routines(numRoutines int) int {
+	if numRoutines == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	if numRoutines < 1 {
+		return 1
+	}
+	return numRoutines
+}
+
+// runParallel calls pf for every pixel inside inBounds. The bounds are split in to square
+// tiles of tileSize pixels, 0 meaning defaultTileSize, which are handed out in row-major order
+// to a pool of numRoutines workers. Inside a tile pixels are visited row by row, so memory is
+// read in the same order it is laid out in the Pix buffers. Tiles are aligned to the top left
+// corner of inBounds, so callers that need to process whole blocks of pixels in a single
+// worker can pass a multiple of their block size.
+//
+// Workers check ctx between tiles and stop early if it has been cancelled, in which case
+// ctx.Err() is returned. Completed tiles are reported to any progress reporter attached to ctx.
+// numRoutines less than 1 is treated as 1, so every pixel is always visited
+func runParallel(ctx context.Context, numRoutines int, inImg *Image, inBounds Rect, outImg *Image, pf pixelFunc, tileSize int) error {
+	if tileSize <= 0 {
+		tileSize = defaultTileSize
+	}
+	if inBounds.IsEmpty() {
+		return ctx.Err()
+	}
+
+	stride := inImg.img.Stride
+	inPix := inImg.img.Pix
+	outPix := outImg.img.Pix
+
+	tilesX := (inBounds.Width + tileSize - 1) / tileSize
+	tilesY := (inBounds.Height + tileSize - 1) / tileSize
+	nTiles := tilesX * tilesY
+	if numRoutines > nTiles {
+		numRoutines = nTiles
+	}
+	if numRoutines < 1 {
+		numRoutines = 1
+	}
+
+	// The queue is filled up front, there are never so many tiles that this is a
+	// significant amount of memory and the workers never have to wait on a producer
+	tiles := make(chan tile, nTiles)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			t := tile{
+				x:      inBounds.X + tx*tileSize,
+				y:      inBounds.Y + ty*tileSize,
+				width:  tileSize,
+				height: tileSize,
+			}
+			if t.x+t.width > inBounds.X+inBounds.Width {
+				t.width = inBounds.X + inBounds.Width - t.x
+			}
+			if t.y+t.height > inBounds.Y+inBounds.Height {
+				t.height = inBounds.Y + inBounds.Height - t.y
+			}
+			tiles <- t
+		}
+	}
+	close(tiles)
+
+	pr := progressFromContext(ctx)
+	var completed int64
+
+	wg := sync.WaitGroup{}
+	for r := 0; r < numRoutines; r++ {
+		wg.Add(1)
+		go func(ri int) {
+			defer wg.Done()
+			for t := range tiles {
+				if ctx.Err() != nil {
+					return
+				}
+				for y := t.y; y < t.y+t.height; y++ {
+					offset := y*stride + t.x*4
+					for x := t.x; x < t.x+t.width; x++ {
+						pf(ri, x, y, offset, stride, inPix, outPix)
+						offset += 4
+					}
+				}
+				if pr != nil {
+					pr.report(float64(atomic.AddInt64(&completed, 1)) / float64(nTiles))
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
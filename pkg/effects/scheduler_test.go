@@ -0,0 +1,142 @@
+package effects
+
+import (
+	"context"
+	"image"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// runParallelStripes is the original scheduler, it splits the image in to numRoutines vertical
+// stripes and walks each column top to bottom. It is kept here so the tile scheduler can be
+// benchmarked against it
+func runParallelStripes(numRoutines int, inImg *Image, inBounds Rect, outImg *Image, pf pixelFunc) {
+	w := inBounds.Width
+	h := inBounds.Height
+	stride := inImg.img.Stride
+	inPix := inImg.img.Pix
+	outPix := outImg.img.Pix
+
+	wg := sync.WaitGroup{}
+	xOffset := inBounds.X
+	widthPerRoutine := w / numRoutines
+	for r := 0; r < numRoutines; r++ {
+		wg.Add(1)
+		if r == numRoutines-1 {
+			widthPerRoutine = (inBounds.X + w) - xOffset
+		}
+		go func(ri, xStart, yStart, width, height int) {
+			for x := xStart; x < xStart+width; x++ {
+				for y := yStart; y < yStart+height; y++ {
+					offset := y*stride + x*4
+					pf(ri, x, y, offset, stride, inPix, outPix)
+				}
+			}
+			wg.Done()
+		}(r, xOffset, inBounds.Y, widthPerRoutine, h)
+		xOffset += widthPerRoutine
+	}
+	wg.Wait()
+}
+
+// boxBlur is a small neighbourhood pixelFunc, similar in shape to the kernel based effects
+func boxBlur(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+	var r, g, b int
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			pOffset := offset + dx*4 + dy*inStride
+			r += int(inPix[pOffset])
+			g += int(inPix[pOffset+1])
+			b += int(inPix[pOffset+2])
+		}
+	}
+	outPix[offset] = uint8(r / 25)
+	outPix[offset+1] = uint8(g / 25)
+	outPix[offset+2] = uint8(b / 25)
+	outPix[offset+3] = 255
+}
+
+func loadBenchImage(b *testing.B) (*Image, *Image, Rect) {
+	img, err := LoadImage("../../test/cabin.jpg")
+	require.Nil(b, err)
+	out := FromImage(img.img)
+	bounds := Rect{X: 2, Y: 2, Width: img.Width - 4, Height: img.Height - 4}
+	return img, out, bounds
+}
+
+func TestRunParallelVisitsEveryPixel(t *testing.T) {
+	img := FromImage(image.NewRGBA(image.Rect(0, 0, 37, 23)))
+	bounds := Rect{X: 3, Y: 2, Width: 31, Height: 19}
+	for _, tileSize := range []int{0, 1, 5, 64} {
+		counts := make([]int32, img.Width*img.Height)
+		valid := make([]bool, img.Width*img.Height)
+		pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+			counts[y*img.Width+x]++
+			valid[y*img.Width+x] = offset == y*inStride+x*4 && ri >= 0 && ri < 3
+		}
+		err := runParallel(context.Background(), 3, img, bounds, img, pf, tileSize)
+		require.Nil(t, err)
+
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				expected := int32(0)
+				if x >= bounds.X && x < bounds.X+bounds.Width && y >= bounds.Y && y < bounds.Y+bounds.Height {
+					expected = 1
+				}
+				require.Equal(t, expected, counts[y*img.Width+x], "x:%d y:%d tileSize:%d", x, y, tileSize)
+				require.Equal(t, expected == 1, valid[y*img.Width+x])
+			}
+		}
+	}
+}
+
+func TestRunParallelAtLeastOneRoutine(t *testing.T) {
+	img := FromImage(image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	for _, numRoutines := range []int{0, -1} {
+		var count int32
+		pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+			count++
+			require.Equal(t, 0, ri)
+		}
+		err := runParallel(context.Background(), numRoutines, img, img.Bounds, img, pf, 0)
+		require.Nil(t, err)
+		require.Equal(t, int32(100), count, "numRoutines:%d", numRoutines)
+	}
+}
+
+func BenchmarkRunParallelTiles(b *testing.B) {
+	img, out, bounds := loadBenchImage(b)
+	numRoutines := runtime.GOMAXPROCS(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runParallel(context.Background(), numRoutines, img, bounds, out, boxBlur, 0)
+	}
+}
+
+func BenchmarkRunParallelStripes(b *testing.B) {
+	img, out, bounds := loadBenchImage(b)
+	numRoutines := runtime.GOMAXPROCS(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runParallelStripes(numRoutines, img, bounds, out, boxBlur)
+	}
+}
+
+func BenchmarkRunParallelTilesSerial(b *testing.B) {
+	img, out, bounds := loadBenchImage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runParallel(context.Background(), 1, img, bounds, out, boxBlur, 0)
+	}
+}
+
+func BenchmarkRunParallelStripesSerial(b *testing.B) {
+	img, out, bounds := loadBenchImage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runParallelStripes(1, img, bounds, out, boxBlur)
+	}
+}
@@ -0,0 +1,171 @@
+package effects
+
+import (
+	"context"
+	"image"
+)
+
+// USMOpts options to pass to the UnsharpMask effect
+type USMOpts struct {
+	// KernelSize is the size of the gaussian kernel used to blur the image, it must be odd. If 0
+	// it is derived from Sigma. Larger values sharpen larger features in the image
+	KernelSize int
+
+	// Sigma is the standard deviation of the gaussian blur, if 0 it is derived from KernelSize
+	Sigma float64
+
+	// Amount is how much of the difference between the image and the blurred image is added
+	// back to the image, values between 0.5 and 2 are typical
+	Amount float64
+
+	// Threshold is the minimum difference between a pixel and its blurred value, between 0 and
+	// 255, before it is sharpened. Raising it stops noise and smooth areas from being sharpened
+	Threshold int
+}
+
+type unsharpMask struct {
+	opts USMOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "unsharpMask",
+		Description: "Sharpens the image by adding back the difference from a blurred copy",
+		Params: []ParamInfo{
+			{Name: "kernelSize", Description: "size of the gaussian kernel, 0 derives it from sigma", Type: ParamInt, Default: 0, Min: 0, Max: 255, Odd: true},
+			{Name: "sigma", Description: "standard deviation of the gaussian kernel", Type: ParamFloat, Default: 2.0, Min: 0, Max: 100},
+			{Name: "amount", Description: "how much of the difference is added back", Type: ParamFloat, Default: 1.0, Min: 0, Max: 10},
+			{Name: "threshold", Description: "minimum difference that is sharpened", Type: ParamInt, Default: 3, Min: 0, Max: 255},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewUnsharpMask(USMOpts{
+				KernelSize: p.Int("kernelSize"),
+				Sigma:      p.Float("sigma"),
+				Amount:     p.Float("amount"),
+				Threshold:  p.Int("threshold"),
+			}), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "sharpen",
+		Description: "Sharpens the image with a 3x3 kernel",
+		Params: []ParamInfo{
+			{Name: "strength", Description: "strength of the sharpening, 0 leaves the image unchanged", Type: ParamFloat, Default: 1.0, Min: 0, Max: 10},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewSharpen(p.Float("strength")), nil
+		},
+	})
+}
+
+// NewUnsharpMask returns an effect that sharpens the image by subtracting a gaussian blurred copy
+// of the image from the original, then adding the difference, scaled by Amount, back on to the
+// original image. Some starting values are:
+// KernelSize: 0
+// Sigma: 2
+// Amount: 1
+// Threshold: 3
+func NewUnsharpMask(opts USMOpts) Effect {
+	return &unsharpMask{opts: opts}
+}
+
+func (u *unsharpMask) Apply(img *Image, numRoutines int) (*Image, error) {
+	return u.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (u *unsharpMask) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	numRoutines = routines(numRoutines)
+
+	gaussian := NewGaussian(u.opts.KernelSize, u.opts.Sigma)
+	blurImg, err := ApplyContext(subProgress(ctx, 0, 0.7), gaussian, img, numRoutines)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := u.opts.Amount
+	threshold := u.opts.Threshold
+	blurPix := blurImg.img.Pix
+	sharpen := func(v, blur uint8) uint8 {
+		diff := int(v) - int(blur)
+		if diff < threshold && -diff < threshold {
+			return v
+		}
+		return clampUint8(float64(v) + amount*float64(diff))
+	}
+
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		// The alpha is kept and the premultiplied colors can't be sharpened past it
+		a := inPix[offset+3]
+		for c := 0; c < 3; c++ {
+			v := sharpen(inPix[offset+c], blurPix[offset+c])
+			if v > a {
+				v = a
+			}
+			outPix[offset+c] = v
+		}
+		outPix[offset+3] = a
+	}
+
+	out := &Image{
+		img: image.NewRGBA(image.Rectangle{
+			Min: image.Point{X: 0, Y: 0},
+			Max: image.Point{X: img.Width, Y: img.Height},
+		}),
+		Width:  img.Width,
+		Height: img.Height,
+		Bounds: blurImg.Bounds,
+	}
+	if err := runParallel(subProgress(ctx, 0.7, 1), numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (u *unsharpMask) kernelRadius() int {
+	return NewGaussian(u.opts.KernelSize, u.opts.Sigma).(kernelEffect).kernelRadius()
+}
+
+func (u *unsharpMask) Spec() EffectSpec {
+	return EffectSpec{Effect: "unsharpMask", Params: Params{
+		"kernelSize": u.opts.KernelSize,
+		"sigma":      u.opts.Sigma,
+		"amount":     u.opts.Amount,
+		"threshold":  u.opts.Threshold,
+	}}
+}
+
+type sharpen struct {
+	strength float64
+}
+
+// NewSharpen returns an effect that sharpens the image with a 3x3 kernel, which increases the
+// difference between each pixel and its four direct neighbours. strength controls how much the
+// image is sharpened, 1 is the standard sharpen kernel, values less than 1 sharpen less
+func NewSharpen(strength float64) Effect {
+	return &sharpen{strength: strength}
+}
+
+func (s *sharpen) Apply(img *Image, numRoutines int) (*Image, error) {
+	return s.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (s *sharpen) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	return ApplyContext(ctx, s.convolution(), img, numRoutines)
+}
+
+func (s *sharpen) convolution() Effect {
+	a := s.strength
+	return NewConvolution([][]float64{
+		{0, -a, 0},
+		{-a, 1 + 4*a, -a},
+		{0, -a, 0},
+	}, ConvOpts{Divisor: 1})
+}
+
+func (s *sharpen) kernelRadius() int {
+	return 1
+}
+
+func (s *sharpen) Spec() EffectSpec {
+	return EffectSpec{Effect: "sharpen", Params: Params{"strength": s.strength}}
+}
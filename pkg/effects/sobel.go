@@ -1,9 +1,9 @@
 package effects
 
 import (
+	"context"
 	"image"
 	"math"
-	"runtime"
 )
 
 type sobel struct {
@@ -11,8 +11,22 @@ type sobel struct {
 	invert    bool
 }
 
-// NewSobel the input image should be a grayscale image, the output will be a version of
-// the input image with the Sobel edge detector applied to it. A value of -1 for threshold
+func init() {
+	Register(EffectInfo{
+		Name:        "sobel",
+		Description: "Detects edges using the sobel operator",
+		Params: []ParamInfo{
+			{Name: "threshold", Description: "magnitude above which a pixel is an edge, -1 outputs the raw magnitude", Type: ParamInt, Default: -1, Min: -1, Max: 255},
+			{Name: "invert", Description: "draw black edges on a white background", Type: ParamBool, Default: false},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewSobel(p.Int("threshold"), p.Bool("invert")), nil
+		},
+	})
+}
+
+// NewSobel the output will be a version of the input image with the Sobel edge detector
+// applied to the luminosity of each pixel, so usually the input is a grayscale image. A value of -1 for threshold
 // will return an image whos rgb values are the sobel intensity values, if 0 <= threshold <= 255
 // then the rgb values will be 255 if the intensity is >= threshold and 0 if the intensity
 // is < threshold
@@ -24,33 +38,18 @@ func NewSobel(threshold int, invert bool) Effect {
 }
 
 func (s *sobel) Apply(img *Image, numRoutines int) (*Image, error) {
-	if numRoutines == 0 {
-		numRoutines = runtime.GOMAXPROCS(0)
-	}
+	return s.ApplyContext(context.Background(), img, numRoutines)
+}
 
-	sobelX := [][]int{
-		{-1, 0, 1},
-		{-2, 0, 2},
-		{-1, 0, 1},
-	}
-	sobelY := [][]int{
-		{-1, -2, -1},
-		{0, 0, 0},
-		{1, 2, 1},
-	}
+func (s *sobel) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	numRoutines = routines(numRoutines)
 
+	sobelX, sobelY := sobelKernels(img.img.Stride)
 	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
-		var px, py int
-		for dy := -1; dy <= 1; dy++ {
-			for dx := -1; dx <= 1; dx++ {
-				pOffset := offset + (dx*4 + dy*inStride)
-				r := int(inPix[pOffset])
-				px += sobelX[dx+1][dy+1] * r
-				py += sobelY[dx+1][dy+1] * r
-			}
-		}
+		px := sobelX.sumLuminosity(offset, inPix)
+		py := sobelY.sumLuminosity(offset, inPix)
 
-		val := uint8(math.Sqrt(float64(px*px + py*py)))
+		val := clampUint8(math.Sqrt(px*px + py*py))
 		if s.threshold != -1 {
 			if val >= uint8(s.threshold) {
 				val = 255
@@ -62,10 +61,13 @@ func (s *sobel) Apply(img *Image, numRoutines int) (*Image, error) {
 		if s.invert {
 			val = 255 - val
 		}
+		// Transparent pixels stay transparent, the edges are drawn with the alpha of the input
+		a := inPix[offset+3]
+		val = premultiply(val, a)
 		outPix[offset] = val
 		outPix[offset+1] = val
 		outPix[offset+2] = val
-		outPix[offset+3] = 255
+		outPix[offset+3] = a
 	}
 
 	out := &Image{
@@ -83,6 +85,32 @@ func (s *sobel) Apply(img *Image, numRoutines int) (*Image, error) {
 		},
 	}
 
-	runParallel(numRoutines, img, out.Bounds, out, pf, 0)
+	if err := runParallel(ctx, numRoutines, img, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
+
+// sobelKernels returns the kernels used to compute the horizontal and vertical
+// gradients of an image with the specified stride
+func sobelKernels(stride int) (*kernel, *kernel) {
+	sobelX := newKernel([][]float64{
+		{-1, 0, 1},
+		{-2, 0, 2},
+		{-1, 0, 1},
+	}, stride)
+	sobelY := newKernel([][]float64{
+		{-1, -2, -1},
+		{0, 0, 0},
+		{1, 2, 1},
+	}, stride)
+	return sobelX, sobelY
+}
+
+func (s *sobel) kernelRadius() int {
+	return 1
+}
+
+func (s *sobel) Spec() EffectSpec {
+	return EffectSpec{Effect: "sobel", Params: Params{"threshold": s.threshold, "invert": s.invert}}
+}
@@ -0,0 +1,227 @@
+package effects
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EffectSpec describes an effect and its parameters. In JSON and YAML it is written as a single
+// object with an "effect" key naming the effect and a key for each parameter, for example:
+//
+//	{"effect": "oil", "filterSize": 5, "levels": 30}
+//
+// Any effect can also have "border" and "borderColor" parameters, in which case the effect is
+// wrapped with WithBorder, border is one of shrink, clamp, mirror, wrap or constant
+type EffectSpec struct {
+	Effect string
+	Params Params
+}
+
+// Serializable is implemented by effects that can describe themselves as an EffectSpec. All of
+// the effects in this package implement it, which is what allows a Pipeline to be marshaled
+type Serializable interface {
+	Spec() EffectSpec
+}
+
+// PipelineSpec is a declarative description of a Pipeline, listing its effects in order
+type PipelineSpec struct {
+	Effects []EffectSpec `json:"effects" yaml:"effects"`
+}
+
+// MarshalJSON writes the spec as a single object, with the effect name first
+func (s EffectSpec) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	name, err := json.Marshal(s.Effect)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(`{"effect":`)
+	buf.Write(name)
+	for _, k := range s.paramNames() {
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(specValue(s.Params[k]))
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON reads a spec written by MarshalJSON
+func (s *EffectSpec) UnmarshalJSON(data []byte) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	return s.fromMap(m)
+}
+
+// MarshalYAML writes the spec as a single mapping, with the effect name first
+func (s EffectSpec) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: "effect"},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: s.Effect},
+	)
+	for _, k := range s.paramNames() {
+		value := &yaml.Node{}
+		if err := value.Encode(specValue(s.Params[k])); err != nil {
+			return nil, err
+		}
+		if value.Kind == yaml.SequenceNode {
+			// Kernels are much easier to read with one row per line
+			for _, row := range value.Content {
+				row.Style = yaml.FlowStyle
+			}
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: k}, value)
+	}
+	return node, nil
+}
+
+// UnmarshalYAML reads a spec written by MarshalYAML
+func (s *EffectSpec) UnmarshalYAML(value *yaml.Node) error {
+	var m map[string]interface{}
+	if err := value.Decode(&m); err != nil {
+		return err
+	}
+	return s.fromMap(m)
+}
+
+func (s *EffectSpec) fromMap(m map[string]interface{}) error {
+	name, ok := m["effect"].(string)
+	if !ok || name == "" {
+		return fmt.Errorf("effect spec is missing the effect name")
+	}
+	s.Effect = name
+	s.Params = Params{}
+	for k, v := range m {
+		if k != "effect" {
+			s.Params[k] = v
+		}
+	}
+	return nil
+}
+
+func (s EffectSpec) paramNames() []string {
+	names := make([]string, 0, len(s.Params))
+	for k := range s.Params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// specValue converts a parameter to the value written in a spec
+func specValue(v interface{}) interface{} {
+	if c, ok := v.(color.RGBA); ok {
+		return FormatColor(c)
+	}
+	return v
+}
+
+// NewPipeline creates a pipeline from a spec, each effect is created with NewEffect
+func NewPipeline(spec PipelineSpec) (*Pipeline, error) {
+	p := &Pipeline{}
+	for i, es := range spec.Effects {
+		e, err := NewEffect(es)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline effect %d: %s", i, err)
+		}
+		p.Add(e, nil)
+	}
+	return p, nil
+}
+
+// Spec returns a spec describing the pipeline. Every effect in the pipeline must implement
+// Serializable, callbacks passed to Add are not part of the spec
+func (p Pipeline) Spec() (PipelineSpec, error) {
+	spec := PipelineSpec{Effects: []EffectSpec{}}
+	for i, item := range p.effects {
+		s, ok := item.effect.(Serializable)
+		if !ok {
+			return PipelineSpec{}, fmt.Errorf("pipeline effect %d (%T) does not implement Serializable", i, item.effect)
+		}
+		spec.Effects = append(spec.Effects, s.Spec())
+	}
+	return spec, nil
+}
+
+// MarshalJSON writes the pipeline spec as JSON
+func (p Pipeline) MarshalJSON() ([]byte, error) {
+	spec, err := p.Spec()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spec)
+}
+
+// UnmarshalJSON replaces the effects in the pipeline with the ones in the JSON spec
+func (p *Pipeline) UnmarshalJSON(data []byte) error {
+	var spec PipelineSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	return p.fromSpec(spec)
+}
+
+// MarshalYAML writes the pipeline spec as YAML
+func (p Pipeline) MarshalYAML() (interface{}, error) {
+	return p.Spec()
+}
+
+// UnmarshalYAML replaces the effects in the pipeline with the ones in the YAML spec
+func (p *Pipeline) UnmarshalYAML(value *yaml.Node) error {
+	var spec PipelineSpec
+	if err := value.Decode(&spec); err != nil {
+		return err
+	}
+	return p.fromSpec(spec)
+}
+
+func (p *Pipeline) fromSpec(spec PipelineSpec) error {
+	np, err := NewPipeline(spec)
+	if err != nil {
+		return err
+	}
+	p.effects = np.effects
+	return nil
+}
+
+// LoadPipeline loads a pipeline spec from a .json, .yaml or .yml file
+func LoadPipeline(specPath string) (*Pipeline, error) {
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline spec: %s, %s", specPath, err)
+	}
+
+	p := &Pipeline{}
+	switch ext := strings.ToLower(path.Ext(specPath)); ext {
+	case ".json":
+		err = json.Unmarshal(data, p)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, p)
+	default:
+		return nil, fmt.Errorf("unsupported pipeline spec file type: %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pipeline spec: %s, %s", specPath, err)
+	}
+	return p, nil
+}
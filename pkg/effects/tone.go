@@ -0,0 +1,224 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// toneLUT maps each possible value of the red, green and blue channels to a new value. The values
+// are not premultiplied, so the table describes the tone change independently of alpha
+type toneLUT [3][256]uint8
+
+// newToneLUT returns a table that maps every channel through f, the result is clamped to 0-255
+func newToneLUT(f func(v float64) float64) *toneLUT {
+	var lut toneLUT
+	for v := 0; v < 256; v++ {
+		out := clampUint8(f(float64(v)))
+		lut[0][v] = out
+		lut[1][v] = out
+		lut[2][v] = out
+	}
+	return &lut
+}
+
+// applyToneLUT returns a new image with the red, green and blue channels of every pixel mapped
+// through the lookup table. Looking up a precomputed value is much faster than evaluating the
+// tone curve for every pixel
+func applyToneLUT(ctx context.Context, img *Image, numRoutines int, lut *toneLUT) (*Image, error) {
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		return lut[0][r], lut[1][g], lut[2][b]
+	})
+}
+
+type contrast struct {
+	amount   float64
+	midpoint int
+}
+
+type gamma struct {
+	gamma float64
+}
+
+// LevelsOpts options to pass to the levels effect
+type LevelsOpts struct {
+	// InBlack and InWhite are the input values that become black and white. Values below
+	// InBlack are clipped to black and values above InWhite are clipped to white
+	InBlack int
+	InWhite int
+
+	// Gamma adjusts the midtones after the input values have been stretched, values larger
+	// than 1 brighten the image and values smaller than 1 darken it. If 0, defaults to 1
+	Gamma float64
+
+	// OutBlack and OutWhite are the output values black and white are mapped to, they can be
+	// used to reduce the contrast of the image. OutBlack can be larger than OutWhite to invert
+	// the image
+	OutBlack int
+	OutWhite int
+}
+
+type levels struct {
+	opts LevelsOpts
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "contrast",
+		Description: "Increases or decreases the contrast around a midpoint",
+		Params: []ParamInfo{
+			{Name: "amount", Description: "contrast multiplier, 1 leaves the image unchanged and 0 makes it flat", Type: ParamFloat, Default: 1.0, Min: 0, Max: 10},
+			{Name: "midpoint", Description: "value that is left unchanged, values are pushed away from it", Type: ParamInt, Default: 128, Min: 0, Max: 255},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewContrast(p.Float("amount"), p.Int("midpoint")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "gamma",
+		Description: "Applies gamma correction, brightening or darkening the midtones",
+		Params: []ParamInfo{
+			{Name: "gamma", Description: "values larger than 1 brighten the image, smaller than 1 darken it", Type: ParamFloat, Default: 1.0, Min: 0.01, Max: 10},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewGamma(p.Float("gamma")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "levels",
+		Description: "Stretches the input black and white points to the output range",
+		Params: []ParamInfo{
+			{Name: "inBlack", Description: "input value that becomes black", Type: ParamInt, Default: 0, Min: 0, Max: 255},
+			{Name: "inWhite", Description: "input value that becomes white", Type: ParamInt, Default: 255, Min: 0, Max: 255},
+			{Name: "gamma", Description: "midtone adjustment, larger than 1 brightens", Type: ParamFloat, Default: 1.0, Min: 0.01, Max: 10},
+			{Name: "outBlack", Description: "output value black is mapped to", Type: ParamInt, Default: 0, Min: 0, Max: 255},
+			{Name: "outWhite", Description: "output value white is mapped to", Type: ParamInt, Default: 255, Min: 0, Max: 255},
+		},
+		New: func(p Params) (Effect, error) {
+			opts := LevelsOpts{
+				InBlack:  p.Int("inBlack"),
+				InWhite:  p.Int("inWhite"),
+				Gamma:    p.Float("gamma"),
+				OutBlack: p.Int("outBlack"),
+				OutWhite: p.Int("outWhite"),
+			}
+			if err := opts.validate(); err != nil {
+				return nil, err
+			}
+			return NewLevels(opts), nil
+		},
+	})
+}
+
+// NewContrast returns an effect that changes the contrast of the image. Each channel is moved
+// away from midpoint by amount, so values larger than 1 increase the contrast and values between
+// 0 and 1 reduce it, 0 makes every pixel the midpoint. 128 is a good midpoint for most images
+func NewContrast(amount float64, midpoint int) Effect {
+	return &contrast{amount: amount, midpoint: midpoint}
+}
+
+func (c *contrast) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *contrast) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if c.amount < 0 {
+		return nil, fmt.Errorf("contrast amount must not be negative, got: %v", c.amount)
+	}
+	mid := float64(c.midpoint)
+	lut := newToneLUT(func(v float64) float64 {
+		return (v-mid)*c.amount + mid
+	})
+	return applyToneLUT(ctx, img, numRoutines, lut)
+}
+
+func (c *contrast) Spec() EffectSpec {
+	return EffectSpec{Effect: "contrast", Params: Params{"amount": c.amount, "midpoint": c.midpoint}}
+}
+
+// NewGamma returns an effect that applies gamma correction, each channel is mapped to
+// 255 * (v/255)^(1/gamma). A gamma larger than 1 brightens the midtones and smaller than 1
+// darkens them, black and white are not changed
+func NewGamma(g float64) Effect {
+	return &gamma{gamma: g}
+}
+
+func (g *gamma) Apply(img *Image, numRoutines int) (*Image, error) {
+	return g.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (g *gamma) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if g.gamma <= 0 {
+		return nil, fmt.Errorf("gamma must be greater than 0, got: %v", g.gamma)
+	}
+	lut := newToneLUT(gammaCurve(g.gamma))
+	return applyToneLUT(ctx, img, numRoutines, lut)
+}
+
+func (g *gamma) Spec() EffectSpec {
+	return EffectSpec{Effect: "gamma", Params: Params{"gamma": g.gamma}}
+}
+
+// gammaCurve returns a function applying gamma correction to a value between 0 and 255
+func gammaCurve(g float64) func(v float64) float64 {
+	return func(v float64) float64 {
+		return 255 * math.Pow(v/255, 1/g)
+	}
+}
+
+// NewLevels returns an effect that maps the InBlack-InWhite range of each channel to the
+// OutBlack-OutWhite range, adjusting the midtones with Gamma. Stretching the range between the
+// darkest and lightest values in an image to 0-255 makes washed out images look more vivid
+func NewLevels(opts LevelsOpts) Effect {
+	return &levels{opts: opts}
+}
+
+func (l *levels) Apply(img *Image, numRoutines int) (*Image, error) {
+	return l.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (l *levels) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := l.opts.validate(); err != nil {
+		return nil, err
+	}
+	opts := l.opts
+	g := opts.Gamma
+	if g == 0 {
+		g = 1
+	}
+	inBlack, inRange := float64(opts.InBlack), float64(opts.InWhite-opts.InBlack)
+	outBlack, outRange := float64(opts.OutBlack), float64(opts.OutWhite-opts.OutBlack)
+	curve := gammaCurve(g)
+	lut := newToneLUT(func(v float64) float64 {
+		v = math.Min(math.Max((v-inBlack)/inRange, 0), 1)
+		return outBlack + curve(v*255)/255*outRange
+	})
+	return applyToneLUT(ctx, img, numRoutines, lut)
+}
+
+func (l *levels) Spec() EffectSpec {
+	g := l.opts.Gamma
+	if g == 0 {
+		g = 1
+	}
+	return EffectSpec{Effect: "levels", Params: Params{
+		"inBlack":  l.opts.InBlack,
+		"inWhite":  l.opts.InWhite,
+		"gamma":    g,
+		"outBlack": l.opts.OutBlack,
+		"outWhite": l.opts.OutWhite,
+	}}
+}
+
+func (opts LevelsOpts) validate() error {
+	if opts.InBlack < 0 || opts.InWhite > 255 || opts.InBlack >= opts.InWhite {
+		return fmt.Errorf("levels input range must be inside 0-255 and InBlack must be less than InWhite, got: %d-%d", opts.InBlack, opts.InWhite)
+	}
+	if opts.OutBlack < 0 || opts.OutBlack > 255 || opts.OutWhite < 0 || opts.OutWhite > 255 {
+		return fmt.Errorf("levels output range must be inside 0-255, got: %d-%d", opts.OutBlack, opts.OutWhite)
+	}
+	if opts.Gamma < 0 {
+		return fmt.Errorf("levels gamma must not be negative, got: %v", opts.Gamma)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// GradientStop is a color in a gradient. Pos is the position of the stop in the gradient, between
+// 0 for black and 1 for white. The color must be opaque
+type GradientStop struct {
+	Pos   float64
+	Color color.RGBA
+}
+
+type sepia struct {
+	intensity float64
+}
+
+type duotone struct {
+	shadow    color.RGBA
+	highlight color.RGBA
+}
+
+type gradientMap struct {
+	stops []GradientStop
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "sepia",
+		Description: "Tones the image with the warm brown of an old photograph",
+		Params: []ParamInfo{
+			{Name: "intensity", Description: "how much of the tone is blended with the original colors", Type: ParamFloat, Default: 1.0, Min: 0, Max: 1},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewSepia(p.Float("intensity")), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "duotone",
+		Description: "Maps the luminance of each pixel to a blend of a shadow and a highlight color",
+		Params: []ParamInfo{
+			{Name: "shadow", Description: "color of black pixels", Type: ParamColor, Default: color.RGBA{R: 32, G: 32, B: 96, A: 255}},
+			{Name: "highlight", Description: "color of white pixels", Type: ParamColor, Default: color.RGBA{R: 255, G: 208, B: 128, A: 255}},
+		},
+		New: func(p Params) (Effect, error) {
+			shadow, highlight := p.Color("shadow"), p.Color("highlight")
+			if err := validateDuotone(shadow, highlight); err != nil {
+				return nil, err
+			}
+			return NewDuotone(shadow, highlight), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "gradientMap",
+		Description: "Maps the luminance of each pixel through a gradient of colors",
+		Params: []ParamInfo{
+			{Name: "stops", Description: "colors of the gradient as pos,r,g,b rows, pos is between 0 for black and 1 for white e.g. 0,0,0,64;0.5,255,0,0;1,255,255,0", Type: ParamKernel, Default: [][]float64{{0, 0, 0, 0}, {1, 255, 255, 255}}},
+		},
+		New: func(p Params) (Effect, error) {
+			stops, err := rowsToStops(p.Kernel("stops"))
+			if err != nil {
+				return nil, err
+			}
+			if err := validateStops(stops); err != nil {
+				return nil, err
+			}
+			return NewGradientMap(stops), nil
+		},
+	})
+}
+
+// NewSepia returns an effect that gives the image the warm brown tone of an old photograph. Each
+// pixel is converted to gray using its luminosity, then red is raised and blue lowered. intensity
+// between 0 and 1 blends the toned pixel with the original, 1 is fully toned
+func NewSepia(intensity float64) Effect {
+	return &sepia{intensity: intensity}
+}
+
+func (s *sepia) Apply(img *Image, numRoutines int) (*Image, error) {
+	return s.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (s *sepia) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if s.intensity < 0 || s.intensity > 1 {
+		return nil, fmt.Errorf("sepia intensity must be between 0 and 1, got: %v", s.intensity)
+	}
+
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		l := luminosity(r, g, b)
+		sr, sg, sb := clampUint8(l+40), clampUint8(l+20), clampUint8(l-20)
+		return blend(r, sr, s.intensity), blend(g, sg, s.intensity), blend(b, sb, s.intensity)
+	})
+}
+
+func (s *sepia) Spec() EffectSpec {
+	return EffectSpec{Effect: "sepia", Params: Params{"intensity": s.intensity}}
+}
+
+// NewDuotone returns an effect that replaces the color of each pixel with a blend of two colors
+// based on its luminosity, black pixels become shadow and white pixels highlight. Both colors must
+// be opaque
+func NewDuotone(shadow, highlight color.RGBA) Effect {
+	return &duotone{shadow: shadow, highlight: highlight}
+}
+
+func (d *duotone) Apply(img *Image, numRoutines int) (*Image, error) {
+	return d.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (d *duotone) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := validateDuotone(d.shadow, d.highlight); err != nil {
+		return nil, err
+	}
+	return applyGradient(ctx, img, numRoutines, []GradientStop{{Pos: 0, Color: d.shadow}, {Pos: 1, Color: d.highlight}})
+}
+
+func (d *duotone) Spec() EffectSpec {
+	return EffectSpec{Effect: "duotone", Params: Params{
+		"shadow":    d.shadow,
+		"highlight": d.highlight,
+	}}
+}
+
+// NewGradientMap returns an effect that replaces the color of each pixel with the color at its
+// luminosity in a gradient. The colors are linearly interpolated between the stops, luminosities
+// before the first stop or after the last stop get the color of that stop. For example stops of
+// black at 0, red at 0.5 and yellow at 1 give a heat map
+func NewGradientMap(stops []GradientStop) Effect {
+	return &gradientMap{stops: stops}
+}
+
+func (gm *gradientMap) Apply(img *Image, numRoutines int) (*Image, error) {
+	return gm.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (gm *gradientMap) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := validateStops(gm.stops); err != nil {
+		return nil, err
+	}
+	return applyGradient(ctx, img, numRoutines, gm.stops)
+}
+
+func (gm *gradientMap) Spec() EffectSpec {
+	return EffectSpec{Effect: "gradientMap", Params: Params{"stops": stopsToRows(gm.stops)}}
+}
+
+func validateDuotone(shadow, highlight color.RGBA) error {
+	if shadow.A != 255 || highlight.A != 255 {
+		return fmt.Errorf("duotone colors must be opaque, got: %s and %s", FormatColor(shadow), FormatColor(highlight))
+	}
+	return nil
+}
+
+func validateStops(stops []GradientStop) error {
+	if len(stops) == 0 {
+		return fmt.Errorf("gradient must have at least 1 stop")
+	}
+	for _, s := range stops {
+		if s.Pos < 0 || s.Pos > 1 {
+			return fmt.Errorf("gradient stop position must be between 0 and 1, got: %v", s.Pos)
+		}
+		if s.Color.A != 255 {
+			return fmt.Errorf("gradient colors must be opaque, got: %v", s.Color)
+		}
+	}
+	return nil
+}
+
+// applyGradient maps the luminosity of every pixel through the gradient. The gradient is sampled
+// once for each of the 256 luminosity values, so the cost per pixel doesn't depend on the number
+// of stops
+func applyGradient(ctx context.Context, img *Image, numRoutines int, stops []GradientStop) (*Image, error) {
+	s := append([]GradientStop{}, stops...)
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].Pos < s[j].Pos
+	})
+
+	var lut [256]color.RGBA
+	for v := range lut {
+		pos := float64(v) / 255
+		i := sort.Search(len(s), func(i int) bool { return s[i].Pos > pos })
+		switch {
+		case i == 0:
+			lut[v] = s[0].Color
+		case i == len(s):
+			lut[v] = s[len(s)-1].Color
+		default:
+			a, b := s[i-1], s[i]
+			t := (pos - a.Pos) / (b.Pos - a.Pos)
+			lut[v] = color.RGBA{
+				R: blend(a.Color.R, b.Color.R, t),
+				G: blend(a.Color.G, b.Color.G, t),
+				B: blend(a.Color.B, b.Color.B, t),
+				A: 255,
+			}
+		}
+	}
+
+	return mapColors(ctx, img, numRoutines, func(r, g, b uint8) (uint8, uint8, uint8) {
+		c := lut[clampUint8(luminosity(r, g, b))]
+		return c.R, c.G, c.B
+	})
+}
+
+// rowsToStops converts rows of pos,r,g,b values, as used in pipeline specs, to gradient stops
+func rowsToStops(rows [][]float64) ([]GradientStop, error) {
+	stops := make([]GradientStop, len(rows))
+	for i, row := range rows {
+		if len(row) != 4 {
+			return nil, fmt.Errorf("each gradient stop must be pos,r,g,b, got: %v", row)
+		}
+		for _, v := range row[1:] {
+			if v < 0 || v > 255 || v != math.Trunc(v) {
+				return nil, fmt.Errorf("gradient stop colors must be whole numbers between 0 and 255, got: %v", row)
+			}
+		}
+		stops[i] = GradientStop{
+			Pos:   row[0],
+			Color: color.RGBA{R: uint8(row[1]), G: uint8(row[2]), B: uint8(row[3]), A: 255},
+		}
+	}
+	return stops, nil
+}
+
+func stopsToRows(stops []GradientStop) [][]float64 {
+	rows := make([][]float64, len(stops))
+	for i, s := range stops {
+		rows[i] = []float64{s.Pos, float64(s.Color.R), float64(s.Color.G), float64(s.Color.B)}
+	}
+	return rows
+}
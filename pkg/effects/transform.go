@@ -0,0 +1,516 @@
+package effects
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// ResampleFilter is the algorithm used to compute pixel values when an image is resized
+type ResampleFilter int
+
+const (
+	// ResampleNearest uses the value of the nearest pixel, it is fast but blocky
+	ResampleNearest ResampleFilter = iota
+
+	// ResampleBilinear linearly interpolates between the nearest pixels
+	ResampleBilinear
+
+	// ResampleBicubic uses a cubic (Catmull-Rom) filter, giving sharper results than bilinear
+	ResampleBicubic
+
+	// ResampleLanczos uses a 3 lobed Lanczos filter, which is the sharpest and slowest option
+	ResampleLanczos
+)
+
+// String returns the name of the filter as used in pipeline specs
+func (f ResampleFilter) String() string {
+	switch f {
+	case ResampleNearest:
+		return "nearest"
+	case ResampleBilinear:
+		return "bilinear"
+	case ResampleBicubic:
+		return "bicubic"
+	case ResampleLanczos:
+		return "lanczos"
+	default:
+		return fmt.Sprintf("ResampleFilter(%d)", int(f))
+	}
+}
+
+func parseResampleFilter(s string) (ResampleFilter, error) {
+	for _, f := range []ResampleFilter{ResampleNearest, ResampleBilinear, ResampleBicubic, ResampleLanczos} {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown resample filter: %s", s)
+}
+
+type resize struct {
+	width  int
+	height int
+	filter ResampleFilter
+}
+
+func init() {
+	Register(EffectInfo{
+		Name:        "resize",
+		Description: "Resizes the image, keeping the aspect ratio if only one dimension is set",
+		Params: []ParamInfo{
+			{Name: "width", Description: "output width, 0 to keep the aspect ratio", Type: ParamInt, Default: 0, Min: 0, Max: 65535},
+			{Name: "height", Description: "output height, 0 to keep the aspect ratio", Type: ParamInt, Default: 0, Min: 0, Max: 65535},
+			{Name: "filter", Description: "resampling filter", Type: ParamString, Default: ResampleBilinear.String(), Values: []string{ResampleNearest.String(), ResampleBilinear.String(), ResampleBicubic.String(), ResampleLanczos.String()}},
+		},
+		New: func(p Params) (Effect, error) {
+			if p.Int("width") == 0 && p.Int("height") == 0 {
+				return nil, fmt.Errorf("one of width or height must be set")
+			}
+			filter, err := parseResampleFilter(p.String("filter"))
+			if err != nil {
+				return nil, err
+			}
+			return NewResize(p.Int("width"), p.Int("height"), filter), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "crop",
+		Description: "Crops the image to a rectangle",
+		Params: []ParamInfo{
+			{Name: "x", Description: "left edge of the rectangle", Type: ParamInt, Default: 0, Min: 0, Max: 65535},
+			{Name: "y", Description: "top edge of the rectangle", Type: ParamInt, Default: 0, Min: 0, Max: 65535},
+			{Name: "width", Description: "width of the rectangle", Type: ParamInt, Min: 1, Max: 65535},
+			{Name: "height", Description: "height of the rectangle", Type: ParamInt, Min: 1, Max: 65535},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewCrop(Rect{X: p.Int("x"), Y: p.Int("y"), Width: p.Int("width"), Height: p.Int("height")}), nil
+		},
+	})
+	Register(EffectInfo{
+		Name:        "rotate",
+		Description: "Rotates the image clockwise by any angle, expanding it to fit",
+		Params: []ParamInfo{
+			{Name: "degrees", Description: "angle to rotate clockwise", Type: ParamFloat, Min: -360, Max: 360},
+			{Name: "background", Description: "color of the uncovered corners", Type: ParamColor, Default: color.RGBA{}},
+		},
+		New: func(p Params) (Effect, error) {
+			return NewRotate(p.Float("degrees"), p.Color("background")), nil
+		},
+	})
+	for _, t := range []struct {
+		effect      Effect
+		description string
+	}{
+		{NewRotate90(), "Rotates the image 90 degrees clockwise"},
+		{NewRotate180(), "Rotates the image 180 degrees"},
+		{NewRotate270(), "Rotates the image 270 degrees clockwise"},
+		{NewFlipH(), "Mirrors the image horizontally"},
+		{NewFlipV(), "Mirrors the image vertically"},
+	} {
+		e := t.effect
+		Register(EffectInfo{
+			Name:        e.(Serializable).Spec().Effect,
+			Description: t.description,
+			New: func(p Params) (Effect, error) {
+				return e, nil
+			},
+		})
+	}
+}
+
+// NewResize returns an effect that resizes the part of the image inside its Bounds to width x height
+// pixels. If one of width or height is 0 it is computed so the aspect ratio is preserved. When the
+// image is made smaller the filter is widened, so every input pixel contributes to the output
+func NewResize(width, height int, filter ResampleFilter) Effect {
+	return &resize{width: width, height: height, filter: filter}
+}
+
+func (r *resize) Apply(img *Image, numRoutines int) (*Image, error) {
+	return r.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (r *resize) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	srcW := img.Bounds.Width
+	srcH := img.Bounds.Height
+	if srcW == 0 || srcH == 0 {
+		return nil, fmt.Errorf("image bounds are empty")
+	}
+
+	width, height := r.width, r.height
+	if width < 0 || height < 0 || (width == 0 && height == 0) {
+		return nil, fmt.Errorf("invalid resize dimensions: %dx%d", width, height)
+	}
+	if width == 0 {
+		width = int(math.Max(1, math.Floor(float64(srcW*height)/float64(srcH)+0.5)))
+	}
+	if height == 0 {
+		height = int(math.Max(1, math.Floor(float64(srcH*width)/float64(srcW)+0.5)))
+	}
+	if err := checkSize(ctx, width, height); err != nil {
+		return nil, err
+	}
+
+	numRoutines = routines(numRoutines)
+
+	support, kernel, err := r.kernel()
+	if err != nil {
+		return nil, err
+	}
+	xWeights := resampleWeights(srcW, width, support, kernel)
+	yWeights := resampleWeights(srcH, height, support, kernel)
+
+	// The resize is separable, so first the width is changed, then the height
+	tmp := newImage(width, srcH)
+	srcPix := img.img.Pix
+	srcStride := img.img.Stride
+	pfHorizontal := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		var r, g, b, a float64
+		c := xWeights[x]
+		rowOffset := (img.Bounds.Y+y)*srcStride + img.Bounds.X*4
+		for i, w := range c.weights {
+			sOffset := rowOffset + (c.start+i)*4
+			r += w * float64(srcPix[sOffset])
+			g += w * float64(srcPix[sOffset+1])
+			b += w * float64(srcPix[sOffset+2])
+			a += w * float64(srcPix[sOffset+3])
+		}
+		// The negative lobes of the bicubic and lanczos filters can overshoot, a premultiplied
+		// color can't be larger than its alpha
+		alpha := float64(clampUint8(a))
+		outPix[offset] = clampAlpha(r, alpha)
+		outPix[offset+1] = clampAlpha(g, alpha)
+		outPix[offset+2] = clampAlpha(b, alpha)
+		outPix[offset+3] = uint8(alpha)
+	}
+	if err := runParallel(subProgress(ctx, 0, 0.5), numRoutines, tmp, tmp.Bounds, tmp, pfHorizontal, 0); err != nil {
+		return nil, err
+	}
+
+	out := newImage(width, height)
+	tmpPix := tmp.img.Pix
+	tmpStride := tmp.img.Stride
+	pfVertical := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		var r, g, b, a float64
+		c := yWeights[y]
+		for i, w := range c.weights {
+			sOffset := (c.start+i)*tmpStride + x*4
+			r += w * float64(tmpPix[sOffset])
+			g += w * float64(tmpPix[sOffset+1])
+			b += w * float64(tmpPix[sOffset+2])
+			a += w * float64(tmpPix[sOffset+3])
+		}
+		alpha := float64(clampUint8(a))
+		outPix[offset] = clampAlpha(r, alpha)
+		outPix[offset+1] = clampAlpha(g, alpha)
+		outPix[offset+2] = clampAlpha(b, alpha)
+		outPix[offset+3] = uint8(alpha)
+	}
+	if err := runParallel(subProgress(ctx, 0.5, 1), numRoutines, out, out.Bounds, out, pfVertical, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *resize) Spec() EffectSpec {
+	return EffectSpec{Effect: "resize", Params: Params{"width": r.width, "height": r.height, "filter": r.filter.String()}}
+}
+
+// kernel returns the support, the distance either side of the center where the filter is non-zero,
+// and the filter function
+func (r *resize) kernel() (float64, func(float64) float64, error) {
+	switch r.filter {
+	case ResampleNearest:
+		return 0, nil, nil
+	case ResampleBilinear:
+		return 1, func(x float64) float64 {
+			return 1 - math.Abs(x)
+		}, nil
+	case ResampleBicubic:
+		return 2, func(x float64) float64 {
+			// Catmull-Rom, the cubic convolution kernel with a = -0.5
+			x = math.Abs(x)
+			if x < 1 {
+				return 1.5*x*x*x - 2.5*x*x + 1
+			}
+			return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+		}, nil
+	case ResampleLanczos:
+		return 3, func(x float64) float64 {
+			if x == 0 {
+				return 1
+			}
+			px := math.Pi * x
+			return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+		}, nil
+	default:
+		return 0, nil, fmt.Errorf("unknown resample filter: %d", r.filter)
+	}
+}
+
+// contribution is the set of source pixels, and their weights, that make up one output pixel
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// resampleWeights returns the contributions for each of the dstSize output pixels when resampling
+// a row or column of srcSize pixels. A nil kernel means nearest neighbour sampling
+func resampleWeights(srcSize, dstSize int, support float64, kernel func(float64) float64) []contribution {
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := math.Max(scale, 1)
+	support *= filterScale
+
+	contributions := make([]contribution, dstSize)
+	for i := range contributions {
+		center := (float64(i)+0.5)*scale - 0.5
+		if kernel == nil {
+			src := rangeInt(int(math.Floor(center+0.5)), 0, srcSize-1)
+			contributions[i] = contribution{start: src, weights: []float64{1}}
+			continue
+		}
+
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		start = rangeInt(start, 0, srcSize-1)
+		end = rangeInt(end, 0, srcSize-1)
+
+		weights := make([]float64, end-start+1)
+		var sum float64
+		for j := range weights {
+			w := kernel((float64(start+j) - center) / filterScale)
+			if math.Abs(float64(start+j)-center) >= support {
+				w = 0
+			}
+			weights[j] = w
+			sum += w
+		}
+		if sum == 0 {
+			// Can only happen if all of the taps were clamped away, fall back to the nearest pixel
+			src := rangeInt(int(math.Floor(center+0.5)), 0, srcSize-1)
+			contributions[i] = contribution{start: src, weights: []float64{1}}
+			continue
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		contributions[i] = contribution{start: start, weights: weights}
+	}
+	return contributions
+}
+
+type crop struct {
+	rect Rect
+}
+
+// NewCrop returns an effect that crops the image to the specified rectangle, which is clipped to the
+// Bounds of the image. The output image has its origin at 0,0
+func NewCrop(r Rect) Effect {
+	return &crop{rect: r}
+}
+
+func (c *crop) Apply(img *Image, numRoutines int) (*Image, error) {
+	return c.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (c *crop) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.rect.Intersect(img.Bounds).IsEmpty() {
+		return nil, fmt.Errorf("crop rectangle does not overlap the image: %s", c.rect)
+	}
+	return img.SubImage(c.rect), nil
+}
+
+func (c *crop) Spec() EffectSpec {
+	return EffectSpec{Effect: "crop", Params: Params{
+		"x":      c.rect.X,
+		"y":      c.rect.Y,
+		"width":  c.rect.Width,
+		"height": c.rect.Height,
+	}}
+}
+
+type rotateQuarter struct {
+	turns int
+}
+
+// NewRotate90 returns an effect that rotates the image 90 degrees clockwise
+func NewRotate90() Effect {
+	return &rotateQuarter{turns: 1}
+}
+
+// NewRotate180 returns an effect that rotates the image 180 degrees
+func NewRotate180() Effect {
+	return &rotateQuarter{turns: 2}
+}
+
+// NewRotate270 returns an effect that rotates the image 270 degrees clockwise, which is the same as
+// 90 degrees counter clockwise
+func NewRotate270() Effect {
+	return &rotateQuarter{turns: 3}
+}
+
+func (r *rotateQuarter) Apply(img *Image, numRoutines int) (*Image, error) {
+	return r.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (r *rotateQuarter) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	w := img.Bounds.Width
+	h := img.Bounds.Height
+	switch r.turns {
+	case 1:
+		return remap(ctx, img, h, w, numRoutines, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 2:
+		return remap(ctx, img, w, h, numRoutines, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	default:
+		return remap(ctx, img, h, w, numRoutines, func(x, y int) (int, int) { return w - 1 - y, x })
+	}
+}
+
+func (r *rotateQuarter) Spec() EffectSpec {
+	return EffectSpec{Effect: fmt.Sprintf("rotate%d", r.turns*90), Params: Params{}}
+}
+
+type flip struct {
+	horizontal bool
+}
+
+// NewFlipH returns an effect that mirrors the image horizontally, so the left edge becomes the right edge
+func NewFlipH() Effect {
+	return &flip{horizontal: true}
+}
+
+// NewFlipV returns an effect that mirrors the image vertically, so the top edge becomes the bottom edge
+func NewFlipV() Effect {
+	return &flip{horizontal: false}
+}
+
+func (f *flip) Apply(img *Image, numRoutines int) (*Image, error) {
+	return f.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (f *flip) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	w := img.Bounds.Width
+	h := img.Bounds.Height
+	if f.horizontal {
+		return remap(ctx, img, w, h, numRoutines, func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+	return remap(ctx, img, w, h, numRoutines, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+func (f *flip) Spec() EffectSpec {
+	if f.horizontal {
+		return EffectSpec{Effect: "flipH", Params: Params{}}
+	}
+	return EffectSpec{Effect: "flipV", Params: Params{}}
+}
+
+// remap returns a new width x height image, where the pixel at x,y is copied from the pixel at
+// src(x,y) relative to the Bounds of img
+func remap(ctx context.Context, img *Image, width, height, numRoutines int, src func(x, y int) (int, int)) (*Image, error) {
+	if err := checkSize(ctx, width, height); err != nil {
+		return nil, err
+	}
+	numRoutines = routines(numRoutines)
+
+	out := newImage(width, height)
+	srcPix := img.img.Pix
+	srcStride := img.img.Stride
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		sx, sy := src(x, y)
+		sOffset := (img.Bounds.Y+sy)*srcStride + (img.Bounds.X+sx)*4
+		copy(outPix[offset:offset+4], srcPix[sOffset:sOffset+4])
+	}
+	if err := runParallel(ctx, numRoutines, out, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type rotate struct {
+	degrees    float64
+	background color.RGBA
+}
+
+// NewRotate returns an effect that rotates the image clockwise by any number of degrees around its
+// center. The output image is enlarged so the whole rotated image fits inside it, and the areas not
+// covered by the image are filled with the background color. Pixels are bilinearly interpolated
+func NewRotate(degrees float64, background color.RGBA) Effect {
+	return &rotate{degrees: degrees, background: background}
+}
+
+func (r *rotate) Apply(img *Image, numRoutines int) (*Image, error) {
+	return r.ApplyContext(context.Background(), img, numRoutines)
+}
+
+func (r *rotate) ApplyContext(ctx context.Context, img *Image, numRoutines int) (*Image, error) {
+	w := img.Bounds.Width
+	h := img.Bounds.Height
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("image bounds are empty")
+	}
+
+	numRoutines = routines(numRoutines)
+
+	rad := r.degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	// Round away tiny errors, so rotating by a multiple of 90 degrees doesn't grow the image
+	outW := int(math.Ceil(math.Abs(float64(w)*cos) + math.Abs(float64(h)*sin) - 1e-6))
+	outH := int(math.Ceil(math.Abs(float64(w)*sin) + math.Abs(float64(h)*cos) - 1e-6))
+	if err := checkSize(ctx, outW, outH); err != nil {
+		return nil, err
+	}
+
+	out := newImage(outW, outH)
+	srcPix := img.img.Pix
+	srcStride := img.img.Stride
+	cx, cy := float64(w)/2, float64(h)/2
+	ocx, ocy := float64(outW)/2, float64(outH)/2
+	bg := [4]float64{float64(r.background.R), float64(r.background.G), float64(r.background.B), float64(r.background.A)}
+
+	pf := func(ri, x, y, offset, inStride int, inPix, outPix []uint8) {
+		// Rotate the center of the output pixel back in to the source image
+		dx := float64(x) + 0.5 - ocx
+		dy := float64(y) + 0.5 - ocy
+		sx := dx*cos + dy*sin + cx - 0.5
+		sy := -dx*sin + dy*cos + cy - 0.5
+
+		x0 := int(math.Floor(sx))
+		y0 := int(math.Floor(sy))
+		fx := sx - float64(x0)
+		fy := sy - float64(y0)
+
+		var c [4]float64
+		for j := 0; j < 2; j++ {
+			for i := 0; i < 2; i++ {
+				wgt := (1 - math.Abs(float64(i)-fx)) * (1 - math.Abs(float64(j)-fy))
+				px, py := x0+i, y0+j
+				if px < 0 || py < 0 || px >= w || py >= h {
+					for k := range c {
+						c[k] += wgt * bg[k]
+					}
+					continue
+				}
+				sOffset := (img.Bounds.Y+py)*srcStride + (img.Bounds.X+px)*4
+				for k := range c {
+					c[k] += wgt * float64(srcPix[sOffset+k])
+				}
+			}
+		}
+		for k := range c {
+			outPix[offset+k] = clampUint8(c[k])
+		}
+	}
+	if err := runParallel(ctx, numRoutines, out, out.Bounds, out, pf, 0); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *rotate) Spec() EffectSpec {
+	return EffectSpec{Effect: "rotate", Params: Params{"degrees": r.degrees, "background": r.background}}
+}